@@ -0,0 +1,53 @@
+package analyzer
+
+import (
+	"net"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// normalizeIP returns the canonical form of an IPv4 or IPv6 address, with
+// any prefix length dropped, or "" if s is not an address. Docker and
+// packets spell IPv6 addresses in different ways; nodes and the inventory
+// are keyed by this form.
+func normalizeIP(s string) string {
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		s = s[:i]
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func isIPv4(s string) bool {
+	ip := net.ParseIP(s)
+	return ip != nil && ip.To4() != nil
+}
+
+// identifies reports whether ip names a single host beyond its link.
+// Link-local addresses repeat on every link, multicast and unspecified ones
+// name no host, so traffic to or from them is no dependency.
+func identifies(ip string) bool {
+	addr := net.ParseIP(ip)
+	return addr != nil && !addr.IsUnspecified() && !addr.IsLinkLocalUnicast() && !addr.IsMulticast()
+}
+
+// neighborDiscovery reports whether packet is IPv6 router or neighbor
+// discovery, which goes between global addresses too.
+func neighborDiscovery(packet gopacket.Packet) bool {
+	icmp, ok := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+	if !ok {
+		return false
+	}
+	switch icmp.TypeCode.Type() {
+	case layers.ICMPv6TypeRouterSolicitation, layers.ICMPv6TypeRouterAdvertisement,
+		layers.ICMPv6TypeNeighborSolicitation, layers.ICMPv6TypeNeighborAdvertisement,
+		layers.ICMPv6TypeRedirect:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+package analyzer
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Ports assumed to be served, when neither a handshake nor a listening
+// socket tells which end of a connection is the server.
+var wellKnownPorts = map[int]bool{
+	53: true, 80: true, 443: true, 1433: true, 1521: true, 2181: true,
+	2379: true, 3000: true, 3306: true, 4222: true, 5000: true, 5432: true,
+	5672: true, 6379: true, 8000: true, 8080: true, 8443: true, 8500: true,
+	9000: true, 9042: true, 9090: true, 9092: true, 9200: true, 11211: true,
+	15672: true, 27017: true,
+}
+
+// Linux hands out ephemeral ports from 32768 by default.
+const ephemeralPortStart = 32768
+
+// hostPort is one end of a transport flow.
+type hostPort struct {
+	ip    string
+	port  int
+	proto string
+}
+
+// conversation is a connection with its ends told apart.
+type conversation struct {
+	client, server hostPort
+	seen           time.Time
+}
+
+// flowKey identifies a connection regardless of the direction of a packet.
+type flowKey struct {
+	proto  string
+	lo, hi hostPort
+}
+
+func newFlowKey(a, b hostPort) flowKey {
+	if a.ip > b.ip || (a.ip == b.ip && a.port > b.port) {
+		a, b = b, a
+	}
+	return flowKey{proto: a.proto, lo: a, hi: b}
+}
+
+// conversationTable remembers which end of every connection is the client.
+// It is shared by all captures.
+type conversationTable struct {
+	mu    sync.Mutex
+	convs map[flowKey]*conversation
+	// listening holds the ends seen accepting a TCP handshake, with when
+	// they last served a packet.
+	listening map[hostPort]time.Time
+}
+
+var conversations = &conversationTable{
+	convs:     make(map[flowKey]*conversation),
+	listening: make(map[hostPort]time.Time),
+}
+
+// packetEnds returns the source and destination of the packet's transport
+// flow. Packets without TCP or UDP get port 0 and the IP protocol name.
+func packetEnds(packet gopacket.Packet) (src, dst hostPort, tcp *layers.TCP) {
+	flow := packet.NetworkLayer().NetworkFlow()
+	src = hostPort{ip: flow.Src().String()}
+	dst = hostPort{ip: flow.Dst().String()}
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		src.proto = strings.ToLower(ip.Protocol.String())
+	case *layers.IPv6:
+		src.proto = strings.ToLower(ip.NextHeader.String())
+	}
+	dst.proto = src.proto
+	switch t := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		src.port, dst.port = int(t.SrcPort), int(t.DstPort)
+		src.proto, dst.proto = "tcp", "tcp"
+		tcp = t
+	case *layers.UDP:
+		src.port, dst.port = int(t.SrcPort), int(t.DstPort)
+		src.proto, dst.proto = "udp", "udp"
+	}
+	return src, dst, tcp
+}
+
+// classify returns the conversation the packet from src to dst belongs to.
+// A SYN or SYN-ACK settles the direction of a TCP connection for good;
+// otherwise it is guessed from the ports, and from the containers as seen
+// from the daemon home. seen is the time of the packet. opened reports
+// whether the packet is the first of a handshake seen for the connection,
+// so retransmitted SYNs and the SYN-ACK answering a SYN are not.
+func (t *conversationTable) classify(src, dst hostPort, tcp *layers.TCP, seen time.Time, home *daemon) (c *conversation, opened bool) {
+	key := newFlowKey(src, dst)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var handshake *conversation
+	if tcp != nil && tcp.SYN {
+		if tcp.ACK {
+			handshake = &conversation{client: dst, server: src}
+		} else {
+			handshake = &conversation{client: src, server: dst}
+		}
+		t.listening[handshake.server] = seen
+	}
+
+	c, ok := t.convs[key]
+	if handshake != nil && (!ok || c.client != handshake.client) {
+		c = handshake
+		t.convs[key] = c
+		opened = true
+	} else if !ok {
+		if t.serves(dst, src, home) {
+			c = &conversation{client: src, server: dst}
+		} else {
+			c = &conversation{client: dst, server: src}
+		}
+		t.convs[key] = c
+	}
+	c.seen = seen
+	if _, ok := t.listening[c.server]; ok {
+		t.listening[c.server] = seen
+	}
+	return c, opened
+}
+
+// serves reports whether a is more likely than b to be the server end, as
+// seen from home. t.mu must be held.
+func (t *conversationTable) serves(a, b hostPort, home *daemon) bool {
+	_, la := t.listening[a]
+	_, lb := t.listening[b]
+	if la, lb = la || exposes(a, home), lb || exposes(b, home); la != lb {
+		return la
+	}
+	if wa, wb := wellKnownPorts[a.port], wellKnownPorts[b.port]; wa != wb {
+		return wa
+	}
+	if ea, eb := a.port >= ephemeralPortStart, b.port >= ephemeralPortStart; ea != eb {
+		return eb
+	}
+	return a.port <= b.port
+}
+
+// exposes reports whether the container owning the address, as seen from
+// home, declares the port in its image or run configuration.
+func exposes(hp hostPort, home *daemon) bool {
+	if hp.port == 0 {
+		return false
+	}
+	container, ok := containerByIP(hp.ip, home)
+	if !ok || container.Config == nil {
+		return false
+	}
+	port, err := nat.NewPort(hp.proto, strconv.Itoa(hp.port))
+	if err != nil {
+		return false
+	}
+	_, ok = container.Config.ExposedPorts[port]
+	return ok
+}
+
+// sweep forgets conversations and listening ports idle since before t.
+func (t *conversationTable) sweep(before time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, c := range t.convs {
+		if c.seen.Before(before) {
+			delete(t.convs, key)
+		}
+	}
+	for hp, seen := range t.listening {
+		if seen.Before(before) {
+			delete(t.listening, hp)
+		}
+	}
+}
+
+// forget drops the listening ports learned on the addresses ips, whose
+// container is gone and which may be given to another one.
+func (t *conversationTable) forget(ips map[string]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for hp := range t.listening {
+		if _, ok := ips[hp.ip]; ok {
+			delete(t.listening, hp)
+		}
+	}
+}
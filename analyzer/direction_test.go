@@ -0,0 +1,153 @@
+package analyzer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestClassify(t *testing.T) {
+	type packet struct {
+		src, dst hostPort
+		tcp      *layers.TCP
+	}
+	var (
+		syn    = &layers.TCP{SYN: true}
+		synAck = &layers.TCP{SYN: true, ACK: true}
+		ack    = &layers.TCP{ACK: true}
+
+		web      = hostPort{ip: "172.17.0.2", port: 8080, proto: "tcp"}
+		client   = hostPort{ip: "172.17.0.3", port: 41000, proto: "tcp"}
+		custom   = hostPort{ip: "172.17.0.2", port: 7000, proto: "tcp"}
+		highPort = hostPort{ip: "172.17.0.3", port: 7001, proto: "tcp"}
+		dns      = hostPort{ip: "10.0.0.53", port: 53, proto: "udp"}
+		resolver = hostPort{ip: "172.17.0.3", port: 50000, proto: "udp"}
+		other    = hostPort{ip: "172.17.0.4", port: 41001, proto: "tcp"}
+	)
+
+	tests := []struct {
+		name    string
+		packets []packet
+		client  hostPort
+		opened  int // packets that opened a connection
+	}{
+		{
+			name:    "syn from the client",
+			packets: []packet{{client, web, syn}},
+			client:  client,
+			opened:  1,
+		},
+		{
+			name:    "syn-ack from the server",
+			packets: []packet{{web, client, synAck}},
+			client:  client,
+			opened:  1,
+		},
+		{
+			name:    "handshake overrides the ports",
+			packets: []packet{{web, client, ack}, {web, client, syn}, {client, web, ack}},
+			client:  web,
+			opened:  1,
+		},
+		{
+			name:    "retransmitted syn and its syn-ack open once",
+			packets: []packet{{client, web, syn}, {client, web, syn}, {web, client, synAck}, {client, web, ack}},
+			client:  client,
+			opened:  1,
+		},
+		{
+			name:    "well-known port without handshake",
+			packets: []packet{{web, client, ack}},
+			client:  client,
+		},
+		{
+			name:    "udp reply to a well-known port",
+			packets: []packet{{dns, resolver, nil}},
+			client:  resolver,
+		},
+		{
+			name:    "ephemeral port is the client",
+			packets: []packet{{custom, client, ack}},
+			client:  client,
+		},
+		{
+			name:    "lower port without any other hint",
+			packets: []packet{{highPort, custom, ack}},
+			client:  highPort,
+		},
+		{
+			name: "listening port learned from another connection",
+			packets: []packet{
+				{other, custom, syn},
+				{custom, highPort, ack},
+			},
+			client: highPort,
+			opened: 1,
+		},
+		{
+			name:    "direction sticks to the first packet",
+			packets: []packet{{client, web, ack}, {web, client, ack}},
+			client:  client,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := &conversationTable{
+				convs:     make(map[flowKey]*conversation),
+				listening: make(map[hostPort]time.Time),
+			}
+			var (
+				conv   *conversation
+				opened int
+			)
+			for _, p := range tt.packets {
+				var ok bool
+				conv, ok = table.classify(p.src, p.dst, p.tcp, time.Now(), nil)
+				if ok {
+					opened++
+				}
+			}
+			if conv.client != tt.client {
+				t.Errorf("client = %v, want %v", conv.client, tt.client)
+			}
+			if opened != tt.opened {
+				t.Errorf("opened %d connections, want %d", opened, tt.opened)
+			}
+		})
+	}
+}
+
+func TestConversationSweep(t *testing.T) {
+	table := &conversationTable{
+		convs:     make(map[flowKey]*conversation),
+		listening: make(map[hostPort]time.Time),
+	}
+	start := time.Date(2021, 9, 1, 10, 0, 0, 0, time.UTC)
+	idle := hostPort{ip: "172.17.0.2", port: 7000, proto: "tcp"}
+	busy := hostPort{ip: "172.17.0.5", port: 7000, proto: "tcp"}
+	old := hostPort{ip: "172.17.0.3", port: 41000, proto: "tcp"}
+	recent := hostPort{ip: "172.17.0.4", port: 41000, proto: "tcp"}
+	table.classify(old, idle, &layers.TCP{SYN: true}, start, nil)
+	table.classify(recent, busy, &layers.TCP{SYN: true}, start, nil)
+	table.classify(recent, busy, &layers.TCP{ACK: true}, start.Add(3*time.Minute), nil)
+
+	table.sweep(start.Add(time.Minute))
+	if _, ok := table.convs[newFlowKey(old, idle)]; ok {
+		t.Error("idle conversation was kept")
+	}
+	if _, ok := table.convs[newFlowKey(recent, busy)]; !ok {
+		t.Error("recent conversation was forgotten")
+	}
+	if _, ok := table.listening[idle]; ok {
+		t.Error("idle listening port was kept")
+	}
+	if _, ok := table.listening[busy]; !ok {
+		t.Error("listening port still serving was forgotten")
+	}
+
+	table.forget(map[string]string{busy.ip: "n1"})
+	if _, ok := table.listening[busy]; ok {
+		t.Error("listening port of a destroyed container was kept")
+	}
+}
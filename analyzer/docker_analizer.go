@@ -2,406 +2,458 @@ package analyzer
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
-	"os/exec"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
+	"github.com/docker/docker/api/types/events"
+	"github.com/lucianolacurcia/sprint-5/engine"
 	"github.com/lucianolacurcia/sprint-5/graphDB"
 )
 
 var (
-	containersIP   map[string]string
-	containersVeth map[string]string
-	containers     map[string]types.Container
-	containersInfo map[string]types.ContainerJSON
-	dockerNetworks map[string]types.NetworkResource
-	estaEnDB       map[string]bool
+	store graphDB.TopologyStore
+	// daemons are the engines watched, the first one adopting the graph
+	// nodes written before nodes were tagged with their daemon.
+	daemons []*daemon
 )
 
-func InitDockerAnalyzer() {
-	estaEnDB = make(map[string]bool)
-	containers = make(map[string]types.Container)
-	containersVeth = make(map[string]string)
-	containersInfo = make(map[string]types.ContainerJSON)
-	dockerNetworks = make(map[string]types.NetworkResource)
-	containersIP = make(map[string]string)
-
-	fetchContainers()
-	fetchContainersInfo()
-	fetchNetworks()
-	fetchContainersIp()
-	fetchContainersVeth()
-	addContainersToDB()
+// daemon is one engine watched: its inventory, and the connection its
+// events and inspections come from.
+type daemon struct {
+	rt engine.Runtime
+	// endpoint tags the graph nodes of the daemon, its partition.
+	endpoint  string
+	inventory *Inventory
+	// loadedAt is when InitDockerAnalyzer listed the daemon; events are
+	// read from then on.
+	loadedAt time.Time
+	// offline is set when the inventory was loaded from a snapshot and
+	// there is no daemon to ask.
+	offline bool
+	// sync serializes event handling and reconciliation, which both read
+	// the daemon and write the inventory and the store.
+	sync sync.Mutex
 }
 
-func fetchContainers() {
-	cli, err := client.NewEnvClient()
-	if err != nil {
-		panic(err)
-	}
-
-	containersAux, err := cli.ContainerList(context.Background(), types.ContainerListOptions{})
-	if err != nil {
-		panic(err)
+func newDaemon(rt engine.Runtime) *daemon {
+	return &daemon{
+		rt:        rt,
+		endpoint:  rt.Endpoint(),
+		inventory: NewInventory(),
+		loadedAt:  time.Now(),
 	}
+}
 
-	for _, container := range containersAux {
-		containers[container.ID] = container
+// InitDockerAnalyzer loads the current containers and networks from every
+// engine in runtimes, Docker or Podman, and reconciles them with the graph
+// already in s. It fails when an engine cannot be listed or the graph
+// cannot be read; containers that cannot be inspected are skipped.
+func InitDockerAnalyzer(runtimes []engine.Runtime, s graphDB.TopologyStore) error {
+	store = s
+	marks = newMarkTable()
+	daemons = nil
+	for _, rt := range runtimes {
+		daemons = append(daemons, newDaemon(rt))
+	}
+
+	for _, d := range daemons {
+		if err := d.load(); err != nil {
+			return err
+		}
 	}
+	return adoptStore()
 }
 
-func fetchContainersInfo() {
-	cli, err := client.NewEnvClient()
+// load lists the containers and networks of the daemon into its inventory.
+func (d *daemon) load() error {
+	ids, err := d.fetchContainers()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	for k := range containers {
-		containerJSON, err := cli.ContainerInspect(context.Background(), k)
-		if err != nil {
-			panic(err)
-		}
-		containersInfo[k] = containerJSON
+	d.fetchContainersInfo(ids)
+	if _, err := d.fetchNetworks(); err != nil {
+		return err
 	}
+	d.inventory.ReindexIPs()
+	d.fetchContainersVeth()
+	return nil
 }
 
-func fetchContainersVeth() {
-	out, err := exec.Command("dockervethmin").Output()
-	if err != nil {
-		log.Fatal(err)
+// component names the daemon in the health report: the kind of engine,
+// followed by its endpoint when there are several.
+func (d *daemon) component() string {
+	if d.rt == nil {
+		return componentEngine
 	}
-	tabla := string(out)
-	campos := strings.Fields(tabla)
-	containersVethAux := make(map[string]string)
-	for i := 0; i < len(campos); i = i + 2 {
-		containersVethAux[campos[i]] = campos[i+1]
+	if len(daemons) > 1 {
+		return d.rt.Name() + " " + d.endpoint
 	}
-	containersVeth = containersVethAux
+	return d.rt.Name()
 }
 
-func fetchNetworks() {
-	cli, err := client.NewEnvClient()
-	if err != nil {
-		panic(err)
-	}
+// owns reports whether the graph node tagged with the daemon endpoint tag
+// belongs to d.
+func (d *daemon) owns(tag string) bool {
+	return tag == d.endpoint || (tag == "" && d == daemons[0])
+}
 
-	dockerNetworksAux, err := cli.NetworkList(context.Background(), types.NetworkListOptions{})
-	if err != nil {
-		panic(err)
+// call runs fn against the daemon, retrying failures that may be
+// transient, and records whether the daemon is reachable. Not found errors
+// are returned as they come so callers can tell them apart.
+func (d *daemon) call(op string, fn func(r engine.Runtime) error) error {
+	err := retry(op, func() error { return fn(d.rt) })
+	if err == nil || engine.IsNotFound(err) {
+		health.heal(d.component())
+		return err
 	}
+	err = &DaemonError{Op: op, Daemon: d.endpoint, Err: err}
+	health.degrade(d.component(), err)
+	return err
+}
 
-	for _, net := range dockerNetworksAux {
-		network, err := cli.NetworkInspect(context.Background(), net.ID, types.NetworkInspectOptions{Verbose: true})
-		if err != nil {
-			panic(err)
-		}
+// fetchContainers returns the IDs of the running containers.
+func (d *daemon) fetchContainers() ([]string, error) {
+	var ids []string
+	err := d.call("list containers", func(r engine.Runtime) error {
+		var err error
+		ids, err = r.ListContainers(context.Background())
+		return err
+	})
+	return ids, err
+}
 
-		dockerNetworks[network.ID] = network
+func (d *daemon) fetchContainersInfo(ids []string) {
+	for _, k := range ids {
+		if err := d.fetchContainerInfoById(k); err != nil {
+			log.Printf("skipping container: %v", err)
+		}
 	}
 }
 
-func fetchNetworkByID(id string) {
-	cli, err := client.NewEnvClient()
-	if err != nil {
-		panic(err)
+func (d *daemon) fetchContainersVeth() {
+	if !d.rt.Local() {
+		return
 	}
+	for id, container := range d.inventory.Snapshot().Containers {
+		ifaces, err := d.rt.Interfaces(container)
+		if err != nil {
+			log.Printf("veth discovery for %s: %v", container.Name, err)
+			continue
+		}
+		d.inventory.SetVeths(id, ifaces)
+	}
+}
 
-	network, err := cli.NetworkInspect(context.Background(), id, types.NetworkInspectOptions{Verbose: true})
+// fetchNetworks inspects every network into the inventory and returns the
+// IDs of the networks listed.
+func (d *daemon) fetchNetworks() ([]string, error) {
+	var ids []string
+	err := d.call("list networks", func(r engine.Runtime) error {
+		var err error
+		ids, err = r.ListNetworks(context.Background())
+		return err
+	})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	dockerNetworks[network.ID] = network
-}
-
-func fetchContainersIp() {
-	containersIPAux := make(map[string]string)
-	for _, network := range dockerNetworks {
-		for idContainer, endpoints := range network.Containers {
-			ip := endpoints.IPv4Address
-			ip = strings.Split(ip, "/")[0]
-			containersIPAux[idContainer] = ip
+	for _, id := range ids {
+		if err := d.fetchNetworkByID(id); err != nil {
+			log.Printf("skipping network %s: %v", shortID(id), err)
 		}
 	}
-	containersIP = containersIPAux
+	return ids, nil
 }
 
-func fetchContainerById(id string) error {
-	cli, err := client.NewEnvClient()
+func (d *daemon) fetchNetworkByID(id string) error {
+	var network types.NetworkResource
+	err := d.call("inspect network "+shortID(id), func(r engine.Runtime) error {
+		var err error
+		network, err = r.InspectNetwork(context.Background(), id)
+		return err
+	})
 	if err != nil {
-		panic(err)
+		return err
 	}
+	d.inventory.SetNetwork(network)
+	return nil
+}
 
-	containersAux, err := cli.ContainerList(context.Background(), types.ContainerListOptions{All: true})
+// fetchContainerInfoById inspects container id into the inventory. A
+// container removed in the meantime yields ErrContainerNotFound.
+func (d *daemon) fetchContainerInfoById(id string) error {
+	var containerJSON types.ContainerJSON
+	err := d.call("inspect container "+shortID(id), func(r engine.Runtime) error {
+		var err error
+		containerJSON, err = r.InspectContainer(context.Background(), id)
+		return err
+	})
+	if engine.IsNotFound(err) {
+		err = ErrContainerNotFound
+	}
 	if err != nil {
-		panic(err)
+		return &ContainerError{Op: "inspect", ID: id, Err: err}
 	}
+	d.inventory.SetContainerInfo(containerJSON)
+	return nil
+}
 
-	for _, container := range containersAux {
-		if container.ID == id {
-			containers[container.ID] = container
-			return nil
-		}
+// fetchContainerVethById discovers the interfaces of container id. The
+// containers of a remote daemon have none to discover.
+func (d *daemon) fetchContainerVethById(id string) error {
+	if !d.rt.Local() {
+		return nil
+	}
+	container, ok := d.inventory.Container(id)
+	if !ok {
+		return &ContainerError{Op: "veth discovery", ID: id, Err: ErrContainerNotFound}
+	}
+	ifaces, err := d.rt.Interfaces(container)
+	if err == nil && len(ifaces) == 0 {
+		err = ErrNoVeth
+	}
+	if err != nil {
+		return &ContainerError{Op: "veth discovery", ID: id, Err: err}
 	}
-	return errors.New("Container not found")
+	d.inventory.SetVeths(id, ifaces)
+	return nil
 }
 
-func fetchContainerInfoById(id string) error {
-	cli, err := client.NewEnvClient()
+// writeContainer inserts container id into the store, or updates it if it
+// is already there, along with its attachments to networks.
+func (d *daemon) writeContainer(id string) error {
+	container, ok := d.inventory.Container(id)
+	if !ok {
+		return &ContainerError{Op: "write", ID: id, Err: ErrContainerNotFound}
+	}
+	ip, _ := d.inventory.IP(id)
+	err := store.InsertContainer(container, ip, d.endpoint)
+	if err == nil {
+		err = store.SetAttachments(id, graphDB.Attachments(container))
+	}
+	observeStore(err)
 	if err != nil {
-		return err
+		return &ContainerError{Op: "write", ID: id, Err: err}
 	}
+	return nil
+}
 
-	containerJSON, err := cli.ContainerInspect(context.Background(), id)
+// writeNetwork inserts network id into the store, or updates it if it is
+// already there.
+func (d *daemon) writeNetwork(id string) error {
+	network, ok := d.inventory.Network(id)
+	if !ok {
+		return nil
+	}
+	err := store.InsertNetwork(network, d.endpoint)
+	observeStore(err)
 	if err != nil {
-		return err
+		return fmt.Errorf("write network %s: %w", shortID(id), err)
 	}
-	containersInfo[id] = containerJSON
 	return nil
 }
 
-func fetchContainerVethById(id string) error {
-	out, err := exec.Command("dockervethmin").Output()
-	if err != nil {
-		panic(err)
-	}
-	tabla := string(out)
-	campos := strings.Fields(tabla)
-	for i := 0; i < len(campos); i = i + 2 {
-		if campos[i] == id {
-			containersVeth[campos[i]] = campos[i+1]
-			return nil
+// addressOwner returns the daemon with a container at ip. The daemon home,
+// the one of the capture the address was seen in, is asked first: the
+// default networks of every daemon share subnets, so an address it knows is
+// one of its own. Otherwise the address must be known to a single other
+// daemon, as on routed or overlay networks; one claimed by several is
+// ambiguous and resolves to none.
+func addressOwner(ip string, home *daemon) *daemon {
+	if home != nil {
+		if _, ok := home.inventory.NetworkOf(ip); ok {
+			return home
 		}
 	}
-	return errors.New("no veth associated with container id provided.")
+	var owner *daemon
+	for _, d := range daemons {
+		if d == home {
+			continue
+		}
+		if _, ok := d.inventory.NetworkOf(ip); ok {
+			if owner != nil {
+				return nil
+			}
+			owner = d
+		}
+	}
+	return owner
 }
 
-func addContainersToDB() {
-	for _, container := range containersInfo {
+// containerByIP returns the container owning ip, as seen from home.
+func containerByIP(ip string, home *daemon) (types.ContainerJSON, bool) {
+	if d := addressOwner(ip, home); d != nil {
+		return d.inventory.ContainerByIP(ip)
+	}
+	return types.ContainerJSON{}, false
+}
 
-		ip, _ := GetContainerIPbyID(container.ID)
-		err := graphDB.InsertContainer(container, ip)
-		if err != nil {
-			panic(err)
-		}
+// networkOf returns the ID of the network ip is a container address on, as
+// seen from home.
+func networkOf(ip string, home *daemon) (string, bool) {
+	if d := addressOwner(ip, home); d != nil {
+		return d.inventory.NetworkOf(ip)
 	}
+	return "", false
 }
 
-func GetContainerByIP(ip string) (types.ContainerJSON, error) {
-	for id, ipAux := range containersIP {
-		if ipAux == ip {
-			return containersInfo[id], nil
+// daemonOf returns the daemon running container id.
+func daemonOf(id string) *daemon {
+	for _, d := range daemons {
+		if _, ok := d.inventory.Container(id); ok {
+			return d
 		}
 	}
-	return types.ContainerJSON{}, errors.New("Container with ip provided not found")
+	return nil
 }
 
-func GetContainerIPbyID(id string) (string, error) {
-	if ip, member := containersIP[id]; member {
-		return ip, nil
+// GetContainerByIP returns the container owning ip, IPv4 or IPv6 in any
+// notation, on whichever daemon it runs.
+func GetContainerByIP(ip string) (types.ContainerJSON, error) {
+	if container, ok := containerByIP(normalizeIP(ip), nil); ok {
+		return container, nil
 	}
-	return "", errors.New("no ip stored for that id")
+	return types.ContainerJSON{}, ErrContainerNotFound
 }
 
-func newContainerCreated(id string) error {
-	err := fetchContainerById(id)
-	if err != nil {
-		panic(err)
-	}
-	err = fetchContainerInfoById(id)
-	if err != nil {
-		panic(err)
+func GetContainerIPbyID(id string) (string, error) {
+	if d := daemonOf(id); d != nil {
+		if ip, member := d.inventory.IP(id); member {
+			return ip, nil
+		}
 	}
-	ip, _ := GetContainerIPbyID(id)
+	return "", ErrNoIP
+}
 
-	err = graphDB.InsertContainer(containersInfo[id], ip)
-	if err != nil {
-		panic(err)
+func (d *daemon) newContainerCreated(id string) error {
+	if err := d.fetchContainerInfoById(id); err != nil {
+		return err
 	}
-	estaEnDB[id] = true
-	return err
+	return d.writeContainer(id)
 }
 
-func containerStarted(id string) error {
-	err := fetchContainerById(id)
-	if err != nil {
-		panic(err)
+func (d *daemon) containerStarted(id string) error {
+	if err := d.fetchContainerInfoById(id); err != nil {
+		return err
 	}
-
-	err = fetchContainerInfoById(id)
-	if err != nil {
-		panic(err)
+	// a restarted container comes back on new veths
+	vethErr := d.fetchContainerVethById(id)
+	monitors.sync(d, id)
+	if err := d.writeContainer(id); err != nil {
+		return err
 	}
+	return vethErr
+}
 
-	ip, _ := GetContainerIPbyID(id)
-	if !estaEnDB[id] {
-		err = graphDB.InsertContainer(containersInfo[id], ip)
-		if err != nil {
-			panic(err)
-		}
-		estaEnDB[id] = true
+func (d *daemon) containerStopped(id string) error {
+	if err := d.fetchContainerInfoById(id); err != nil {
+		return err
 	}
-
-	err = graphDB.UpdateContainer(containersInfo[id], ip)
-	return err
+	monitors.sync(d, id)
+	return d.writeContainer(id)
 }
 
-func containerStopped(id string) error {
-	err := fetchContainerById(id)
+func (d *daemon) containerDestroyed(id string) error {
+	monitors.stop(d, id)
+	conversations.forget(d.inventory.IPs(id))
+	d.inventory.RemoveContainer(id)
+	marks.UnmarkEdgesOf(graphDB.ContainerEndpoint(id))
+	err := store.MarkContainerRemoved(id)
+	if err == nil {
+		// a removed container is attached to nothing
+		err = store.SetAttachments(id, nil)
+	}
+	observeStore(err)
 	if err != nil {
-		panic(err)
+		return &ContainerError{Op: "mark removed", ID: id, Err: err}
 	}
-	err = fetchContainerInfoById(id)
-	if err != nil {
-		panic(err)
-	}
-	ip, _ := GetContainerIPbyID(id)
-	err = graphDB.UpdateContainer(containersInfo[id], ip)
-	return err
+	return nil
 }
 
-func containerDestroyed(id string) error {
-	delete(containersIP, id)
-	delete(containers, id)
-	delete(containersInfo, id)
-	delete(containersVeth, id)
-	err := graphDB.DeleteContainer(id)
-	if err != nil {
-		panic(err)
+func (d *daemon) networkCreated(id string) error {
+	if err := d.fetchNetworkByID(id); err != nil {
+		return err
 	}
-	delete(estaEnDB, id)
-	return err
+	return d.writeNetwork(id)
 }
 
-func networkCreated(id string) error {
-	fetchNetworkByID(id)
+func (d *daemon) networkDestroyed(id string) error {
+	d.inventory.RemoveNetwork(id)
+	err := store.RemoveNetwork(id)
+	observeStore(err)
+	if err != nil {
+		return fmt.Errorf("remove network %s: %w", shortID(id), err)
+	}
 	return nil
 }
 
-func networkDestroyed(id string) {
-	delete(dockerNetworks, id)
-}
-
-func networkConnected(idNetwork, idContainer string) {
+func (d *daemon) networkConnected(idNetwork, idContainer string) error {
 	// update network
-	fetchNetworkByID(idNetwork)
+	if err := d.fetchNetworkByID(idNetwork); err != nil {
+		return err
+	}
 
 	// update container
-	err := fetchContainerById(idContainer)
-	if err != nil {
-		panic(err)
-	}
-	err = fetchContainerInfoById(idContainer)
-	if err != nil {
-		panic(err)
+	if err := d.fetchContainerInfoById(idContainer); err != nil {
+		return err
 	}
 
-	// update veth and ip
-	err = fetchContainerVethById(idContainer)
-	if err != nil {
-		panic(err)
+	// update veth and ip; without a veth the container is still written,
+	// just not monitored
+	vethErr := d.fetchContainerVethById(idContainer)
+	d.inventory.ReindexIPs()
+	monitors.sync(d, idContainer)
+	if err := d.writeContainer(idContainer); err != nil {
+		return err
 	}
-	fetchContainersIp()
-	ip, _ := GetContainerIPbyID(idContainer)
-	graphDB.UpdateContainer(containersInfo[idContainer], ip)
-
-	go MonitorPackets(containersInfo[idContainer])
-
+	return vethErr
 }
 
-func networkDisconnect(idNetwork, idContainer string) {
+func (d *daemon) networkDisconnect(idNetwork, idContainer string) error {
 	// update network
-	fetchNetworkByID(idNetwork)
+	if err := d.fetchNetworkByID(idNetwork); err != nil {
+		return err
+	}
+	d.inventory.ReindexIPs()
 
-	// update container
-	err := fetchContainerById(idContainer)
-	if err != nil {
-		panic(err)
+	// update container and the veths left
+	if err := d.fetchContainerInfoById(idContainer); err != nil {
+		return err
 	}
-	err = fetchContainerInfoById(idContainer)
-	if err != nil {
-		panic(err)
+	if err := d.fetchContainerVethById(idContainer); errors.Is(err, ErrNoVeth) {
+		d.inventory.SetVeths(idContainer, nil)
+	} else if err != nil {
+		log.Printf("network disconnect: %v", err)
 	}
+	monitors.sync(d, idContainer)
+	return d.writeContainer(idContainer)
 }
 
-func ListenEvents() {
-	cli, err := client.NewEnvClient()
-	if err != nil {
-		panic(err)
-	}
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	options := types.EventsOptions{}
-
-	eventsChan, errChan := cli.Events(ctx, options)
-
-	go func() {
-		for event := range eventsChan {
-			if event.Type == "network" && event.Action == "create" {
-				fmt.Printf("Network created: %s\n", event.Actor.ID)
-				err := networkCreated(event.Actor.ID)
-				if err != nil {
-					panic(err)
-				}
-			} else if event.Type == "container" && event.Action == "create" {
-				fmt.Printf("Container created: %s\n", event.Actor.ID)
-				err := newContainerCreated(event.Actor.ID)
-				if err != nil {
-					panic(err)
-				}
-			} else if event.Type == "network" && event.Action == "connect" {
-				fmt.Printf("Network connected: %s\n", event.Actor.ID)
-				empJSON, err := json.MarshalIndent(event, "", "  ")
-				networkConnected(event.Actor.ID, event.Actor.Attributes["container"])
-				if err != nil {
-					log.Fatalf(err.Error())
-				}
-				fmt.Println(event.Actor.Attributes["container"])
-				fmt.Printf("%s\n", string(empJSON))
-			} else if event.Type == "container" && event.Action == "start" {
-				fmt.Printf("Container started: %s\n", event.Actor.ID)
-				err := containerStarted(event.Actor.ID)
-				if err != nil {
-					panic(err)
-				}
-			} else if event.Type == "network" && event.Action == "disconnect" {
-				fmt.Printf("network destroyed: %s\n", event.Actor.ID)
-				networkDisconnect(event.Actor.ID, event.Actor.Attributes["container"])
-				if err != nil {
-					panic(err)
-				}
-
-			} else if event.Type == "container" && event.Action == "stop" {
-				fmt.Printf("Container stopped: %s\n", event.Actor.ID)
-				err := containerStopped(event.Actor.ID)
-				if err != nil {
-					panic(err)
-				}
-
-			} else if event.Type == "container" && event.Action == "destroy" {
-				fmt.Printf("Container destroyed: %s\n", event.Actor.ID)
-				err := containerDestroyed(event.Actor.ID)
-				if err != nil {
-					panic(err)
-				}
-
-			} else if event.Type == "network" && event.Action == "destroy" {
-				fmt.Printf("network destroyed: %s\n", event.Actor.ID)
-				networkDestroyed(event.Actor.ID)
-				if err != nil {
-					panic(err)
-				}
-			}
-
-		}
-	}()
-
-	if err := <-errChan; err != nil {
-		panic(err)
+// handleEvent applies a Docker event to the inventory and the store. The
+// changes it makes are published on the change feed of the store.
+func (d *daemon) handleEvent(event events.Message) error {
+	switch {
+	case event.Type == "network" && event.Action == "create":
+		return d.networkCreated(event.Actor.ID)
+	case event.Type == "container" && event.Action == "create":
+		return d.newContainerCreated(event.Actor.ID)
+	case event.Type == "network" && event.Action == "connect":
+		return d.networkConnected(event.Actor.ID, event.Actor.Attributes["container"])
+	case event.Type == "container" && event.Action == "start":
+		return d.containerStarted(event.Actor.ID)
+	case event.Type == "network" && event.Action == "disconnect":
+		return d.networkDisconnect(event.Actor.ID, event.Actor.Attributes["container"])
+	case event.Type == "container" && (event.Action == "stop" || event.Action == "die"):
+		// a container that exits by itself only sends die
+		return d.containerStopped(event.Actor.ID)
+	case event.Type == "container" && event.Action == "destroy":
+		return d.containerDestroyed(event.Actor.ID)
+	case event.Type == "network" && event.Action == "destroy":
+		return d.networkDestroyed(event.Actor.ID)
 	}
+	return nil
 }
@@ -0,0 +1,89 @@
+package analyzer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lucianolacurcia/sprint-5/engine"
+)
+
+var (
+	ErrContainerNotFound = errors.New("container not found")
+	ErrNoIP              = errors.New("no ip known for container")
+	ErrNoVeth            = errors.New("no veth associated with container")
+)
+
+// ContainerError is a failure that only affects one container. The analyzer
+// logs it and carries on without the container.
+type ContainerError struct {
+	Op  string
+	ID  string
+	Err error
+}
+
+func (e *ContainerError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, shortID(e.ID), e.Err)
+}
+
+func (e *ContainerError) Unwrap() error {
+	return e.Err
+}
+
+// DaemonError is a failure talking to a Docker daemon.
+type DaemonError struct {
+	Op string
+	// Daemon is the endpoint of the daemon.
+	Daemon string
+	Err    error
+}
+
+func (e *DaemonError) Error() string {
+	if e.Daemon == "" {
+		return fmt.Sprintf("docker %s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("docker %s at %s: %v", e.Op, e.Daemon, e.Err)
+}
+
+func (e *DaemonError) Unwrap() error {
+	return e.Err
+}
+
+// shortID returns the 12 character form Docker shows container IDs in.
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// Attempts and initial delay of the retries around Docker calls.
+const (
+	retryAttempts = 4
+	retryDelay    = 200 * time.Millisecond
+)
+
+// retry runs fn until it succeeds, fails permanently or runs out of
+// attempts, doubling the delay between attempts. It returns the last error.
+func retry(op string, fn func() error) error {
+	delay := retryDelay
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || !temporary(err) || attempt == retryAttempts {
+			return err
+		}
+		log.Printf("%s: %v, retrying in %s", op, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// temporary reports whether retrying the call that failed with err may
+// succeed. A container that is gone stays gone.
+func temporary(err error) bool {
+	return !errors.Is(err, ErrContainerNotFound) &&
+		!errors.Is(err, context.Canceled) &&
+		!engine.IsNotFound(err)
+}
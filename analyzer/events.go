@@ -0,0 +1,108 @@
+package analyzer
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+)
+
+// Delay before reconnecting to the events stream, doubled after every
+// failed attempt up to the maximum.
+const (
+	eventsBackoffMin = time.Second
+	eventsBackoffMax = 30 * time.Second
+)
+
+// ListenEvents applies the events of every daemon for as long as the
+// process runs, each daemon on its own stream. Events that cannot be
+// applied are logged and skipped. When a stream breaks, for instance
+// because dockerd restarted, it reconnects with backoff, asks for the
+// events since the last one applied and resyncs containers and networks
+// against the daemon, since events older than the daemon's own buffer are
+// gone for good.
+func ListenEvents() {
+	var wg sync.WaitGroup
+	for _, d := range daemons {
+		wg.Add(1)
+		go func(d *daemon) {
+			defer wg.Done()
+			d.listenEvents()
+		}(d)
+	}
+	wg.Wait()
+}
+
+func (d *daemon) listenEvents() {
+	since := d.loadedAt
+	backoff := eventsBackoffMin
+	for reconnect := false; ; reconnect = true {
+		if reconnect {
+			log.Printf("reconnecting to %s events at %s in %s", d.rt.Name(), d.endpoint, backoff)
+			time.Sleep(backoff)
+		}
+		last, connected, err := d.watchEvents(since, reconnect)
+		if !last.IsZero() {
+			since = last
+		}
+		if connected {
+			backoff = eventsBackoffMin
+		} else if backoff *= 2; backoff > eventsBackoffMax {
+			backoff = eventsBackoffMax
+		}
+		health.degrade(d.component(), &DaemonError{Op: "events", Daemon: d.endpoint, Err: err})
+	}
+}
+
+// watchEvents streams the events since the given time until the stream
+// fails, resyncing with the daemon first when resync is set. It returns
+// the time of the last event applied, whether the stream was opened and
+// why it ended.
+func (d *daemon) watchEvents(since time.Time, resync bool) (last time.Time, connected bool, err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	eventsChan, errChan := d.rt.Events(ctx, since)
+	// Events only returns once the request has been answered, a refused
+	// connection is already waiting
+	select {
+	case err := <-errChan:
+		return last, false, err
+	default:
+	}
+	health.heal(d.component())
+
+	if resync {
+		if _, err := d.reconcile(); err != nil {
+			return last, true, err
+		}
+	}
+
+	for {
+		select {
+		case event := <-eventsChan:
+			d.sync.Lock()
+			err := d.handleEvent(event)
+			d.sync.Unlock()
+			if err != nil {
+				log.Printf("%s %s event: %v", event.Type, event.Action, err)
+			}
+			last = eventTime(event)
+		case err := <-errChan:
+			if err == nil {
+				err = errors.New("event stream closed")
+			}
+			return last, true, err
+		}
+	}
+}
+
+func eventTime(event events.Message) time.Time {
+	if event.TimeNano != 0 {
+		return time.Unix(0, event.TimeNano)
+	}
+	return time.Unix(event.Time, 0)
+}
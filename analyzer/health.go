@@ -0,0 +1,107 @@
+package analyzer
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Components reported by Health.
+const (
+	componentEngine  = "docker"
+	componentStore   = "store"
+	componentCapture = "capture/"
+)
+
+// Problem is the last failure of a degraded component.
+type Problem struct {
+	Component string    `json:"component"`
+	Error     string    `json:"error"`
+	Since     time.Time `json:"since"`
+}
+
+// HealthReport tells whether the analyzer is running with parts of its
+// view missing, and why.
+type HealthReport struct {
+	Degraded bool      `json:"degraded"`
+	Problems []Problem `json:"problems"`
+}
+
+type healthTable struct {
+	mu       sync.Mutex
+	problems map[string]Problem
+}
+
+var health = &healthTable{problems: make(map[string]Problem)}
+
+// degrade records err as the current failure of component.
+func (h *healthTable) degrade(component string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p, ok := h.problems[component]
+	if !ok {
+		log.Printf("degraded: %s: %v", component, err)
+		p = Problem{Component: component, Since: time.Now()}
+	}
+	p.Error = err.Error()
+	h.problems[component] = p
+}
+
+// heal clears the failure of component, if any.
+func (h *healthTable) heal(component string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.problems[component]; ok {
+		log.Printf("recovered: %s", component)
+		delete(h.problems, component)
+	}
+}
+
+// healPrefix clears the failures of every component under prefix.
+func (h *healthTable) healPrefix(prefix string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for component := range h.problems {
+		if strings.HasPrefix(component, prefix) {
+			log.Printf("recovered: %s", component)
+			delete(h.problems, component)
+		}
+	}
+}
+
+// observe records the outcome of a call to component.
+func (h *healthTable) observe(component string, err error) {
+	if err != nil {
+		h.degrade(component, err)
+	} else {
+		h.heal(component)
+	}
+}
+
+// observeStore records the outcome of a store call. A store that queues
+// writes accepts them while its flushes fail, so its last flush counts too.
+func observeStore(err error) {
+	if queued, ok := store.(interface{ Err() error }); ok && err == nil {
+		err = queued.Err()
+	}
+	health.observe(componentStore, err)
+}
+
+// Health returns the components currently failing.
+func Health() HealthReport {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	report := HealthReport{
+		Degraded: len(health.problems) > 0,
+		Problems: make([]Problem, 0, len(health.problems)),
+	}
+	for _, p := range health.problems {
+		report.Problems = append(report.Problems, p)
+	}
+	sort.Slice(report.Problems, func(i, j int) bool {
+		return report.Problems[i].Component < report.Problems[j].Component
+	})
+	return report
+}
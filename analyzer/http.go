@@ -0,0 +1,189 @@
+package analyzer
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	"github.com/google/gopacket/tcpassembly/tcpreader"
+	"github.com/lucianolacurcia/sprint-5/graphDB"
+)
+
+// How long a reassembled connection may stay idle before it is flushed.
+const streamIdleTimeout = 2 * time.Minute
+
+// newAssembler returns a TCP assembler that parses HTTP out of the streams
+// it rebuilds. Assemblers are not safe for concurrent use, so every capture
+// needs its own. wg tracks the goroutines reading the streams; home is the
+// daemon of the capture, nil in a replay.
+func newAssembler(wg *sync.WaitGroup, home *daemon) *tcpassembly.Assembler {
+	return tcpassembly.NewAssembler(tcpassembly.NewStreamPool(&httpStreamFactory{wg: wg, home: home}))
+}
+
+// httpStreamFactory implements tcpassembly.StreamFactory
+type httpStreamFactory struct {
+	wg   *sync.WaitGroup
+	home *daemon
+}
+
+// httpStream reads HTTP requests or responses from one direction of a
+// connection.
+type httpStream struct {
+	net, transport gopacket.Flow
+	home           *daemon
+	r              tcpreader.ReaderStream
+}
+
+func (f *httpStreamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
+	s := &httpStream{
+		net:       net,
+		transport: transport,
+		home:      f.home,
+		r:         tcpreader.NewReaderStream(),
+	}
+	// the reader stream must always be drained or the assembler blocks
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		s.run()
+	}()
+	return &s.r
+}
+
+func (s *httpStream) run() {
+	buf := bufio.NewReader(&s.r)
+	defer tcpreader.DiscardBytesToEOF(buf)
+
+	start, err := buf.Peek(5)
+	if err != nil {
+		return
+	}
+	if string(start) == "HTTP/" {
+		s.readResponses(buf)
+	} else {
+		s.readRequests(buf)
+	}
+}
+
+func (s *httpStream) readRequests(buf *bufio.Reader) {
+	for {
+		req, err := http.ReadRequest(buf)
+		if err != nil {
+			// io.EOF ends the stream, anything else is not HTTP
+			return
+		}
+		tcpreader.DiscardBytesToEOF(req.Body)
+		req.Body.Close()
+		httpConns.request(s.net, s.transport, s.home, graphDB.AppLayer{
+			Protocol: "http",
+			Method:   req.Method,
+			Host:     req.Host,
+			Path:     req.URL.Path,
+		})
+	}
+}
+
+func (s *httpStream) readResponses(buf *bufio.Reader) {
+	for {
+		resp, err := http.ReadResponse(buf, nil)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return
+		} else if err != nil {
+			log.Println("Error reading http response", s.net, s.transport, ":", err)
+			return
+		}
+		tcpreader.DiscardBytesToEOF(resp.Body)
+		resp.Body.Close()
+		// the response travels server -> client, the connection is keyed the
+		// other way around
+		httpConns.response(s.net.Reverse(), s.transport.Reverse(), s.home, resp.StatusCode)
+	}
+}
+
+// connKey identifies a TCP connection from the client side.
+type connKey struct {
+	net, transport gopacket.Flow
+}
+
+// httpConn pairs the requests and responses of one connection, which are
+// read by different goroutines.
+type httpConn struct {
+	requests []graphDB.AppLayer
+	statuses []int
+	seen     time.Time
+}
+
+type httpConnTable struct {
+	mu    sync.Mutex
+	conns map[connKey]*httpConn
+}
+
+var httpConns = &httpConnTable{conns: make(map[connKey]*httpConn)}
+
+func (t *httpConnTable) get(key connKey) *httpConn {
+	c, ok := t.conns[key]
+	if !ok {
+		c = &httpConn{}
+		t.conns[key] = c
+	}
+	c.seen = time.Now()
+	return c
+}
+
+func (t *httpConnTable) request(net, transport gopacket.Flow, home *daemon, app graphDB.AppLayer) {
+	t.mu.Lock()
+	c := t.get(connKey{net, transport})
+	if len(c.statuses) > 0 {
+		app.Status, c.statuses = c.statuses[0], c.statuses[1:]
+	} else {
+		c.requests = append(c.requests, app)
+	}
+	t.mu.Unlock()
+	updateEdgeAppLayer(net, transport, home, app)
+}
+
+func (t *httpConnTable) response(net, transport gopacket.Flow, home *daemon, status int) {
+	t.mu.Lock()
+	c := t.get(connKey{net, transport})
+	if len(c.requests) == 0 {
+		c.statuses = append(c.statuses, status)
+		t.mu.Unlock()
+		return
+	}
+	app := c.requests[0]
+	c.requests = c.requests[1:]
+	t.mu.Unlock()
+	app.Status = status
+	updateEdgeAppLayer(net, transport, home, app)
+}
+
+// sweep forgets connections idle since before t.
+func (t *httpConnTable) sweep(before time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, c := range t.conns {
+		if c.seen.Before(before) {
+			delete(t.conns, key)
+		}
+	}
+}
+
+// updateEdgeAppLayer stores app on the edge of the client -> server flow,
+// as seen from the daemon home.
+func updateEdgeAppLayer(net, transport gopacket.Flow, home *daemon, app graphDB.AppLayer) {
+	client := hostPort{ip: net.Src().String(), proto: "tcp"}
+	server := hostPort{ip: net.Dst().String(), proto: "tcp"}
+	server.port, _ = strconv.Atoi(transport.Dst().String())
+	edge := edgeBetween(client, server, home)
+	err := store.UpdateDependencyAppLayer(edge, app)
+	observeStore(err)
+	if err != nil {
+		logStoreError("updating edge "+edge.String(), err)
+	}
+}
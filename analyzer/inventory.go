@@ -0,0 +1,287 @@
+package analyzer
+
+import (
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/lucianolacurcia/sprint-5/veth"
+)
+
+// Inventory is the analyzer's view of one daemon: containers, networks, and
+// the addresses and interfaces of each container. It is safe for concurrent
+// use; the event listener writes it while every capture reads it.
+//
+// Values handed out are copies of the maps, but the Docker structs they hold
+// share pointers with the inventory. Callers must treat them as read only,
+// the inventory itself only ever replaces them whole.
+type Inventory struct {
+	mu       sync.RWMutex
+	info     map[string]types.ContainerJSON
+	networks map[string]types.NetworkResource
+	ips      map[string]map[string]string // network ID by container, then address
+	byIP     map[string]address
+	veths    map[string]map[string]veth.Interface
+	byVeth   map[string]string
+}
+
+// address is where a container IP belongs.
+type address struct {
+	container, network string
+}
+
+// InventorySnapshot is a consistent copy of the inventory.
+type InventorySnapshot struct {
+	Containers map[string]types.ContainerJSON
+	Networks   map[string]types.NetworkResource
+	IPs        map[string]map[string]string
+	Veths      map[string]map[string]veth.Interface
+}
+
+func NewInventory() *Inventory {
+	return &Inventory{
+		info:     make(map[string]types.ContainerJSON),
+		networks: make(map[string]types.NetworkResource),
+		ips:      make(map[string]map[string]string),
+		byIP:     make(map[string]address),
+		veths:    make(map[string]map[string]veth.Interface),
+		byVeth:   make(map[string]string),
+	}
+}
+
+func (inv *Inventory) SetContainerInfo(c types.ContainerJSON) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.info[c.ID] = c
+}
+
+// RemoveContainer drops the container and every index entry pointing at it.
+func (inv *Inventory) RemoveContainer(id string) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	delete(inv.info, id)
+	inv.setIPsLocked(id, nil)
+	inv.setVethsLocked(id, nil)
+}
+
+func (inv *Inventory) SetNetwork(n types.NetworkResource) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.networks[n.ID] = n
+}
+
+func (inv *Inventory) Network(id string) (types.NetworkResource, bool) {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	n, ok := inv.networks[id]
+	return n, ok
+}
+
+func (inv *Inventory) RemoveNetwork(id string) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	delete(inv.networks, id)
+}
+
+// ReindexIPs rebuilds the container addresses, IPv4 and IPv6, from the
+// endpoints listed in the networks.
+func (inv *Inventory) ReindexIPs() {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	ips := make(map[string]map[string]string)
+	for _, network := range inv.networks {
+		for idContainer, endpoint := range network.Containers {
+			for _, cidr := range []string{endpoint.IPv4Address, endpoint.IPv6Address} {
+				ip := normalizeIP(cidr)
+				if ip == "" {
+					continue
+				}
+				if ips[idContainer] == nil {
+					ips[idContainer] = make(map[string]string)
+				}
+				ips[idContainer][ip] = network.ID
+			}
+		}
+	}
+	for id := range inv.ips {
+		if _, ok := ips[id]; !ok {
+			inv.setIPsLocked(id, nil)
+		}
+	}
+	for id, byIP := range ips {
+		inv.setIPsLocked(id, byIP)
+	}
+}
+
+// SetIPs indexes the addresses of container id, mapped to the ID of their
+// network, replacing those it had. Addresses must be normalized.
+func (inv *Inventory) SetIPs(id string, ips map[string]string) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.setIPsLocked(id, ips)
+}
+
+func (inv *Inventory) setIPsLocked(id string, ips map[string]string) {
+	for old := range inv.ips[id] {
+		if inv.byIP[old].container == id {
+			delete(inv.byIP, old)
+		}
+	}
+	if len(ips) == 0 {
+		delete(inv.ips, id)
+		return
+	}
+	copied := make(map[string]string, len(ips))
+	for ip, network := range ips {
+		copied[ip] = network
+		inv.byIP[ip] = address{container: id, network: network}
+	}
+	inv.ips[id] = copied
+}
+
+// SetVeths records the interfaces of container id, keyed by network.
+func (inv *Inventory) SetVeths(id string, ifaces map[string]veth.Interface) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.setVethsLocked(id, ifaces)
+}
+
+func (inv *Inventory) setVethsLocked(id string, ifaces map[string]veth.Interface) {
+	for _, iface := range inv.veths[id] {
+		if inv.byVeth[iface.HostName] == id {
+			delete(inv.byVeth, iface.HostName)
+		}
+	}
+	if len(ifaces) == 0 {
+		delete(inv.veths, id)
+		return
+	}
+	inv.veths[id] = ifaces
+	for _, iface := range ifaces {
+		if iface.HostName != "" {
+			inv.byVeth[iface.HostName] = id
+		}
+	}
+}
+
+// Container returns the inspected container with the given ID.
+func (inv *Inventory) Container(id string) (types.ContainerJSON, bool) {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	c, ok := inv.info[id]
+	return c, ok
+}
+
+// ContainerByIP returns the container owning ip.
+func (inv *Inventory) ContainerByIP(ip string) (types.ContainerJSON, bool) {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	addr, ok := inv.byIP[ip]
+	if !ok {
+		return types.ContainerJSON{}, false
+	}
+	c, ok := inv.info[addr.container]
+	return c, ok
+}
+
+// NetworkOf returns the ID of the network on which ip is a container
+// address.
+func (inv *Inventory) NetworkOf(ip string) (string, bool) {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	addr, ok := inv.byIP[ip]
+	return addr.network, ok
+}
+
+// ContainerByVeth returns the container behind the host interface name.
+func (inv *Inventory) ContainerByVeth(name string) (types.ContainerJSON, bool) {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	id, ok := inv.byVeth[name]
+	if !ok {
+		return types.ContainerJSON{}, false
+	}
+	c, ok := inv.info[id]
+	return c, ok
+}
+
+// IP returns the primary address of container id: IPv4 before IPv6, then
+// the one on the network with the lowest ID, so that it does not change
+// from one call to the next.
+func (inv *Inventory) IP(id string) (string, bool) {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	primary := ""
+	for ip, network := range inv.ips[id] {
+		if primary == "" || beforeIP(ip, network, primary, inv.ips[id][primary]) {
+			primary = ip
+		}
+	}
+	return primary, primary != ""
+}
+
+// beforeIP orders the addresses of a container for IP.
+func beforeIP(a, networkA, b, networkB string) bool {
+	if v4a, v4b := isIPv4(a), isIPv4(b); v4a != v4b {
+		return v4a
+	}
+	if networkA != networkB {
+		return networkA < networkB
+	}
+	return a < b
+}
+
+// IPs returns a copy of the addresses of container id, mapped to the ID of
+// their network.
+func (inv *Inventory) IPs(id string) map[string]string {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	out := make(map[string]string, len(inv.ips[id]))
+	for ip, network := range inv.ips[id] {
+		out[ip] = network
+	}
+	return out
+}
+
+// Veths returns a copy of the interfaces of container id, keyed by network.
+func (inv *Inventory) Veths(id string) map[string]veth.Interface {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	out := make(map[string]veth.Interface, len(inv.veths[id]))
+	for network, iface := range inv.veths[id] {
+		out[network] = iface
+	}
+	return out
+}
+
+// Snapshot returns a copy of the inventory taken under a single lock.
+func (inv *Inventory) Snapshot() InventorySnapshot {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	s := InventorySnapshot{
+		Containers: make(map[string]types.ContainerJSON, len(inv.info)),
+		Networks:   make(map[string]types.NetworkResource, len(inv.networks)),
+		IPs:        make(map[string]map[string]string, len(inv.ips)),
+		Veths:      make(map[string]map[string]veth.Interface, len(inv.veths)),
+	}
+	for id, c := range inv.info {
+		s.Containers[id] = c
+	}
+	for id, n := range inv.networks {
+		s.Networks[id] = n
+	}
+	for id, ips := range inv.ips {
+		copied := make(map[string]string, len(ips))
+		for ip, network := range ips {
+			copied[ip] = network
+		}
+		s.IPs[id] = copied
+	}
+	for id, ifaces := range inv.veths {
+		copied := make(map[string]veth.Interface, len(ifaces))
+		for network, iface := range ifaces {
+			copied[network] = iface
+		}
+		s.Veths[id] = copied
+	}
+	return s
+}
@@ -0,0 +1,76 @@
+package analyzer
+
+import (
+	"sync"
+
+	"github.com/lucianolacurcia/sprint-5/graphDB"
+)
+
+// markTable remembers which NoContainer nodes and edges have already been
+// written to the graph, so that packets do not write them again. It is
+// shared by every daemon, whose containers may depend on each other.
+type markTable struct {
+	mu           sync.Mutex
+	noContainers map[string]bool
+	edges        map[graphDB.Edge]bool
+}
+
+var marks = newMarkTable()
+
+func newMarkTable() *markTable {
+	return &markTable{
+		noContainers: make(map[string]bool),
+		edges:        make(map[graphDB.Edge]bool),
+	}
+}
+
+// MarkNoContainer records that the NoContainer node of ip exists and
+// reports whether it was new.
+func (t *markTable) MarkNoContainer(ip string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.noContainers[ip] {
+		return false
+	}
+	t.noContainers[ip] = true
+	return true
+}
+
+// MarkEdge records that edge exists in the graph and reports whether it
+// was new.
+func (t *markTable) MarkEdge(edge graphDB.Edge) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.edges[edge] {
+		return false
+	}
+	t.edges[edge] = true
+	return true
+}
+
+// UnmarkNoContainer forgets the NoContainer node of ip, so that a failed
+// insert is retried.
+func (t *markTable) UnmarkNoContainer(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.noContainers, ip)
+}
+
+// UnmarkEdgesOf forgets every edge ending at e, whose node has been
+// deleted or is missing from the graph.
+func (t *markTable) UnmarkEdgesOf(e graphDB.Endpoint) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for edge := range t.edges {
+		if edge.From == e || edge.To == e {
+			delete(t.edges, edge)
+		}
+	}
+}
+
+// UnmarkEdge forgets edge, so that a failed insert is retried.
+func (t *markTable) UnmarkEdge(edge graphDB.Edge) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.edges, edge)
+}
@@ -0,0 +1,87 @@
+package analyzer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lucianolacurcia/sprint-5/graphDB"
+)
+
+// metricsTable accumulates traffic counters per edge between flushes.
+type metricsTable struct {
+	mu      sync.Mutex
+	pending map[graphDB.Edge]*graphDB.Metrics
+}
+
+var edgeMetrics = &metricsTable{pending: make(map[graphDB.Edge]*graphDB.Metrics)}
+
+// record counts a packet of size bytes on edge. forward is true when the
+// packet goes from the client to the server; opened marks the packet that
+// opened a connection.
+func (t *metricsTable) record(edge graphDB.Edge, forward bool, size int, opened bool, ts time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m, ok := t.pending[edge]
+	if !ok {
+		m = &graphDB.Metrics{FirstSeen: ts}
+		t.pending[edge] = m
+	}
+	if forward {
+		m.BytesOut += int64(size)
+		m.PacketsOut++
+	} else {
+		m.BytesIn += int64(size)
+		m.PacketsIn++
+	}
+	if opened {
+		m.Connections++
+	}
+	if ts.Before(m.FirstSeen) {
+		m.FirstSeen = ts
+	}
+	if ts.After(m.LastSeen) {
+		m.LastSeen = ts
+	}
+}
+
+// flush writes the counters gathered since the last flush to the store.
+func (t *metricsTable) flush() {
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = make(map[graphDB.Edge]*graphDB.Metrics)
+	t.mu.Unlock()
+
+	for edge, m := range pending {
+		err := store.AddDependencyMetrics(edge, *m)
+		observeStore(err)
+		if err != nil {
+			logStoreError("writing metrics of "+edge.String(), err)
+			t.requeue(edge, *m)
+		}
+	}
+}
+
+// requeue adds back counters that could not be written, so that the next
+// flush carries them.
+func (t *metricsTable) requeue(edge graphDB.Edge, m graphDB.Metrics) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if pending, ok := t.pending[edge]; ok {
+		m = m.Add(*pending)
+	}
+	t.pending[edge] = &m
+}
+
+// ReportMetrics writes edge traffic counters to the store every interval.
+func ReportMetrics(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		edgeMetrics.flush()
+	}
+}
+
+// FlushMetrics writes the counters not yet reported.
+func FlushMetrics() {
+	edgeMetrics.flush()
+}
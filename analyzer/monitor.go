@@ -0,0 +1,277 @@
+package analyzer
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+	"github.com/lucianolacurcia/sprint-5/veth"
+)
+
+// How long a read may block on a pcap handle. It bounds how long closing a
+// handle takes.
+const captureReadTimeout = 500 * time.Millisecond
+
+// monitor is the capture of one container interface.
+type monitor struct {
+	container string
+	iface     veth.Interface
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+// monitorManager runs one capture per interface of every running
+// container, on its host veth or, for rootless Podman, inside the
+// container's namespace, and stops it when the container stops, is
+// destroyed or the interface goes away.
+type monitorManager struct {
+	mu       sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+	monitors map[string]*monitor // by veth.Interface.CaptureName
+}
+
+var monitors = newMonitorManager()
+
+func newMonitorManager() *monitorManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &monitorManager{
+		ctx:      ctx,
+		cancel:   cancel,
+		monitors: make(map[string]*monitor),
+	}
+}
+
+// sync makes the captures of container id of daemon d match its
+// interfaces in the inventory: captures of interfaces that went away or
+// were recreated under the same name are stopped, new interfaces get one.
+func (m *monitorManager) sync(d *daemon, id string) {
+	if !monitorTraffic {
+		return
+	}
+	container, ok := d.inventory.Container(id)
+	want := make(map[string]veth.Interface)
+	if ok && container.State != nil && container.State.Running {
+		for _, iface := range d.inventory.Veths(id) {
+			if name := iface.CaptureName(); name != "" {
+				want[name] = iface
+			}
+		}
+	}
+	if ok && len(want) == 0 {
+		// nothing left to capture, nothing left failing
+		health.healPrefix(captureComponent(container, ""))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ctx.Err() != nil {
+		return
+	}
+	for name, mon := range m.monitors {
+		if mon.container != id {
+			continue
+		}
+		if iface, ok := want[name]; ok && iface.HostIndex == mon.iface.HostIndex && iface.Index == mon.iface.Index {
+			delete(want, name)
+			continue
+		}
+		m.stopLocked(name)
+	}
+	for _, iface := range want {
+		m.startLocked(d, container, iface)
+	}
+}
+
+// stop ends every capture of container id of daemon d.
+func (m *monitorManager) stop(d *daemon, id string) {
+	if container, ok := d.inventory.Container(id); ok {
+		health.healPrefix(captureComponent(container, ""))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, mon := range m.monitors {
+		if mon.container == id {
+			m.stopLocked(name)
+		}
+	}
+}
+
+// shutdown ends every capture and waits for them to finish. No capture is
+// started afterwards.
+func (m *monitorManager) shutdown() {
+	m.mu.Lock()
+	m.cancel()
+	running := make([]*monitor, 0, len(m.monitors))
+	for name, mon := range m.monitors {
+		running = append(running, mon)
+		delete(m.monitors, name)
+	}
+	m.mu.Unlock()
+	for _, mon := range running {
+		<-mon.done
+	}
+}
+
+// stopLocked cancels the named capture without waiting for it.
+// m.mu must be held.
+func (m *monitorManager) stopLocked(name string) {
+	mon := m.monitors[name]
+	mon.cancel()
+	delete(m.monitors, name)
+}
+
+// startLocked starts capturing on iface. m.mu must be held.
+func (m *monitorManager) startLocked(d *daemon, container types.ContainerJSON, iface veth.Interface) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	mon := &monitor{
+		container: container.ID,
+		iface:     iface,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	name := iface.CaptureName()
+	m.monitors[name] = mon
+	go func() {
+		defer close(mon.done)
+		capture(ctx, d, container, iface)
+		// a capture that failed or whose veth went away is started again by
+		// the next sync
+		m.mu.Lock()
+		if m.monitors[name] == mon {
+			delete(m.monitors, name)
+		}
+		m.mu.Unlock()
+		cancel()
+	}()
+}
+
+// capture reads the traffic of container on iface until ctx is canceled or
+// the interface goes away. A capture that cannot be opened is logged and
+// reported as degraded until it is stopped or opens on a later attempt;
+// the other captures are not affected.
+func capture(ctx context.Context, d *daemon, container types.ContainerJSON, iface veth.Interface) {
+	component := captureComponent(container, captureLabel(iface))
+	handle, err := openCapture(d, container, iface)
+	if err != nil {
+		log.Printf("not monitoring: %v", err)
+		health.degrade(component, err)
+		return
+	}
+	health.heal(component)
+
+	// closing the handle ends the packet channel, and with it readPackets
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			handle.Close()
+		case <-stopped:
+		}
+	}()
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	readPackets(packetSource.Packets(), d, container.ID)
+	close(stopped)
+	handle.Close()
+}
+
+// captureComponent names the capture of container on the interface iface
+// in the health report.
+func captureComponent(container types.ContainerJSON, iface string) string {
+	return componentCapture + strings.TrimPrefix(container.Name, "/") + "/" + iface
+}
+
+// captureLabel is the interface name used in logs and reports: the host
+// veth, or the interface inside the container when it is read there.
+func captureLabel(iface veth.Interface) string {
+	if iface.NetNS != "" {
+		return iface.Name
+	}
+	return iface.HostName
+}
+
+// openCapture opens a filtered pcap handle on the host end of iface, or on
+// iface itself inside the container's namespace when it has no host end.
+func openCapture(d *daemon, container types.ContainerJSON, iface veth.Interface) (*pcap.Handle, error) {
+	filter, err := bpfFilterFor(container, ifaceIPs(d, container, iface))
+	if err != nil {
+		return nil, &ContainerError{Op: "capture", ID: container.ID, Err: err}
+	}
+	label := captureLabel(iface)
+	var handle *pcap.Handle
+	open := func() error {
+		var err error
+		handle, err = pcap.OpenLive(label, captureOpts.Snaplen, captureOpts.Promiscuous, captureReadTimeout)
+		return err
+	}
+	if iface.NetNS != "" {
+		err = veth.Do(iface.NetNS, open)
+	} else {
+		err = open()
+	}
+	if err != nil {
+		return nil, &ContainerError{Op: "capture on " + label, ID: container.ID, Err: err}
+	}
+	if err := handle.SetBPFFilter(filter); err != nil {
+		handle.Close()
+		return nil, &ContainerError{Op: "bpf filter on " + label, ID: container.ID, Err: err}
+	}
+	return handle, nil
+}
+
+// ifaceIPs returns the IPv4 and global IPv6 addresses of iface. If the
+// interface has none, it falls back to the addresses Docker gave the
+// endpoint with the same MAC, then to every address of container.
+func ifaceIPs(d *daemon, container types.ContainerJSON, iface veth.Interface) []string {
+	var ips []string
+	for _, addr := range iface.Addrs {
+		if ip := normalizeIP(addr.IP.String()); ip != "" && identifies(ip) {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) > 0 {
+		return ips
+	}
+	if container.NetworkSettings != nil && iface.MAC != "" {
+		for _, endpoint := range container.NetworkSettings.Networks {
+			if endpoint == nil || endpoint.MacAddress != iface.MAC {
+				continue
+			}
+			for _, s := range []string{endpoint.IPAddress, endpoint.GlobalIPv6Address} {
+				if ip := normalizeIP(s); ip != "" {
+					ips = append(ips, ip)
+				}
+			}
+		}
+	}
+	if len(ips) > 0 {
+		return ips
+	}
+	for ip := range d.inventory.IPs(container.ID) {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// MonitorAllContainers starts capturing on the veths of every container
+// of every daemon on this host.
+func MonitorAllContainers() {
+	for _, d := range daemons {
+		for id := range d.inventory.Snapshot().Containers {
+			monitors.sync(d, id)
+		}
+	}
+}
+
+// StopMonitors ends every capture, closing the pcap handles, and waits for
+// the packets already read to be processed.
+func StopMonitors() {
+	monitors.shutdown()
+}
@@ -0,0 +1,359 @@
+package analyzer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/lucianolacurcia/sprint-5/graphDB"
+)
+
+// ReconcileReport counts the differences a reconciliation fixed.
+type ReconcileReport struct {
+	// Networks added to or dropped from the inventory or the store.
+	Networks int `json:"networks"`
+	// Container nodes missing from the store.
+	Added int `json:"added"`
+	// Container nodes whose name, status, ports or IP were stale.
+	Updated int `json:"updated"`
+	// Container nodes of containers that no longer exist, now marked
+	// removed.
+	Removed int `json:"removed"`
+}
+
+func (r ReconcileReport) Fixed() int {
+	return r.Networks + r.Added + r.Updated + r.Removed
+}
+
+func (r ReconcileReport) add(o ReconcileReport) ReconcileReport {
+	r.Networks += o.Networks
+	r.Added += o.Added
+	r.Updated += o.Updated
+	r.Removed += o.Removed
+	return r
+}
+
+func (r ReconcileReport) String() string {
+	return fmt.Sprintf("%d networks, %d nodes added, %d updated, %d removed",
+		r.Networks, r.Added, r.Updated, r.Removed)
+}
+
+// Reconcile lists the containers and networks of every daemon, brings the
+// inventories up to date and then corrects the Container nodes of the
+// store, whatever events were missed or half applied. A daemon that fails
+// does not keep the others from being reconciled; the first error is
+// returned.
+func Reconcile() (ReconcileReport, error) {
+	var (
+		total    ReconcileReport
+		firstErr error
+	)
+	for _, d := range daemons {
+		report, err := d.reconcile()
+		total = total.add(report)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return total, firstErr
+}
+
+func (d *daemon) reconcile() (ReconcileReport, error) {
+	d.sync.Lock()
+	defer d.sync.Unlock()
+	var report ReconcileReport
+	if err := d.refreshInventory(&report); err != nil {
+		return report, err
+	}
+	err := d.reconcileStore(&report)
+	observeStore(err)
+	return report, err
+}
+
+// ReconcileEvery runs Reconcile every interval and logs what it fixed.
+func ReconcileEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		report, err := Reconcile()
+		if err != nil {
+			log.Printf("reconcile: %v", err)
+			continue
+		}
+		if report.Fixed() > 0 {
+			log.Printf("reconcile: fixed %s", report)
+		}
+	}
+}
+
+// refreshInventory reloads containers and networks from the daemon.
+// Containers that are new or were restarted get their veths discovered, and
+// the captures of every container are brought in line.
+func (d *daemon) refreshInventory(report *ReconcileReport) error {
+	inventory := d.inventory
+	before := inventory.Snapshot()
+
+	ids, err := d.fetchContainers()
+	if err != nil {
+		return err
+	}
+	running := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		running[id] = true
+	}
+	d.fetchContainersInfo(ids)
+
+	networks, err := d.fetchNetworks()
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool, len(networks))
+	for _, id := range networks {
+		listed[id] = true
+		if _, ok := before.Networks[id]; !ok {
+			report.Networks++
+		}
+	}
+	for id := range before.Networks {
+		if !listed[id] {
+			inventory.RemoveNetwork(id)
+			report.Networks++
+		}
+	}
+	inventory.ReindexIPs()
+
+	// containers no longer running have either stopped or been removed
+	for id := range before.Containers {
+		if running[id] {
+			continue
+		}
+		err := d.fetchContainerInfoById(id)
+		if errors.Is(err, ErrContainerNotFound) {
+			conversations.forget(inventory.IPs(id))
+			inventory.RemoveContainer(id)
+			marks.UnmarkEdgesOf(graphDB.ContainerEndpoint(id))
+		} else if err != nil {
+			log.Printf("reconcile: %v", err)
+		}
+	}
+
+	for _, id := range ids {
+		container, ok := inventory.Container(id)
+		if !ok {
+			continue
+		}
+		old, known := before.Containers[id]
+		if !known || old.State == nil || container.State == nil || old.State.Pid != container.State.Pid {
+			// new or restarted, in a new network namespace
+			if err := d.fetchContainerVethById(id); err != nil {
+				log.Printf("reconcile: %v", err)
+			}
+		}
+	}
+
+	// captures that failed or whose veth went away are retried too
+	for id := range before.Containers {
+		if _, ok := inventory.Container(id); !ok {
+			monitors.stop(d, id)
+		}
+	}
+	for id := range inventory.Snapshot().Containers {
+		monitors.sync(d, id)
+	}
+	return nil
+}
+
+// reconcileStore makes the Network and Container nodes of the daemon's
+// partition of the store, and the attachments between them, match the
+// inventory. Nodes of containers missing from the inventory are checked
+// with the daemon: stopped containers are adopted back into the inventory,
+// containers that no longer exist are marked removed.
+func (d *daemon) reconcileStore(report *ReconcileReport) error {
+	if err := d.reconcileNetworks(report); err != nil {
+		return err
+	}
+
+	nodes, err := store.Containers()
+	if err != nil {
+		return err
+	}
+	stored := make(map[string]graphDB.ContainerNode, len(nodes))
+	for _, node := range nodes {
+		if d.owns(node.Daemon) {
+			stored[node.ID] = node
+		}
+	}
+
+	for id, node := range stored {
+		if _, ok := d.inventory.Container(id); ok || node.Status == graphDB.StatusRemoved {
+			continue
+		}
+		err := d.fetchContainerInfoById(id)
+		if err == nil {
+			// not running, the loop below updates its status
+			continue
+		}
+		if !errors.Is(err, ErrContainerNotFound) {
+			log.Printf("reconcile: %v", err)
+			continue
+		}
+		if err := store.MarkContainerRemoved(id); err != nil {
+			return err
+		}
+		report.Removed++
+	}
+
+	for id, container := range d.inventory.Snapshot().Containers {
+		ip, _ := d.inventory.IP(id)
+		node, ok := stored[id]
+		switch {
+		case !ok:
+			if err := store.InsertContainer(container, ip, d.endpoint); err != nil {
+				return err
+			}
+			// whatever edges it had went with the node
+			marks.UnmarkEdgesOf(graphDB.ContainerEndpoint(id))
+			report.Added++
+		case staleNode(node, container, ip, d.endpoint):
+			if err := store.UpdateContainer(container, ip, d.endpoint); err != nil {
+				return err
+			}
+			report.Updated++
+		}
+		if err := store.SetAttachments(id, graphDB.Attachments(container)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcileNetworks writes every network of the inventory to the store and
+// removes the Network nodes of the daemon that are gone.
+func (d *daemon) reconcileNetworks(report *ReconcileReport) error {
+	all, err := store.Networks()
+	if err != nil {
+		return err
+	}
+	var nodes []graphDB.NetworkNode
+	for _, node := range all {
+		if d.owns(node.Daemon) {
+			nodes = append(nodes, node)
+		}
+	}
+	networks := d.inventory.Snapshot().Networks
+	for _, node := range nodes {
+		if _, ok := networks[node.ID]; ok {
+			continue
+		}
+		if err := store.RemoveNetwork(node.ID); err != nil {
+			return err
+		}
+		report.Networks++
+	}
+	stored := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		stored[node.ID] = true
+	}
+	for id, network := range networks {
+		if err := store.InsertNetwork(network, d.endpoint); err != nil {
+			return err
+		}
+		if !stored[id] {
+			report.Networks++
+		}
+	}
+	return nil
+}
+
+// addMissing writes the networks and containers of the inventory that
+// the store lacks, for a daemon loaded from a snapshot. Stored nodes are
+// left alone: they may have been written by a live daemon since, which the
+// snapshot knows nothing about.
+func (d *daemon) addMissing(report *ReconcileReport) error {
+	networks, err := store.Networks()
+	if err != nil {
+		return err
+	}
+	storedNetworks := make(map[string]bool, len(networks))
+	for _, node := range networks {
+		storedNetworks[node.ID] = true
+	}
+	for id, network := range d.inventory.Snapshot().Networks {
+		if storedNetworks[id] {
+			continue
+		}
+		if err := store.InsertNetwork(network, d.endpoint); err != nil {
+			return err
+		}
+		report.Networks++
+	}
+
+	nodes, err := store.Containers()
+	if err != nil {
+		return err
+	}
+	stored := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		stored[node.ID] = true
+	}
+	for id, container := range d.inventory.Snapshot().Containers {
+		if stored[id] {
+			continue
+		}
+		ip, _ := d.inventory.IP(id)
+		if err := store.InsertContainer(container, ip, d.endpoint); err != nil {
+			return err
+		}
+		marks.UnmarkEdgesOf(graphDB.ContainerEndpoint(id))
+		if err := store.SetAttachments(id, graphDB.Attachments(container)); err != nil {
+			return err
+		}
+		report.Added++
+	}
+	return nil
+}
+
+// adoptStore takes over the graph left by a previous run: the containers
+// of every daemon are reconciled with their stored nodes, or only added
+// when missing for a snapshot, and the stored NoContainer nodes and
+// dependencies are marked as existing so they are not written twice.
+func adoptStore() error {
+	var report ReconcileReport
+	for _, d := range daemons {
+		reconcile := d.reconcileStore
+		if d.offline {
+			reconcile = d.addMissing
+		}
+		err := reconcile(&report)
+		observeStore(err)
+		if err != nil {
+			return err
+		}
+	}
+	noContainers, err := store.NoContainers()
+	if err != nil {
+		return err
+	}
+	for _, node := range noContainers {
+		marks.MarkNoContainer(node.IP)
+	}
+	edges, err := store.Dependencies()
+	if err != nil {
+		return err
+	}
+	for _, edge := range edges {
+		marks.MarkEdge(edge)
+	}
+	log.Printf("adopted graph: %d dependencies, %s", len(edges), report)
+	return nil
+}
+
+// staleNode reports whether node no longer describes container, run by
+// the daemon at endpoint.
+func staleNode(node graphDB.ContainerNode, container types.ContainerJSON, ip, endpoint string) bool {
+	want := graphDB.NewContainerNode(container, ip, endpoint)
+	want.Hostname = node.Hostname
+	return node != want
+}
@@ -0,0 +1,131 @@
+package analyzer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/docker/docker/api/types"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+	"github.com/lucianolacurcia/sprint-5/graphDB"
+)
+
+// inventoryFile is the snapshot written by WriteInventory: the inspected
+// containers and networks of every daemon. Older snapshots are a bare
+// array of containers.
+type inventoryFile struct {
+	Containers []types.ContainerJSON   `json:"containers"`
+	Networks   []types.NetworkResource `json:"networks"`
+}
+
+// WriteInventory saves the inspected containers and networks of every
+// daemon as JSON, the format read by LoadInventory.
+func WriteInventory(w io.Writer) error {
+	var file inventoryFile
+	for _, d := range daemons {
+		snapshot := d.inventory.Snapshot()
+		for _, container := range snapshot.Containers {
+			file.Containers = append(file.Containers, container)
+		}
+		for _, network := range snapshot.Networks {
+			file.Networks = append(file.Networks, network)
+		}
+	}
+	sort.Slice(file.Containers, func(i, j int) bool { return file.Containers[i].Name < file.Containers[j].Name })
+	sort.Slice(file.Networks, func(i, j int) bool { return file.Networks[i].ID < file.Networks[j].ID })
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(file)
+}
+
+// LoadInventory replaces the live Docker state with a snapshot written by
+// WriteInventory, as a single offline daemon, and adds to s the containers
+// and networks it lacks.
+func LoadInventory(r io.Reader, s graphDB.TopologyStore) error {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return fmt.Errorf("reading inventory: %w", err)
+	}
+	var file inventoryFile
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(raw, &file.Containers); err != nil {
+			return fmt.Errorf("reading inventory: %w", err)
+		}
+	} else if err := json.Unmarshal(raw, &file); err != nil {
+		return fmt.Errorf("reading inventory: %w", err)
+	}
+
+	store = s
+	marks = newMarkTable()
+	d := &daemon{inventory: NewInventory(), offline: true}
+	daemons = []*daemon{d}
+	inventory := d.inventory
+
+	for _, network := range file.Networks {
+		if network.ID == "" {
+			return fmt.Errorf("reading inventory: network entry without id")
+		}
+		inventory.SetNetwork(network)
+	}
+	for _, container := range file.Containers {
+		if container.ContainerJSONBase == nil {
+			return fmt.Errorf("reading inventory: container entry without id")
+		}
+		inventory.SetContainerInfo(container)
+		inventory.SetIPs(container.ID, inventoryIPs(container))
+	}
+	return adoptStore()
+}
+
+// inventoryIPs returns the addresses of container, mapped to the ID of
+// their network.
+func inventoryIPs(container types.ContainerJSON) map[string]string {
+	ips := make(map[string]string)
+	if container.NetworkSettings == nil {
+		return ips
+	}
+	for _, endpoint := range container.NetworkSettings.Networks {
+		if endpoint == nil || endpoint.NetworkID == "" {
+			continue
+		}
+		for _, s := range []string{endpoint.IPAddress, endpoint.GlobalIPv6Address} {
+			if ip := normalizeIP(s); ip != "" {
+				ips[ip] = endpoint.NetworkID
+			}
+		}
+	}
+	return ips
+}
+
+// ReplayPcaps feeds the packets of the given pcap or pcapng files through
+// the same processing as live capture. Only packets to or from a container
+// in the inventory are taken into account, as if they had been captured on
+// its veth.
+func ReplayPcaps(files []string) error {
+	for _, file := range files {
+		if err := replayPcap(file); err != nil {
+			return err
+		}
+	}
+	FlushMetrics()
+	return nil
+}
+
+func replayPcap(file string) error {
+	handle, err := pcap.OpenOffline(file)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", file, err)
+	}
+	defer handle.Close()
+	if captureOpts.BPFFilter != "" {
+		if err := handle.SetBPFFilter(captureOpts.BPFFilter); err != nil {
+			return fmt.Errorf("bpf filter on %s: %w", file, err)
+		}
+	}
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	readPackets(packetSource.Packets(), nil, "")
+	return nil
+}
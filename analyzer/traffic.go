@@ -2,107 +2,254 @@ package analyzer
 
 import (
 	"fmt"
+	"log"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/google/gopacket"
-	_ "github.com/google/gopacket/layers"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/tcpassembly"
 	"github.com/lucianolacurcia/sprint-5/graphDB"
 )
 
 var (
-	// edges is a set of idA+idB as key, if exists value, then the edge is already created in the graph
-	noContainers map[string]bool
-	edges        map[parIP]bool
-	wg           sync.WaitGroup
+	monitorTraffic bool
+	captureOpts    CaptureOptions
 )
 
-type parIP struct {
-	A, B string
+// CaptureOptions tunes the pcap handles opened for each container.
+type CaptureOptions struct {
+	Snaplen     int32
+	Promiscuous bool
+	// BPFFilter replaces the default "host <container ip>" filter.
+	BPFFilter string
+	// BPFOverrides maps a container name or ID to its own filter.
+	BPFOverrides map[string]string
 }
 
-func InitTrafficAnalizer() {
-	edges = make(map[parIP]bool)
-	noContainers = make(map[string]bool)
+// InitTrafficAnalizer prepares packet monitoring, rejecting filters that
+// libpcap cannot compile.
+func InitTrafficAnalizer(opts CaptureOptions) error {
+	if opts.BPFFilter != "" {
+		if _, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, int(opts.Snaplen), opts.BPFFilter); err != nil {
+			return fmt.Errorf("bpf filter %q: %w", opts.BPFFilter, err)
+		}
+	}
+	for name, filter := range opts.BPFOverrides {
+		if _, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, int(opts.Snaplen), filter); err != nil {
+			return fmt.Errorf("bpf filter %q for %s: %w", filter, name, err)
+		}
+	}
+	captureOpts = opts
+	monitorTraffic = true
+	return nil
 }
 
-func MonitorAllContainers() {
-	fmt.Println(containers)
-	for _, container := range containersInfo {
-		wg.Add(1)
-		go MonitorPackets(container)
+// ndFilter drops IPv6 router and neighbor discovery, ICMPv6 types 133 to
+// 137, when they follow the fixed header.
+const ndFilter = "not (icmp6 and ip6[40] >= 133 and ip6[40] <= 137)"
+
+// bpfFilterFor returns the capture filter for container, which is sending
+// from ips. The default filter needs an address to be known.
+func bpfFilterFor(container types.ContainerJSON, ips []string) (string, error) {
+	name := strings.TrimPrefix(container.Name, "/")
+	for key, filter := range captureOpts.BPFOverrides {
+		if key == name || key == container.ID || (len(key) >= 12 && strings.HasPrefix(container.ID, key)) {
+			return filter, nil
+		}
 	}
-	wg.Wait()
+	if captureOpts.BPFFilter != "" {
+		return captureOpts.BPFFilter, nil
+	}
+	if len(ips) == 0 {
+		return "", ErrNoIP
+	}
+	// both directions are needed to tell clients from servers
+	hosts := make([]string, len(ips))
+	ipv6 := false
+	for i, ip := range ips {
+		hosts[i] = "host " + ip
+		ipv6 = ipv6 || !isIPv4(ip)
+	}
+	filter := strings.Join(hosts, " or ")
+	if len(hosts) > 1 {
+		filter = "(" + filter + ")"
+	}
+	if ipv6 {
+		filter += " and " + ndFilter
+	}
+	return filter, nil
 }
 
-func MonitorPackets(containerA types.ContainerJSON) {
-	if handle, err := pcap.OpenLive(containersVeth[containerA.ID], 256000, true, pcap.BlockForever); err != nil {
-		panic(err)
-	} else {
-		ip, _ := GetContainerIPbyID(containerA.ID)
-		// get only outgoing packets
-		handle.SetBPFFilter("src " + ip)
-		// handle.SetBPFFilter("src " + ip + " and (tcp[13] & 2 != 0)")
-		packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-		// process packets
-		for packet := range packetSource.Packets() {
-			if appL := packet.ApplicationLayer(); appL != nil {
-				if appL := packet.ApplicationLayer().LayerContents(); string(appL) == "" {
-					continue
-				}
+// readPackets processes packets until the channel closes, reassembling TCP
+// streams along the way. It returns once every stream has been parsed.
+// owner is the ID of the container whose interface is being captured, run
+// by the daemon home, or empty, with home nil, when replaying a capture
+// that may hold any container's traffic.
+//
+// Idle streams are flushed by the time of the capture, the latest packet
+// timestamp seen, which in a replay lies in the past. A live capture also
+// goes by the wall clock while no packets arrive.
+func readPackets(packets <-chan gopacket.Packet, home *daemon, owner string) {
+	var streams sync.WaitGroup
+	assembler := newAssembler(&streams, home)
+	var tick <-chan time.Time
+	if home != nil {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var latest, swept time.Time
+	for {
+		select {
+		case packet, ok := <-packets:
+			if !ok {
+				assembler.FlushAll()
+				streams.Wait()
+				return
 			}
-			if linkL := packet.LinkLayer(); linkL != nil {
-				fmt.Println(string(linkL.LinkFlow().String()))
+			processPacket(packet, assembler, home, owner)
+			if ts := packet.Metadata().Timestamp; ts.After(latest) {
+				latest = ts
 			}
-			if netL := packet.NetworkLayer(); netL != nil {
-				fmt.Println(string(netL.NetworkFlow().String()))
-				if edges[parIP{netL.NetworkFlow().Src().String(), netL.NetworkFlow().Dst().String()}] == false {
-					edges[parIP{netL.NetworkFlow().Src().String(), netL.NetworkFlow().Dst().String()}] = true
-					containerSrc, err := GetContainerByIP(netL.NetworkFlow().Src().String())
-					if err != nil {
-						panic(err)
-					}
-					containerDst, err := GetContainerByIP(netL.NetworkFlow().Dst().String())
-					if err != nil {
-						if _, miembro := noContainers[netL.NetworkFlow().Dst().String()]; !miembro {
-							noContainers[netL.NetworkFlow().Dst().String()] = true
-							err = graphDB.InsertNoContainerNode(netL.NetworkFlow().Dst().String())
-							if err != nil {
-								panic(err)
-							}
-						}
-						if appL := packet.ApplicationLayer(); appL != nil {
-							err = graphDB.AddDependencyNonContianerContainer(netL.NetworkFlow().Dst().String(), containerSrc, string(appL.LayerContents()))
-						} else {
-							err = graphDB.AddDependencyNonContianerContainer(netL.NetworkFlow().Dst().String(), containerSrc, "no app layer")
-						}
-						if err != nil {
-							panic(err)
-						}
-						continue
-					}
-					if appL := packet.ApplicationLayer(); appL != nil {
-						graphDB.AddDependency(containerSrc, containerDst, string(appL.LayerContents()))
-					} else {
-						err = graphDB.AddDependency(containerSrc, containerDst, "no app layer")
-					}
-					if err != nil {
-						panic(err)
-					}
-				}
+			if swept.IsZero() {
+				swept = latest
 			}
-			if appL := packet.ApplicationLayer(); appL != nil {
-				fmt.Println(string(appL.LayerType().String()))
-				fmt.Println(string(appL.LayerContents()))
-				fmt.Println(string(appL.LayerPayload()))
+			if latest.Sub(swept) >= time.Minute {
+				sweepIdle(assembler, latest)
+				swept = latest
 			}
-			if erroL := packet.ErrorLayer(); erroL != nil {
-				fmt.Println(string(erroL.LayerType().String()))
-				fmt.Println(string(erroL.LayerContents()))
-				fmt.Println(string(erroL.LayerPayload()))
+		case <-tick:
+			sweepIdle(assembler, time.Now())
+		}
+	}
+}
+
+// sweepIdle flushes the streams and forgets the conversations idle at now,
+// by the clock of the capture. HTTP connections are stamped as their
+// streams are parsed, by the wall clock.
+func sweepIdle(assembler *tcpassembly.Assembler, now time.Time) {
+	idle := now.Add(-streamIdleTimeout)
+	assembler.FlushOlderThan(idle)
+	conversations.sweep(idle)
+	httpConns.sweep(time.Now().Add(-streamIdleTimeout))
+}
+
+// processPacket records the dependency shown by a packet to or from a
+// container and hands TCP segments to the assembler.
+func processPacket(packet gopacket.Packet, assembler *tcpassembly.Assembler, home *daemon, owner string) {
+	netL := packet.NetworkLayer()
+	if netL == nil {
+		return
+	}
+	src, dst, tcp := packetEnds(packet)
+	if !identifies(src.ip) || !identifies(dst.ip) || neighborDiscovery(packet) {
+		return
+	}
+	conv, opened := conversations.classify(src, dst, tcp, packet.Metadata().Timestamp, home)
+
+	client, clientOK := containerByIP(conv.client.ip, home)
+	server, serverOK := containerByIP(conv.server.ip, home)
+	if !clientOK && !serverOK {
+		// with a custom filter or in a replay, traffic between other hosts
+		// shows up too
+		return
+	}
+	// When both ends are containers the packet is captured on both veths;
+	// the client's capture accounts for it, unless the client runs on a
+	// remote daemon and is not captured at all.
+	if owner != "" {
+		if clientOK && client.ID != owner && captured(conv.client.ip, home) {
+			return
+		}
+		if !clientOK && server.ID != owner {
+			return
+		}
+	}
+
+	edge := edgeBetween(conv.client, conv.server, home)
+	if marks.MarkEdge(edge) {
+		if err := addEdge(edge); err != nil {
+			// forget the edge so that a later packet retries it
+			marks.UnmarkEdge(edge)
+			logStoreError("adding edge "+edge.String(), err)
+		}
+	}
+
+	size := packet.Metadata().Length
+	if size == 0 {
+		size = len(packet.Data())
+	}
+	forward := src == conv.client
+	edgeMetrics.record(edge, forward, size, opened, packet.Metadata().Timestamp)
+
+	if tcp != nil {
+		assembler.AssembleWithTimestamp(netL.NetworkFlow(), tcp, packet.Metadata().Timestamp)
+	}
+}
+
+// captured reports whether the container at ip, as seen from the daemon
+// home, runs on this host and has its traffic captured.
+func captured(ip string, home *daemon) bool {
+	d := addressOwner(ip, home)
+	return d != nil && d.rt != nil && d.rt.Local()
+}
+
+// endpointFor returns the graph node of ip, as seen from the daemon home:
+// its container, or a NoContainer.
+func endpointFor(ip string, home *daemon) graphDB.Endpoint {
+	if container, ok := containerByIP(ip, home); ok {
+		return graphDB.ContainerEndpoint(container.ID)
+	}
+	return graphDB.NoContainerEndpoint(ip)
+}
+
+// edgeBetween returns the edge from client to the port of server, over the
+// network of the container address involved, as seen from the daemon home.
+func edgeBetween(client, server hostPort, home *daemon) graphDB.Edge {
+	network, ok := networkOf(client.ip, home)
+	if !ok {
+		network, _ = networkOf(server.ip, home)
+	}
+	return graphDB.Edge{
+		From:     endpointFor(client.ip, home),
+		To:       endpointFor(server.ip, home),
+		Port:     server.port,
+		Protocol: server.proto,
+		Network:  network,
+	}
+}
+
+// addEdge creates the dependency, along with the NoContainer node of an end
+// that is not a container. What the application layer carries is filled in
+// later, once the stream has been reassembled.
+func addEdge(edge graphDB.Edge) error {
+	for _, end := range []graphDB.Endpoint{edge.From, edge.To} {
+		if end.IsContainer() {
+			continue
+		}
+		if marks.MarkNoContainer(end.IP) {
+			err := store.InsertNoContainerNode(end.IP)
+			observeStore(err)
+			if err != nil {
+				marks.UnmarkNoContainer(end.IP)
+				return err
 			}
 		}
 	}
-	wg.Done()
+	err := store.AddDependency(edge, graphDB.AppLayer{})
+	observeStore(err)
+	return err
+}
+
+// logStoreError logs a failed write made while processing packets. Writes
+// failing because the store is unreachable are not logged one by one, the
+// degraded state already says so.
+func logStoreError(op string, err error) {
+	if !graphDB.IsUnavailable(err) {
+		log.Printf("%s: %v", op, err)
+	}
 }
@@ -0,0 +1,247 @@
+// Package api serves the topology as JSON over HTTP.
+//
+// Endpoints are versioned under /v1 and answer GET only:
+//
+//	/v1/graph                the whole graph
+//	/v1/containers           Container nodes
+//	/v1/containers/{ref}     one container, by ID, ID prefix or name, with
+//	                         its upstream and downstream dependencies
+//	/v1/networks             Network nodes
+//	/v1/endpoints            NoContainer nodes, the external endpoints
+//	/v1/changes              the changes to the graph, as they are written
+//
+// Every endpoint but the last takes the project, network, protocol, since
+// and until query parameters; see filter. Changes stream over Server-Sent
+// Events, or WebSocket when the client asks for an upgrade.
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucianolacurcia/sprint-5/graphDB"
+)
+
+// Server answers queries on the graph of a store, and streams the changes
+// published on a feed.
+type Server struct {
+	store graphDB.GraphReader
+	feed  *graphDB.Feed
+	opts  Options
+	mux   *http.ServeMux
+
+	// done is closed to end the streams in progress.
+	done chan struct{}
+	once sync.Once
+}
+
+// Options configure a Server.
+type Options struct {
+	// Origins are the web origins, besides the server's own, whose pages
+	// may open WebSocket streams; "*" allows any.
+	Origins []string
+}
+
+// New returns a server reading from store. Without a feed, changes are not
+// served.
+func New(store graphDB.GraphReader, feed *graphDB.Feed, opts Options) *Server {
+	s := &Server{store: store, feed: feed, opts: opts, mux: http.NewServeMux(), done: make(chan struct{})}
+	s.mux.HandleFunc("/v1/graph", s.graph)
+	s.mux.HandleFunc("/v1/containers", s.containers)
+	s.mux.HandleFunc("/v1/containers/", s.container)
+	s.mux.HandleFunc("/v1/networks", s.networks)
+	s.mux.HandleFunc("/v1/endpoints", s.endpoints)
+	s.mux.HandleFunc("/v1/changes", s.changes)
+	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, errors.New("no such endpoint"))
+	})
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("only GET is supported"))
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// Close ends the change streams in progress, which an http.Server does not
+// wait for on shutdown.
+func (s *Server) Close() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// ContainerDetail is a container with the dependencies it is at either end
+// of.
+type ContainerDetail struct {
+	Container   graphDB.ContainerNode `json:"container"`
+	Attachments []graphDB.Attachment  `json:"attachments"`
+	// Upstream are the dependencies of the container: the servers it is a
+	// client of.
+	Upstream []graphDB.Dependency `json:"upstream"`
+	// Downstream are the dependencies on the container: its clients.
+	Downstream []graphDB.Dependency `json:"downstream"`
+}
+
+// query reads the filter of r and the part of the graph it applies to,
+// answering r itself when either fails. Dependencies, the bulk of the
+// graph, are only read when edges says the filter needs them.
+func (s *Server) query(w http.ResponseWriter, r *http.Request, edges func(f filter) bool) (*view, filter, bool) {
+	f, err := parseFilter(r.URL.Query(), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil, f, false
+	}
+	read := s.store.Nodes
+	if edges(f) {
+		read = s.store.Graph
+	}
+	g, err := read()
+	if err != nil {
+		log.Printf("api: %v", err)
+		writeError(w, http.StatusServiceUnavailable, err)
+		return nil, f, false
+	}
+	return newView(g, f), f, true
+}
+
+func (s *Server) graph(w http.ResponseWriter, r *http.Request) {
+	if v, f, ok := s.query(w, r, func(filter) bool { return true }); ok {
+		writeJSON(w, v.apply(f))
+	}
+}
+
+// Containers and networks pass the node filters by themselves, and only
+// need the dependencies to pass the edge filters.
+func (s *Server) containers(w http.ResponseWriter, r *http.Request) {
+	if v, f, ok := s.query(w, r, filter.edgeFilter); ok {
+		writeJSON(w, map[string]interface{}{"containers": v.apply(f).Containers})
+	}
+}
+
+func (s *Server) networks(w http.ResponseWriter, r *http.Request) {
+	if v, f, ok := s.query(w, r, filter.edgeFilter); ok {
+		writeJSON(w, map[string]interface{}{"networks": v.apply(f).Networks})
+	}
+}
+
+// endpoints answers /v1/endpoints. Filtered endpoints are those at the end
+// of a dependency that passes.
+func (s *Server) endpoints(w http.ResponseWriter, r *http.Request) {
+	if v, f, ok := s.query(w, r, filter.filtered); ok {
+		writeJSON(w, map[string]interface{}{"endpoints": v.apply(f).NoContainers})
+	}
+}
+
+// container answers /v1/containers/{ref}. Only the protocol and time
+// filters apply to its dependencies.
+func (s *Server) container(w http.ResponseWriter, r *http.Request) {
+	ref := strings.TrimPrefix(r.URL.Path, "/v1/containers/")
+	if ref == "" || strings.Contains(ref, "/") {
+		writeError(w, http.StatusNotFound, errors.New("no such endpoint"))
+		return
+	}
+	v, f, ok := s.query(w, r, func(filter) bool { return false })
+	if !ok {
+		return
+	}
+	node, err := findContainer(v.graph.Containers, ref)
+	if err != nil {
+		status := http.StatusNotFound
+		if errors.Is(err, errAmbiguous) {
+			status = http.StatusConflict
+		}
+		writeError(w, status, err)
+		return
+	}
+	f.project, f.network = "", ""
+	detail := ContainerDetail{
+		Container:   node,
+		Attachments: []graphDB.Attachment{},
+		Upstream:    []graphDB.Dependency{},
+		Downstream:  []graphDB.Dependency{},
+	}
+	for _, a := range v.graph.Attachments {
+		if a.ContainerID == node.ID {
+			detail.Attachments = append(detail.Attachments, a.Attachment)
+		}
+	}
+	dependencies, err := s.store.ContainerDependencies(node.ID)
+	if err != nil {
+		log.Printf("api: %v", err)
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	self := graphDB.ContainerEndpoint(node.ID)
+	for _, d := range dependencies {
+		if !v.dependency(f, d) {
+			continue
+		}
+		if d.From == self {
+			detail.Upstream = append(detail.Upstream, d)
+		}
+		if d.To == self {
+			detail.Downstream = append(detail.Downstream, d)
+		}
+	}
+	writeJSON(w, detail)
+}
+
+var (
+	errNoContainer = errors.New("no such container")
+	errAmbiguous   = errors.New("several containers match")
+)
+
+// findContainer returns the container whose ID is ref, or else the only
+// one whose ID starts with ref or whose name is ref. Among several, a
+// single one that is not removed wins.
+func findContainer(containers []graphDB.ContainerNode, ref string) (graphDB.ContainerNode, error) {
+	var matches []graphDB.ContainerNode
+	for _, node := range containers {
+		if node.ID == ref {
+			return node, nil
+		}
+		if strings.HasPrefix(node.ID, ref) || strings.TrimPrefix(node.Name, "/") == strings.TrimPrefix(ref, "/") {
+			matches = append(matches, node)
+		}
+	}
+	if len(matches) == 1 {
+		return matches[0], nil
+	}
+	var live []graphDB.ContainerNode
+	for _, node := range matches {
+		if node.Status != graphDB.StatusRemoved {
+			live = append(live, node)
+		}
+	}
+	switch {
+	case len(live) == 1:
+		return live[0], nil
+	case len(matches) == 0:
+		return graphDB.ContainerNode{}, errNoContainer
+	default:
+		return graphDB.ContainerNode{}, errAmbiguous
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("api: writing response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lucianolacurcia/sprint-5/graphDB"
+)
+
+// How many changes a stream buffers for a slow client before dropping it.
+const streamBuffer = 1024
+
+// How often an idle stream is sent something, so that proxies keep it
+// open and gone clients are noticed.
+const keepaliveInterval = 15 * time.Second
+
+var changeTypes = []string{
+	graphDB.ContainerCreated,
+	graphDB.ContainerStarted,
+	graphDB.ContainerStopped,
+	graphDB.ContainerDestroyed,
+	graphDB.EdgeAdded,
+	graphDB.EdgeMetrics,
+}
+
+// stream is how changes reach a client: Server-Sent Events or WebSocket.
+type stream interface {
+	change(c graphDB.Change, data []byte) error
+	keepalive() error
+	// end tells the client why the stream ends: err, or nil when the
+	// server shuts down.
+	end(err error)
+}
+
+// changes answers /v1/changes, streaming the changes published after the
+// request over WebSocket if the client asks for an upgrade, over
+// Server-Sent Events otherwise.
+func (s *Server) changes(w http.ResponseWriter, r *http.Request) {
+	if s.feed == nil {
+		writeError(w, http.StatusNotFound, errors.New("no change feed"))
+		return
+	}
+	match, err := parseTypes(r.URL.Query()["type"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if websocketRequested(r) {
+		if !originAllowed(r, s.opts.Origins) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("origin %q not allowed", r.Header.Get("Origin")))
+			return
+		}
+		conn, err := upgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.close()
+		s.stream(conn, match, conn.gone)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming unsupported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	s.stream(&sseStream{w: w, flusher: flusher}, match, r.Context().Done())
+}
+
+// stream sends the changes that match until the client is gone, the
+// server shuts down or the client falls behind.
+func (s *Server) stream(out stream, match func(typ string) bool, gone <-chan struct{}) {
+	sub := s.feed.Subscribe(streamBuffer)
+	defer sub.Close()
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case c, ok := <-sub.Changes():
+			if !ok {
+				out.end(sub.Err())
+				return
+			}
+			if !match(c.Type) {
+				continue
+			}
+			data, err := json.Marshal(c)
+			if err != nil {
+				continue
+			}
+			if err := out.change(c, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := out.keepalive(); err != nil {
+				return
+			}
+		case <-s.done:
+			out.end(nil)
+			return
+		case <-gone:
+			return
+		}
+	}
+}
+
+// parseTypes returns whether a change type is one of those listed, or of
+// their kind: "container" stands for every container change. Without
+// types, every change matches.
+func parseTypes(values []string) (func(typ string) bool, error) {
+	wanted := make(map[string]bool)
+	for _, value := range values {
+		for _, t := range strings.Split(value, ",") {
+			t = strings.TrimSpace(t)
+			if t == "" {
+				continue
+			}
+			known := false
+			for _, typ := range changeTypes {
+				if typ == t || strings.HasPrefix(typ, t+".") {
+					wanted[typ] = true
+					known = true
+				}
+			}
+			if !known {
+				return nil, fmt.Errorf("unknown change type %q, valid ones are %s", t, strings.Join(changeTypes, ", "))
+			}
+		}
+	}
+	return func(typ string) bool {
+		return len(wanted) == 0 || wanted[typ]
+	}, nil
+}
+
+type sseStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (s *sseStream) change(c graphDB.Change, data []byte) error {
+	if _, err := fmt.Fprintf(s.w, "id: %d\nevent: %s\ndata: %s\n\n", c.Seq, c.Type, data); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *sseStream) keepalive() error {
+	if _, err := fmt.Fprint(s.w, ": keepalive\n\n"); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *sseStream) end(err error) {
+	if err == nil {
+		err = errShuttingDown
+	}
+	data, _ := json.Marshal(map[string]string{"error": err.Error()})
+	fmt.Fprintf(s.w, "event: error\ndata: %s\n\n", data)
+	s.flusher.Flush()
+}
+
+var errShuttingDown = errors.New("server shutting down")
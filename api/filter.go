@@ -0,0 +1,221 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lucianolacurcia/sprint-5/graphDB"
+)
+
+// filter narrows the graph down to what a query asks for. Zero fields do
+// not filter.
+type filter struct {
+	// project keeps the containers of a Compose project.
+	project string
+	// network keeps the containers attached to a network, by ID, ID prefix
+	// or name, and the edges over it.
+	network string
+	// protocol keeps the edges of a transport or application protocol.
+	protocol string
+	// since and until keep the edges with traffic in the window.
+	since, until time.Time
+}
+
+// parseFilter reads the filter query parameters. Times are RFC 3339, or a
+// duration back from now.
+func parseFilter(q url.Values, now time.Time) (filter, error) {
+	f := filter{
+		project:  q.Get("project"),
+		network:  q.Get("network"),
+		protocol: strings.ToLower(q.Get("protocol")),
+	}
+	var err error
+	if f.since, err = parseTime(q.Get("since"), now); err != nil {
+		return f, fmt.Errorf("since: %w", err)
+	}
+	if f.until, err = parseTime(q.Get("until"), now); err != nil {
+		return f, fmt.Errorf("until: %w", err)
+	}
+	if !f.since.IsZero() && !f.until.IsZero() && f.until.Before(f.since) {
+		return f, fmt.Errorf("until %s is before since %s", f.until.Format(time.RFC3339), f.since.Format(time.RFC3339))
+	}
+	return f, nil
+}
+
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC 3339 time nor a duration", s)
+	}
+	return t, nil
+}
+
+func (f filter) nodeFilter() bool {
+	return f.project != "" || f.network != ""
+}
+
+func (f filter) edgeFilter() bool {
+	return f.protocol != "" || !f.since.IsZero() || !f.until.IsZero()
+}
+
+func (f filter) filtered() bool {
+	return f.nodeFilter() || f.edgeFilter()
+}
+
+// view is a graph with the indexes the filters need.
+type view struct {
+	graph graphDB.Graph
+	// networks the network filter names, by ID
+	networks map[string]bool
+	// attached maps a container ID to the networks it is attached to
+	attached map[string][]string
+	// containers by ID
+	containers map[string]graphDB.ContainerNode
+}
+
+func newView(g graphDB.Graph, f filter) *view {
+	v := &view{
+		graph:      g,
+		networks:   make(map[string]bool),
+		attached:   make(map[string][]string),
+		containers: make(map[string]graphDB.ContainerNode, len(g.Containers)),
+	}
+	for _, network := range g.Networks {
+		if f.network != "" && (network.ID == f.network || network.Name == f.network ||
+			(len(f.network) >= 12 && strings.HasPrefix(network.ID, f.network))) {
+			v.networks[network.ID] = true
+		}
+	}
+	for _, a := range g.Attachments {
+		v.attached[a.ContainerID] = append(v.attached[a.ContainerID], a.NetworkID)
+	}
+	for _, node := range g.Containers {
+		v.containers[node.ID] = node
+	}
+	return v
+}
+
+// container reports whether the node passes the project and network
+// filters.
+func (v *view) container(f filter, node graphDB.ContainerNode) bool {
+	if f.project != "" && node.Project != f.project {
+		return false
+	}
+	if f.network != "" {
+		for _, id := range v.attached[node.ID] {
+			if v.networks[id] {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// dependency reports whether d passes the protocol and time filters, and,
+// when nodes are filtered, goes over the network asked for and has a
+// container end that passes.
+func (v *view) dependency(f filter, d graphDB.Dependency) bool {
+	if f.protocol != "" && d.Protocol != f.protocol && strings.ToLower(d.AppLayer.Protocol) != f.protocol {
+		return false
+	}
+	if !f.since.IsZero() && d.Metrics.LastSeen.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && (d.Metrics.FirstSeen.IsZero() || d.Metrics.FirstSeen.After(f.until)) {
+		return false
+	}
+	if f.network != "" && d.Network != "" && !v.networks[d.Network] {
+		return false
+	}
+	if f.nodeFilter() {
+		for _, end := range []graphDB.Endpoint{d.From, d.To} {
+			if node, ok := v.containers[end.ContainerID]; ok && end.IsContainer() && v.container(f, node) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// apply returns the part of the graph f keeps: the edges that pass, and the
+// nodes at their ends. Without edge filters the containers that pass are
+// kept even if they have no edge, with the networks they are attached to.
+func (v *view) apply(f filter) graphDB.Graph {
+	if !f.nodeFilter() && !f.edgeFilter() {
+		return v.graph
+	}
+	out := graphDB.Graph{
+		Containers:   []graphDB.ContainerNode{},
+		Networks:     []graphDB.NetworkNode{},
+		NoContainers: []graphDB.NoContainerNode{},
+		Attachments:  []graphDB.ContainerAttachment{},
+		Dependencies: []graphDB.Dependency{},
+	}
+	containers := make(map[string]bool)
+	endpoints := make(map[string]bool)
+	for _, d := range v.graph.Dependencies {
+		if !v.dependency(f, d) {
+			continue
+		}
+		out.Dependencies = append(out.Dependencies, d)
+		for _, end := range []graphDB.Endpoint{d.From, d.To} {
+			if end.IsContainer() {
+				containers[end.ContainerID] = true
+			} else {
+				endpoints[end.IP] = true
+			}
+		}
+	}
+	if !f.edgeFilter() {
+		for _, node := range v.graph.Containers {
+			if v.container(f, node) {
+				containers[node.ID] = true
+			}
+		}
+	}
+
+	networks := make(map[string]bool)
+	for id := range v.networks {
+		networks[id] = true
+	}
+	if f.network == "" {
+		for id := range containers {
+			for _, network := range v.attached[id] {
+				networks[network] = true
+			}
+		}
+	}
+
+	for _, node := range v.graph.Containers {
+		if containers[node.ID] {
+			out.Containers = append(out.Containers, node)
+		}
+	}
+	for _, node := range v.graph.Networks {
+		if networks[node.ID] {
+			out.Networks = append(out.Networks, node)
+		}
+	}
+	for _, node := range v.graph.NoContainers {
+		if endpoints[node.IP] {
+			out.NoContainers = append(out.NoContainers, node)
+		}
+	}
+	for _, a := range v.graph.Attachments {
+		if containers[a.ContainerID] && networks[a.NetworkID] {
+			out.Attachments = append(out.Attachments, a)
+		}
+	}
+	out.ServiceDependencies = graphDB.ServiceEdges(out.Containers, out.Dependencies)
+	return out
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lucianolacurcia/sprint-5/graphDB"
+)
+
+// How long a message may take to write before the client is given up.
+const frameWriteTimeout = 10 * time.Second
+
+// How long a client may stay silent. It is pinged every keepaliveInterval
+// and must answer, so a client that is gone without closing is noticed.
+const readTimeout = 2 * keepaliveInterval
+
+// Largest message read from a client, which has nothing to say.
+const maxMessageSize = 1 << 16
+
+// upgrader answers the handshake. The origin is checked by changes before
+// upgrading, so that a refused page gets the error as JSON.
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// websocketRequested reports whether r asks for an upgrade to WebSocket.
+func websocketRequested(r *http.Request) bool {
+	return websocket.IsWebSocketUpgrade(r)
+}
+
+// originAllowed reports whether the page r comes from may open a stream:
+// browsers send the Origin of the page, which must be the host serving the
+// API or one of allowed, so that other sites cannot read the topology
+// through the browser of someone on the network. Clients other than
+// browsers send no Origin.
+func originAllowed(r *http.Request, allowed []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, a := range allowed {
+		if a == "*" || strings.EqualFold(strings.TrimSuffix(a, "/"), origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+type wsConn struct {
+	conn *websocket.Conn
+	mu   sync.Mutex // serializes messages, control frames need not
+	// gone is closed once the client closed the connection or broke it.
+	gone chan struct{}
+}
+
+// upgradeWebSocket answers the handshake of r and returns the connection.
+// On error the response was written already.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &wsConn{conn: conn, gone: make(chan struct{})}
+	go c.read()
+	return c, nil
+}
+
+func (c *wsConn) change(_ graphDB.Change, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(frameWriteTimeout))
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *wsConn) keepalive() error {
+	return c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(frameWriteTimeout))
+}
+
+func (c *wsConn) end(err error) {
+	switch {
+	case err == nil:
+		c.writeClose(websocket.CloseGoingAway, errShuttingDown.Error())
+	case errors.Is(err, graphDB.ErrLagged):
+		c.writeClose(websocket.ClosePolicyViolation, err.Error())
+	default:
+		c.writeClose(websocket.CloseNormalClosure, "")
+	}
+}
+
+func (c *wsConn) close() {
+	c.conn.Close()
+}
+
+// writeClose sends a close frame with code and reason, the latter cut to
+// what fits a control frame.
+func (c *wsConn) writeClose(code int, reason string) error {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	msg := websocket.FormatCloseMessage(code, reason)
+	return c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(frameWriteTimeout))
+}
+
+// read reads what the client sends until it closes the connection or
+// stays silent longer than readTimeout; the connection answers pings and
+// closes on its own. Any message, pongs included, proves the client is
+// still there.
+func (c *wsConn) read() {
+	defer close(c.gone)
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(readTimeout))
+	})
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(readTimeout))
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
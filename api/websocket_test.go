@@ -0,0 +1,140 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lucianolacurcia/sprint-5/graphDB"
+)
+
+// dialChanges opens a WebSocket stream of changes on srv with origin.
+func dialChanges(srv *httptest.Server, origin string) (*websocket.Conn, *http.Response, error) {
+	header := http.Header{}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+	return websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/v1/changes", header)
+}
+
+func TestWebSocketStream(t *testing.T) {
+	feed := graphDB.NewFeed()
+	api := New(graphDB.NewMemoryStore(), feed, Options{})
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	conn, _, err := dialChanges(srv, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// the stream subscribes after the handshake, so publish until a change
+	// gets through
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				feed.Publish(graphDB.Change{Type: graphDB.ContainerStarted})
+			case <-stop:
+				return
+			}
+		}
+	}()
+	typ, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c graphDB.Change
+	if err := json.Unmarshal(data, &c); err != nil {
+		t.Fatal(err)
+	}
+	if typ != websocket.TextMessage || c.Type != graphDB.ContainerStarted {
+		t.Errorf("message = %d %s, want a text %s change", typ, data, graphDB.ContainerStarted)
+	}
+
+	// shutting down closes the stream with going away
+	api.Close()
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway || closeErr.Text != errShuttingDown.Error() {
+		t.Errorf("err = %v, want close %d %q", err, websocket.CloseGoingAway, errShuttingDown)
+	}
+}
+
+func TestWebSocketRejectsOrigin(t *testing.T) {
+	srv := httptest.NewServer(New(graphDB.NewMemoryStore(), graphDB.NewFeed(), Options{}))
+	defer srv.Close()
+
+	conn, resp, err := dialChanges(srv, "http://evil.example")
+	if err == nil {
+		conn.Close()
+		t.Fatal("upgrade succeeded")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("response = %v, want 403", resp)
+	}
+}
+
+func TestOriginAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		origin  string
+		allowed []string
+		ok      bool
+	}{
+		{"no origin", "", nil, true},
+		{"same host", "http://topology.local:7476", nil, true},
+		{"other host", "http://evil.example", nil, false},
+		{"same host other port", "http://topology.local:8080", nil, false},
+		{"listed", "https://dash.example", []string{"https://dash.example/"}, true},
+		{"listed in other case", "https://Dash.example", []string{"https://dash.example"}, true},
+		{"any", "http://evil.example", []string{"*"}, true},
+		{"not listed", "http://evil.example", []string{"https://dash.example"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://topology.local:7476/v1/changes", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := originAllowed(r, tt.allowed); got != tt.ok {
+				t.Errorf("allowed = %v, want %v", got, tt.ok)
+			}
+		})
+	}
+}
+
+func TestWebsocketRequested(t *testing.T) {
+	tests := []struct {
+		connection, upgrade string
+		ok                  bool
+	}{
+		{"Upgrade", "websocket", true},
+		{"keep-alive, Upgrade", "WebSocket", true},
+		{"keep-alive", "websocket", false},
+		{"Upgrade", "h2c", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/v1/changes", nil)
+		r.Header.Set("Connection", tt.connection)
+		r.Header.Set("Upgrade", tt.upgrade)
+		if got := websocketRequested(r); got != tt.ok {
+			t.Errorf("Connection %q, Upgrade %q: requested = %v, want %v", tt.connection, tt.upgrade, got, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/lucianolacurcia/sprint-5/graphDB"
+	"google.golang.org/grpc"
+)
+
+// Longest wait between two pushes while the collector cannot be reached.
+const maxPushBackoff = time.Minute
+
+// How long a push may take.
+const pushTimeout = 30 * time.Second
+
+// errAgentWipe is returned by Agent.Wipe: the graph belongs to the
+// collector.
+var errAgentWipe = errors.New("an agent cannot wipe the graph, run wipe against the collector's store")
+
+// AgentOptions configure an Agent.
+type AgentOptions struct {
+	// Collector is the host:port of the collector.
+	Collector string
+	TLS       TLS
+	// PushInterval is how often merged writes are pushed.
+	PushInterval time.Duration
+	// BufferSize is how many nodes and relationships the writes not pushed
+	// yet may touch before traffic writes are dropped. Container and
+	// network writes are always kept.
+	BufferSize int
+}
+
+// Agent is a TopologyStore that pushes its writes to a collector. Writes
+// are merged in a buffer until pushed, and kept there while the collector
+// cannot be reached; reads are answered from a copy of everything written,
+// so the analyzer runs the same whether the collector is up or not.
+type Agent struct {
+	opts     AgentOptions
+	conn     *grpc.ClientConn
+	hostname string
+
+	mirror *graphDB.MemoryStore
+
+	mu      sync.Mutex
+	pending *graphDB.Batch
+	// full is set until the whole graph has been pushed in this run and
+	// after the collector restarted.
+	full    bool
+	session string
+	dropped int64
+	lastErr error
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// NewAgent starts pushing to the collector. The collector does not need to
+// be reachable yet.
+func NewAgent(opts AgentOptions) (*Agent, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dial(opts.Collector, opts.TLS)
+	if err != nil {
+		return nil, err
+	}
+	a := &Agent{
+		opts:     opts,
+		conn:     conn,
+		hostname: hostname,
+		mirror:   graphDB.NewMemoryStore(),
+		pending:  graphDB.NewBatch(),
+		full:     true,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go a.run()
+	return a, nil
+}
+
+// write applies a write to the mirror and the buffer. Traffic writes are
+// dropped, and ErrQueueFull returned, while the buffer is full.
+func (a *Agent) write(op string, traffic bool, apply func(b *graphDB.Batch)) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if traffic && a.pending.Len() >= a.opts.BufferSize {
+		a.dropped++
+		return &graphDB.StoreError{Op: op, Err: graphDB.ErrQueueFull}
+	}
+	apply(a.pending)
+	// the mirror takes the same writes, through a batch of its own
+	b := graphDB.NewBatch()
+	apply(b)
+	return a.mirror.WriteBatch(b)
+}
+
+func (a *Agent) InsertContainer(container types.ContainerJSON, ip, daemon string) error {
+	return a.write("insert container", false, func(b *graphDB.Batch) { b.InsertContainer(container, ip, daemon) })
+}
+
+func (a *Agent) UpdateContainer(container types.ContainerJSON, ip, daemon string) error {
+	return a.write("update container", false, func(b *graphDB.Batch) { b.UpdateContainer(container, ip, daemon) })
+}
+
+func (a *Agent) MarkContainerRemoved(id string) error {
+	return a.write("mark container removed", false, func(b *graphDB.Batch) { b.MarkContainerRemoved(id) })
+}
+
+func (a *Agent) InsertNoContainerNode(ip string) error {
+	return a.write("insert NoContainer", true, func(b *graphDB.Batch) { b.InsertNoContainerNode(ip) })
+}
+
+func (a *Agent) InsertNetwork(network types.NetworkResource, daemon string) error {
+	return a.write("insert network", false, func(b *graphDB.Batch) { b.InsertNetwork(network, daemon) })
+}
+
+func (a *Agent) RemoveNetwork(id string) error {
+	return a.write("remove network", false, func(b *graphDB.Batch) { b.RemoveNetwork(id) })
+}
+
+func (a *Agent) SetAttachments(id string, attachments []graphDB.Attachment) error {
+	return a.write("set attachments", false, func(b *graphDB.Batch) { b.SetAttachments(id, attachments) })
+}
+
+func (a *Agent) AddDependency(edge graphDB.Edge, app graphDB.AppLayer) error {
+	return a.write("add dependency", true, func(b *graphDB.Batch) { b.AddDependency(edge, app) })
+}
+
+func (a *Agent) UpdateDependencyAppLayer(edge graphDB.Edge, app graphDB.AppLayer) error {
+	return a.write("update dependency", true, func(b *graphDB.Batch) { b.UpdateDependencyAppLayer(edge, app) })
+}
+
+func (a *Agent) AddDependencyMetrics(edge graphDB.Edge, delta graphDB.Metrics) error {
+	return a.write("add dependency metrics", true, func(b *graphDB.Batch) { b.AddDependencyMetrics(edge, delta) })
+}
+
+func (a *Agent) Containers() ([]graphDB.ContainerNode, error) {
+	return a.mirror.Containers()
+}
+
+func (a *Agent) Networks() ([]graphDB.NetworkNode, error) {
+	return a.mirror.Networks()
+}
+
+func (a *Agent) NoContainers() ([]graphDB.NoContainerNode, error) {
+	return a.mirror.NoContainers()
+}
+
+func (a *Agent) Dependencies() ([]graphDB.Edge, error) {
+	return a.mirror.Dependencies()
+}
+
+func (a *Agent) ServiceDependencies() ([]graphDB.ServiceEdge, error) {
+	return a.mirror.ServiceDependencies()
+}
+
+// Graph returns the graph of this host only; the collector has the others.
+// So do Nodes and ContainerDependencies.
+func (a *Agent) Graph() (graphDB.Graph, error) {
+	return a.mirror.Snapshot(), nil
+}
+
+func (a *Agent) Nodes() (graphDB.Graph, error) {
+	return a.mirror.Nodes()
+}
+
+func (a *Agent) ContainerDependencies(id string) ([]graphDB.Dependency, error) {
+	return a.mirror.ContainerDependencies(id)
+}
+
+// OnApplied reports the writes as this host's mirror of the graph applies
+// them, whether or not they reached the collector yet.
+func (a *Agent) OnApplied(fn func(applied *graphDB.Batch)) {
+	a.mirror.OnApplied(fn)
+}
+
+func (a *Agent) Wipe() error {
+	return errAgentWipe
+}
+
+// Err returns the error of the last push, or nil once one succeeds.
+func (a *Agent) Err() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lastErr
+}
+
+// Close makes one last push and disconnects. It returns the error of that
+// push.
+func (a *Agent) Close() error {
+	a.once.Do(func() { close(a.stop) })
+	<-a.done
+	err := a.Err()
+	a.conn.Close()
+	return err
+}
+
+// run pushes every PushInterval, backing off while pushes fail.
+func (a *Agent) run() {
+	defer close(a.done)
+	wait := a.opts.PushInterval
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			err := a.push()
+			switch {
+			case err == nil:
+				wait = a.opts.PushInterval
+			case wait < maxPushBackoff:
+				wait *= 2
+				if wait > maxPushBackoff {
+					wait = maxPushBackoff
+				}
+			}
+			timer.Reset(wait)
+		case <-a.stop:
+			a.push()
+			return
+		}
+	}
+}
+
+// push sends the buffer. Writes made during the push go to a new buffer;
+// if the push fails they are merged back after the ones that failed.
+func (a *Agent) push() error {
+	a.mu.Lock()
+	full := a.full
+	sent := a.pending
+	b := sent
+	if full {
+		b = graphDB.GraphBatch(a.mirror.Snapshot())
+		b.Merge(sent)
+	}
+	if b.Len() == 0 {
+		a.mu.Unlock()
+		return nil
+	}
+	a.pending = graphDB.NewBatch()
+	a.mu.Unlock()
+
+	req := &PushRequest{
+		Agent: AgentInfo{Hostname: a.hostname, Addresses: hostAddresses()},
+		Full:  full,
+		Batch: b,
+	}
+	var reply PushReply
+	ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+	err := a.conn.Invoke(ctx, pushMethod, req, &reply)
+	cancel()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err != nil {
+		if a.lastErr == nil {
+			log.Printf("collector %s unreachable, buffering: %v", a.opts.Collector, err)
+		}
+		a.lastErr = err
+		// a full push is rebuilt from the mirror, only the writes it
+		// carried on top are kept
+		sent.Merge(a.pending)
+		a.pending = sent
+		return err
+	}
+	if a.lastErr != nil {
+		log.Printf("collector %s reachable again, %d traffic writes dropped meanwhile", a.opts.Collector, a.dropped)
+		a.dropped = 0
+	}
+	a.lastErr = nil
+	if full {
+		a.full = false
+	} else if a.session != "" && reply.Session != a.session {
+		// the collector restarted and may have lost what it had
+		a.full = true
+	}
+	a.session = reply.Session
+	return nil
+}
+
+// Interfaces whose addresses are not reachable from other hosts: loopback
+// aside, bridges and veths of container engines.
+var privateInterfaces = []string{"docker", "br-", "veth", "cni", "podman", "virbr"}
+
+// hostAddresses returns the addresses other hosts may reach this one at.
+func hostAddresses() []string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var out []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || private(iface.Name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			out = append(out, ipNet.IP.String())
+		}
+	}
+	return out
+}
+
+func private(name string) bool {
+	for _, prefix := range privateInterfaces {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	_ graphDB.TopologyStore   = (*Agent)(nil)
+	_ graphDB.GraphReader     = (*Agent)(nil)
+	_ graphDB.AppliedReporter = (*Agent)(nil)
+)
@@ -0,0 +1,220 @@
+// Package cluster splits docker-topology across hosts: an agent on every
+// host watches its engines and captures its traffic, and pushes what it
+// writes to a collector, which owns the graph and ties together the
+// containers of different hosts that talk to each other.
+//
+// Agents and the collector speak gRPC. Messages are JSON, so there is no
+// generated code: an agent pushes the writes it merged since its last push
+// as a single unary call, which the collector applies whole or not at all.
+package cluster
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/lucianolacurcia/sprint-5/graphDB"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/peer"
+)
+
+// Largest push accepted, a whole graph included.
+const maxMessageSize = 64 << 20
+
+const pushMethod = "/topology.Collector/Push"
+
+// PushRequest carries the writes an agent made since its last push.
+type PushRequest struct {
+	Agent AgentInfo `json:"agent"`
+	// Full is set when Batch writes the whole graph of the agent: its nodes
+	// missing from it are gone.
+	Full  bool           `json:"full,omitempty"`
+	Batch *graphDB.Batch `json:"batch"`
+}
+
+// AgentInfo describes the host an agent runs on.
+type AgentInfo struct {
+	// Hostname is the hostname the nodes of the agent are written with.
+	Hostname string `json:"hostname"`
+	// Addresses are the addresses of the host itself, through which its
+	// published ports are reached.
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// PushReply acknowledges a push.
+type PushReply struct {
+	// Session changes when the collector restarts, so that agents push
+	// their whole graph again.
+	Session string `json:"session"`
+}
+
+// TLS names the PEM files securing the connections between agents and the
+// collector. With none set, connections are in plain text.
+type TLS struct {
+	// CA verifies the collector, on an agent, or the agents, on the
+	// collector, which then requires them to present a certificate.
+	CA string
+	// Cert and Key are the certificate presented to the other side.
+	Cert string
+	Key  string
+}
+
+func (t TLS) enabled() bool {
+	return t.CA != "" || t.Cert != "" || t.Key != ""
+}
+
+// authenticates reports whether the collector serving with t knows who
+// its agents are: it serves TLS and requires them a certificate.
+func (t TLS) authenticates() bool {
+	return t.CA != "" && t.Cert != "" && t.Key != ""
+}
+
+// peerNames returns the names the verified client certificate of the call
+// in ctx is issued to: its common name and DNS names.
+func peerNames(ctx context.Context) ([]string, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, errors.New("no peer")
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil, errors.New("no verified client certificate")
+	}
+	cert := info.State.VerifiedChains[0][0]
+	names := append([]string{}, cert.DNSNames...)
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names, nil
+}
+
+// namesHost reports whether one of names is hostname, whole or as the
+// first label of a domain name.
+func namesHost(names []string, hostname string) bool {
+	for _, name := range names {
+		if strings.EqualFold(name, hostname) || strings.EqualFold(strings.SplitN(name, ".", 2)[0], hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// config returns the TLS configuration for the client or the server side.
+func (t TLS) config(server bool) (*tls.Config, error) {
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.Cert != "" || t.Key != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	} else if server {
+		return nil, errors.New("the collector needs a certificate and key to serve TLS")
+	}
+	if t.CA != "" {
+		pem, err := ioutil.ReadFile(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificate found", t.CA)
+		}
+		if server {
+			c.ClientCAs = pool
+			c.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			c.RootCAs = pool
+		}
+	}
+	return c, nil
+}
+
+// jsonCodec marshals messages as JSON. Calls select it by content subtype.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// collectorServer is the service the collector implements.
+type collectorServer interface {
+	Push(ctx context.Context, req *PushRequest) (*PushReply, error)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "topology.Collector",
+	HandlerType: (*collectorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Push", Handler: pushHandler},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "cluster.go",
+}
+
+func pushHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := new(PushRequest)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(collectorServer).Push(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: pushMethod}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(collectorServer).Push(ctx, req.(*PushRequest))
+	}
+	return interceptor(ctx, req, info, handler)
+}
+
+// dial opens the connection of an agent to the collector at addr. It does
+// not wait for the collector to be reachable.
+func dial(addr string, t TLS) (*grpc.ClientConn, error) {
+	opts := []grpc.DialOption{
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(jsonCodec{}.Name()), grpc.MaxCallSendMsgSize(maxMessageSize)),
+	}
+	if t.enabled() {
+		c, err := t.config(false)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(c)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	return grpc.Dial(addr, opts...)
+}
+
+// newServer returns a gRPC server serving c.
+func newServer(c *Collector, t TLS) (*grpc.Server, error) {
+	opts := []grpc.ServerOption{grpc.MaxRecvMsgSize(maxMessageSize)}
+	if t.enabled() {
+		config, err := t.config(true)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(config)))
+	}
+	server := grpc.NewServer(opts...)
+	server.RegisterService(&serviceDesc, c)
+	return server, nil
+}
@@ -0,0 +1,353 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucianolacurcia/sprint-5/graphDB"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Collector receives the writes of agents and applies them to the graph,
+// after pointing the edges that reach the container of another agent at
+// it. Each agent writes its own partition of the graph, by hostname.
+type Collector struct {
+	store   graphDB.SharedStore
+	session string
+	server  *grpc.Server
+	tls     TLS
+
+	mu     sync.Mutex
+	agents map[string]*agentState // by hostname
+}
+
+// agentState is what the collector knows of an agent: the containers and
+// networks it pushed and the addresses of its host.
+type agentState struct {
+	addresses []string
+	inventory *graphDB.MemoryStore
+	// index is rebuilt from inventory once it changes
+	index *hostIndex
+}
+
+// NewCollector returns a collector writing to store.
+func NewCollector(store graphDB.SharedStore, t TLS) (*Collector, error) {
+	c := &Collector{
+		store:   store,
+		session: strconv.FormatInt(time.Now().UnixNano(), 36),
+		tls:     t,
+		agents:  make(map[string]*agentState),
+	}
+	server, err := newServer(c, t)
+	if err != nil {
+		return nil, err
+	}
+	c.server = server
+	return c, nil
+}
+
+// errUnauthenticated is returned by Listen for an address other hosts can
+// reach while agents are not authenticated: anyone reaching it could
+// write, or remove, the nodes of any host.
+var errUnauthenticated = errors.New("the collector only listens on addresses other than loopback with the cluster tls ca, cert and key set, so that agents present a certificate")
+
+// Listen listens on addr for agents. Without TLS client authentication,
+// addr must be a loopback address.
+func (c *Collector) Listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := l.Addr().(*net.TCPAddr); !c.tls.authenticates() && (!ok || !tcp.IP.IsLoopback()) {
+		l.Close()
+		return nil, fmt.Errorf("%s: %w", addr, errUnauthenticated)
+	}
+	return l, nil
+}
+
+// Serve accepts agents on l until Stop is called.
+func (c *Collector) Serve(l net.Listener) error {
+	return c.server.Serve(l)
+}
+
+// Stop waits for the pushes in progress and stops serving.
+func (c *Collector) Stop() {
+	c.server.GracefulStop()
+}
+
+// Push applies the writes of an agent. Pushes are applied one at a time,
+// so that each resolves edges against the others it follows.
+func (c *Collector) Push(ctx context.Context, req *PushRequest) (*PushReply, error) {
+	if req.Agent.Hostname == "" || req.Batch == nil {
+		return nil, status.Error(codes.InvalidArgument, "a push needs a hostname and a batch")
+	}
+	if c.tls.authenticates() {
+		// an agent only writes the partition of the host its certificate
+		// is issued to
+		names, err := peerNames(ctx)
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		if !namesHost(names, req.Agent.Hostname) {
+			return nil, status.Errorf(codes.PermissionDenied, "certificate issued to %s, not %s", strings.Join(names, ", "), req.Agent.Hostname)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	agent, ok := c.agents[req.Agent.Hostname]
+	if !ok || req.Full {
+		if !ok {
+			log.Printf("agent %s connected", req.Agent.Hostname)
+		}
+		agent = &agentState{inventory: graphDB.NewMemoryStore()}
+		c.agents[req.Agent.Hostname] = agent
+	}
+	agent.addresses = req.Agent.Addresses
+	if inventory := req.Batch.Inventory(); inventory.Len() > 0 {
+		agent.inventory.WriteBatch(inventory)
+		agent.index = nil
+	}
+	if req.Full {
+		if err := c.dropGone(req.Agent.Hostname, agent, req.Batch); err != nil {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+	}
+	req.Batch.RewriteEdges(func(edge graphDB.Edge) (graphDB.Edge, bool) {
+		return c.resolve(req.Agent.Hostname, edge)
+	})
+	if err := c.store.WriteBatch(req.Batch); err != nil {
+		// the agent keeps the writes and pushes them again
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &PushReply{Session: c.session}, nil
+}
+
+// dropGone adds to b the removal of the nodes of the agent at hostname
+// that its whole graph, now in agent.inventory, no longer has.
+func (c *Collector) dropGone(hostname string, agent *agentState, b *graphDB.Batch) error {
+	graph := agent.inventory.Snapshot()
+	containers := make(map[string]bool, len(graph.Containers))
+	for _, node := range graph.Containers {
+		containers[node.ID] = true
+	}
+	networks := make(map[string]bool, len(graph.Networks))
+	for _, node := range graph.Networks {
+		networks[node.ID] = true
+	}
+
+	stored, err := c.store.HostContainers(hostname)
+	if err != nil {
+		return err
+	}
+	for _, node := range stored {
+		if !containers[node.ID] && node.Status != graphDB.StatusRemoved {
+			b.MarkContainerRemoved(node.ID)
+		}
+	}
+	storedNetworks, err := c.store.HostNetworks(hostname)
+	if err != nil {
+		return err
+	}
+	for _, node := range storedNetworks {
+		if !networks[node.ID] {
+			b.RemoveNetwork(node.ID)
+		}
+	}
+	return nil
+}
+
+// resolve returns edge, as seen by the agent at hostname, with the ends
+// that are containers of other agents pointed at them, and whether the
+// traffic the agent saw on it counts: when the client turns out to be the
+// container of another agent, that agent captured the same packets and
+// accounts for them.
+func (c *Collector) resolve(hostname string, edge graphDB.Edge) (graphDB.Edge, bool) {
+	counted := true
+	if !edge.To.IsContainer() {
+		if id, port, ok := c.lookup(hostname, edge.To.IP, edge.Port, edge.Protocol); ok {
+			edge.To = graphDB.ContainerEndpoint(id)
+			edge.Port = port
+		}
+	}
+	if !edge.From.IsContainer() {
+		if id, _, ok := c.lookup(hostname, edge.From.IP, 0, ""); ok {
+			edge.From = graphDB.ContainerEndpoint(id)
+			counted = false
+		}
+	}
+	return edge, counted
+}
+
+// lookup finds the container of another agent than the one at hostname
+// that ip, and port if not 0, reach: one with that address on a network
+// spanning hosts, or one publishing port on a host at ip. It returns the
+// container and the port it listens on, unless no container or several
+// match.
+func (c *Collector) lookup(hostname, ip string, port int, proto string) (string, int, bool) {
+	self := c.indexOf(hostname)
+	var (
+		found     string
+		foundPort int
+		matches   int
+	)
+	for other, agent := range c.agents {
+		if other == hostname {
+			continue
+		}
+		index := c.indexOf(other)
+		if id, ok := index.global[ip]; ok {
+			found, foundPort = id, port
+			matches++
+			continue
+		}
+		if port == 0 || !contains(agent.addresses, ip) || self.inSubnet(ip) || index.inSubnet(ip) {
+			continue
+		}
+		for _, p := range index.published[strconv.Itoa(port)+"/"+proto] {
+			if p.hostIP == "" || p.hostIP == ip || net.ParseIP(p.hostIP).IsUnspecified() {
+				found, foundPort = p.container, p.port
+				matches++
+				break
+			}
+		}
+	}
+	return found, foundPort, matches == 1
+}
+
+// indexOf returns the index of the agent at hostname, building it if its
+// inventory changed. c.mu must be held.
+func (c *Collector) indexOf(hostname string) *hostIndex {
+	agent, ok := c.agents[hostname]
+	if !ok {
+		return &hostIndex{}
+	}
+	if agent.index == nil {
+		agent.index = newHostIndex(agent.inventory.Snapshot())
+	}
+	return agent.index
+}
+
+// hostIndex is how the running containers of an agent are reached from
+// other hosts.
+type hostIndex struct {
+	// global maps the addresses of containers on networks spanning hosts to
+	// their container.
+	global map[string]string
+	// published maps a host port, as port/protocol, to the containers
+	// publishing it.
+	published map[string][]publishedPort
+	// subnets of the networks of the host, whose addresses are not the
+	// host's own even if its interfaces carry them.
+	subnets []*net.IPNet
+}
+
+type publishedPort struct {
+	container string
+	port      int
+	// hostIP is the address the port is bound to, unspecified for all.
+	hostIP string
+}
+
+func newHostIndex(g graphDB.Graph) *hostIndex {
+	index := &hostIndex{
+		global:    make(map[string]string),
+		published: make(map[string][]publishedPort),
+	}
+	networks := make(map[string]graphDB.NetworkNode, len(g.Networks))
+	for _, network := range g.Networks {
+		networks[network.ID] = network
+		for _, subnet := range network.Subnets {
+			if _, ipNet, err := net.ParseCIDR(subnet); err == nil {
+				index.subnets = append(index.subnets, ipNet)
+			}
+		}
+	}
+	running := make(map[string]bool)
+	for _, node := range g.Containers {
+		if node.Status != "running" {
+			continue
+		}
+		running[node.ID] = true
+		index.addPorts(node.ID, node.Ports)
+	}
+	for _, a := range g.Attachments {
+		if !running[a.ContainerID] || !spansHosts(networks[a.NetworkID]) {
+			continue
+		}
+		for _, ip := range []string{a.IP, a.IPv6} {
+			if ip != "" {
+				index.global[ip] = a.ContainerID
+			}
+		}
+	}
+	return index
+}
+
+func (i *hostIndex) inSubnet(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, subnet := range i.subnets {
+		if parsed != nil && subnet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// spansHosts reports whether the addresses of network are reachable from
+// other hosts as they are: swarm overlays and networks bridged to the
+// physical one.
+func spansHosts(network graphDB.NetworkNode) bool {
+	switch {
+	case network.Scope == "swarm" || network.Scope == "global":
+		return true
+	case network.Driver == "overlay" || network.Driver == "macvlan" || network.Driver == "ipvlan":
+		return true
+	}
+	return false
+}
+
+// addPorts indexes the ports published by container id, as its node
+// lists them: one "80/tcp -> 0.0.0.0:8080" line each.
+func (i *hostIndex) addPorts(id, ports string) {
+	for _, line := range strings.Split(ports, "\n") {
+		parts := strings.SplitN(line, " -> ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		inner := strings.SplitN(parts[0], "/", 2)
+		// the host address may be IPv6, unbracketed
+		colon := strings.LastIndex(parts[1], ":")
+		if len(inner) != 2 || colon < 0 {
+			continue
+		}
+		port, err := strconv.Atoi(inner[0])
+		if err != nil {
+			continue
+		}
+		key := parts[1][colon+1:] + "/" + inner[1]
+		i.published[key] = append(i.published[key], publishedPort{
+			container: id,
+			port:      port,
+			hostIP:    parts[1][:colon],
+		})
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
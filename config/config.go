@@ -0,0 +1,767 @@
+// Package config loads the settings of docker-topology.
+//
+// Values are merged in the following order, each source overriding the
+// previous one:
+//
+//  1. built-in defaults
+//  2. the config file (YAML or TOML, chosen by extension) given with
+//     -config or TOPOLOGY_CONFIG
+//  3. TOPOLOGY_* environment variables
+//  4. command-line flags
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Analyzer names accepted in Config.Analyzers.
+const (
+	AnalyzerDocker  = "docker"
+	AnalyzerTraffic = "traffic"
+)
+
+// Container engines accepted in Docker.Runtime.
+const (
+	RuntimeDocker = "docker"
+	RuntimePodman = "podman"
+)
+
+// Graph store backends accepted in Store.Backend.
+const (
+	StoreNeo4j  = "neo4j"
+	StoreMemory = "memory"
+)
+
+// What to do with graph writes when the write queue is full, accepted in
+// Store.QueuePolicy.
+const (
+	QueueBlock = "block"
+	QueueDrop  = "drop"
+)
+
+// Maximum snapshot length accepted by libpcap.
+const maxSnaplen = 262144
+
+type Config struct {
+	Store     Store    `yaml:"store" toml:"store"`
+	Neo4j     Neo4j    `yaml:"neo4j" toml:"neo4j"`
+	Docker    Docker   `yaml:"docker" toml:"docker"`
+	Capture   Capture  `yaml:"capture" toml:"capture"`
+	Cluster   Cluster  `yaml:"cluster" toml:"cluster"`
+	API       API      `yaml:"api" toml:"api"`
+	Analyzers []string `yaml:"analyzers" toml:"analyzers"`
+
+	// Args holds the command and its arguments left after the flags.
+	Args []string `yaml:"-" toml:"-"`
+}
+
+type Store struct {
+	Backend string `yaml:"backend" toml:"backend"`
+	// DumpFile is where the memory backend writes the graph as JSON on
+	// shutdown. Empty means stdout.
+	DumpFile string `yaml:"dump_file" toml:"dump_file"`
+	// QueueSize is how many writes to Neo4j may be queued before the
+	// QueuePolicy applies. Zero writes synchronously, without a queue.
+	QueueSize int `yaml:"queue_size" toml:"queue_size"`
+	// BatchSize is how many nodes and relationships a batch touches before
+	// it is flushed early.
+	BatchSize int `yaml:"batch_size" toml:"batch_size"`
+	// FlushInterval is how long a queued write may wait to be flushed.
+	FlushInterval time.Duration `yaml:"flush_interval" toml:"flush_interval"`
+	// QueuePolicy is block, to slow the analyzer down while Neo4j catches
+	// up, or drop, to lose writes instead.
+	QueuePolicy string `yaml:"queue_policy" toml:"queue_policy"`
+}
+
+type Neo4j struct {
+	URL  string `yaml:"url" toml:"url"`
+	User string `yaml:"user" toml:"user"`
+	// Password is never taken from a flag, where other users of the host
+	// could read it. PasswordFile, when set, replaces it with the content
+	// of that file.
+	Password     string `yaml:"password" toml:"password"`
+	PasswordFile string `yaml:"password_file" toml:"password_file"`
+	Database     string `yaml:"database" toml:"database"`
+}
+
+type Docker struct {
+	// Runtime is the container engine watched, docker or podman.
+	Runtime string `yaml:"runtime" toml:"runtime"`
+	// Host is the daemon address, e.g. unix:///var/run/docker.sock. When
+	// empty the DOCKER_* environment variables are used for Docker, and the
+	// API socket of the current user for Podman.
+	Host string `yaml:"host" toml:"host"`
+	// TLSCA, TLSCert and TLSKey are the PEM files verifying a tcp:// Host
+	// and authenticating to it. The DOCKER_* environment brings its own
+	// when Host is empty, and applies to no other daemon.
+	TLSCA   string `yaml:"tls_ca" toml:"tls_ca"`
+	TLSCert string `yaml:"tls_cert" toml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key" toml:"tls_key"`
+	// ReconcileInterval is how often the graph is compared with the daemon
+	// and corrected. Zero turns reconciliation off.
+	ReconcileInterval time.Duration `yaml:"reconcile_interval" toml:"reconcile_interval"`
+	// Daemons are further engines watched by the same process, each with
+	// its own inventory, events and partition of the graph.
+	Daemons []Daemon `yaml:"daemons" toml:"daemons"`
+}
+
+// Daemon is an engine watched besides the one of Docker.Host.
+type Daemon struct {
+	// Runtime is docker or podman; empty means Docker.Runtime.
+	Runtime string `yaml:"runtime" toml:"runtime"`
+	// Host is the engine address: unix://, tcp://, npipe:// or, for Docker,
+	// ssh://[user@]host[:port].
+	Host string `yaml:"host" toml:"host"`
+	// TLSCA, TLSCert and TLSKey are the PEM files verifying a tcp:// engine
+	// and authenticating to it.
+	TLSCA   string `yaml:"tls_ca" toml:"tls_ca"`
+	TLSCert string `yaml:"tls_cert" toml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key" toml:"tls_key"`
+}
+
+// AllDaemons returns every engine to watch, the one of Host first, with
+// their runtime filled in.
+func (d Docker) AllDaemons() []Daemon {
+	all := []Daemon{{Runtime: d.Runtime, Host: d.Host, TLSCA: d.TLSCA, TLSCert: d.TLSCert, TLSKey: d.TLSKey}}
+	for _, daemon := range d.Daemons {
+		if daemon.Runtime == "" {
+			daemon.Runtime = d.Runtime
+		}
+		all = append(all, daemon)
+	}
+	return all
+}
+
+type Capture struct {
+	Snaplen     int  `yaml:"snaplen" toml:"snaplen"`
+	Promiscuous bool `yaml:"promiscuous" toml:"promiscuous"`
+	// BPFFilter replaces the default per-container filter.
+	BPFFilter string `yaml:"bpf_filter" toml:"bpf_filter"`
+	// BPFOverrides maps a container name or ID to the filter used for it.
+	BPFOverrides map[string]string `yaml:"bpf_overrides" toml:"bpf_overrides"`
+	// MetricsInterval is how often edge traffic counters are written.
+	MetricsInterval time.Duration `yaml:"metrics_interval" toml:"metrics_interval"`
+}
+
+// Cluster splits docker-topology between agents, which watch the engines
+// of their host and push what they find, and a collector, which owns the
+// graph.
+type Cluster struct {
+	// Collector is the host:port of the collector. Setting it runs the live
+	// command as an agent, which writes to the collector instead of the
+	// store.
+	Collector string `yaml:"collector" toml:"collector"`
+	// Listen is the address the collector command accepts agents on.
+	Listen string `yaml:"listen" toml:"listen"`
+	// PushInterval is how often an agent pushes its writes.
+	PushInterval time.Duration `yaml:"push_interval" toml:"push_interval"`
+	// BufferSize is how many nodes and relationships the writes an agent
+	// could not push yet may touch before it drops traffic writes.
+	BufferSize int `yaml:"buffer_size" toml:"buffer_size"`
+	// TLSCA, TLSCert and TLSKey are the PEM files securing the connections
+	// between agents and the collector.
+	TLSCA   string `yaml:"tls_ca" toml:"tls_ca"`
+	TLSCert string `yaml:"tls_cert" toml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key" toml:"tls_key"`
+}
+
+// API is the HTTP query API.
+type API struct {
+	// Listen is the address the API is served on, empty to turn it off.
+	Listen string `yaml:"listen" toml:"listen"`
+	// Origins are the web origins, besides the API's own, whose pages may
+	// open the change feed over WebSocket; "*" allows any.
+	Origins []string `yaml:"origins" toml:"origins"`
+}
+
+const usage = `Usage: docker-topology [flags] [command]
+
+Commands:
+  (none)                             watch Docker and capture traffic live
+  snapshot FILE                      save the container inventory as JSON
+  replay -inventory FILE PCAP...     build the graph from capture files
+  wipe                               delete what docker-topology wrote to the store
+  migrate                            tag the nodes older versions wrote without an owner
+  collector                          apply what agents push to the store
+
+Flags:
+`
+
+// Default returns the configuration used when nothing else is given.
+func Default() Config {
+	return Config{
+		Store: Store{
+			Backend:       StoreNeo4j,
+			QueueSize:     10000,
+			BatchSize:     500,
+			FlushInterval: time.Second,
+			QueuePolicy:   QueueBlock,
+		},
+		Neo4j: Neo4j{
+			URL:  "neo4j://localhost:7687",
+			User: "neo4j",
+		},
+		Docker: Docker{
+			Runtime:           RuntimeDocker,
+			ReconcileInterval: 5 * time.Minute,
+		},
+		Capture: Capture{
+			Snaplen:         256000,
+			Promiscuous:     true,
+			MetricsInterval: 30 * time.Second,
+		},
+		Cluster: Cluster{
+			Listen:       "localhost:7475",
+			PushInterval: time.Second,
+			BufferSize:   100000,
+		},
+		API: API{
+			Listen: "localhost:7476",
+		},
+		Analyzers: []string{AnalyzerDocker, AnalyzerTraffic},
+	}
+}
+
+// Enabled reports whether the named analyzer is turned on.
+func (c Config) Enabled(analyzer string) bool {
+	for _, a := range c.Analyzers {
+		if a == analyzer {
+			return true
+		}
+	}
+	return false
+}
+
+// Load builds the configuration from defaults, the config file, the
+// environment and args, then validates it.
+func Load(args []string) (Config, error) {
+	cfg := Default()
+	fs := flag.NewFlagSet("docker-topology", flag.ContinueOnError)
+
+	var (
+		configFile   = fs.String("config", "", "path to a YAML or TOML config file (env TOPOLOGY_CONFIG)")
+		storeBackend = fs.String("store", cfg.Store.Backend, "graph store backend: neo4j or memory (env TOPOLOGY_STORE)")
+		storeDump    = fs.String("store-dump", "", "file the memory store is written to on exit, stdout if empty (env TOPOLOGY_STORE_DUMP)")
+		queueSize    = fs.Int("queue-size", cfg.Store.QueueSize, "graph writes queued for Neo4j, 0 to write synchronously (env TOPOLOGY_QUEUE_SIZE)")
+		batchSize    = fs.Int("batch-size", cfg.Store.BatchSize, "nodes and relationships per Neo4j batch (env TOPOLOGY_BATCH_SIZE)")
+		flushEvery   = fs.Duration("flush-interval", cfg.Store.FlushInterval, "how long a queued graph write may wait (env TOPOLOGY_FLUSH_INTERVAL)")
+		queuePolicy  = fs.String("queue-policy", cfg.Store.QueuePolicy, "when the write queue is full: block or drop (env TOPOLOGY_QUEUE_POLICY)")
+		neo4jURL     = fs.String("neo4j-url", cfg.Neo4j.URL, "Neo4j connection URL (env TOPOLOGY_NEO4J_URL)")
+		neo4jUser    = fs.String("neo4j-user", cfg.Neo4j.User, "Neo4j user (env TOPOLOGY_NEO4J_USER)")
+		passwordFile = fs.String("neo4j-password-file", "", "file holding the Neo4j password, which is otherwise read from TOPOLOGY_NEO4J_PASSWORD (env TOPOLOGY_NEO4J_PASSWORD_FILE)")
+		neo4jDB      = fs.String("neo4j-database", "", "Neo4j database name, empty for the server default (env TOPOLOGY_NEO4J_DATABASE)")
+		runtime      = fs.String("runtime", cfg.Docker.Runtime, "container engine: docker or podman (env TOPOLOGY_RUNTIME)")
+		dockerHost   = fs.String("docker-host", "", "Docker daemon or Podman socket address (env TOPOLOGY_DOCKER_HOST)")
+		dockerCA     = fs.String("docker-tls-ca", "", "CA verifying a tcp:// -docker-host (env TOPOLOGY_DOCKER_TLS_CA)")
+		dockerCert   = fs.String("docker-tls-cert", "", "certificate presented to a tcp:// -docker-host (env TOPOLOGY_DOCKER_TLS_CERT)")
+		dockerKey    = fs.String("docker-tls-key", "", "key of -docker-tls-cert (env TOPOLOGY_DOCKER_TLS_KEY)")
+		daemons      = listFlag{}
+		apiOrigins   = listFlag{}
+		reconcile    = fs.Duration("reconcile-interval", cfg.Docker.ReconcileInterval, "how often the graph is reconciled with Docker, 0 to disable (env TOPOLOGY_RECONCILE_INTERVAL)")
+		snaplen      = fs.Int("snaplen", cfg.Capture.Snaplen, "pcap snapshot length (env TOPOLOGY_SNAPLEN)")
+		promisc      = fs.Bool("promisc", cfg.Capture.Promiscuous, "capture in promiscuous mode (env TOPOLOGY_PROMISC)")
+		bpfFilter    = fs.String("bpf", "", "BPF filter replacing the default per-container one (env TOPOLOGY_BPF_FILTER)")
+		metricsEvery = fs.Duration("metrics-interval", cfg.Capture.MetricsInterval, "how often edge traffic counters are written (env TOPOLOGY_METRICS_INTERVAL)")
+		collector    = fs.String("collector", "", "collector host:port, runs as an agent pushing to it (env TOPOLOGY_COLLECTOR)")
+		listen       = fs.String("listen", cfg.Cluster.Listen, "address the collector accepts agents on (env TOPOLOGY_LISTEN)")
+		pushEvery    = fs.Duration("push-interval", cfg.Cluster.PushInterval, "how often an agent pushes to the collector (env TOPOLOGY_PUSH_INTERVAL)")
+		agentBuffer  = fs.Int("agent-buffer", cfg.Cluster.BufferSize, "nodes and relationships an agent buffers while the collector is unreachable (env TOPOLOGY_AGENT_BUFFER)")
+		clusterCA    = fs.String("cluster-tls-ca", "", "CA verifying the collector, or the agents on the collector (env TOPOLOGY_CLUSTER_TLS_CA)")
+		clusterCert  = fs.String("cluster-tls-cert", "", "certificate presented between agents and collector (env TOPOLOGY_CLUSTER_TLS_CERT)")
+		clusterKey   = fs.String("cluster-tls-key", "", "key of -cluster-tls-cert (env TOPOLOGY_CLUSTER_TLS_KEY)")
+		apiListen    = fs.String("api", cfg.API.Listen, "address the HTTP query API is served on, empty to disable (env TOPOLOGY_API)")
+		analyzers    = fs.String("analyzers", strings.Join(cfg.Analyzers, ","), "comma separated analyzers to run: docker,traffic (env TOPOLOGY_ANALYZERS)")
+		bpfOverrides = keyValueFlag{}
+	)
+	fs.Var(bpfOverrides, "bpf-override", "per-container BPF filter as name=filter, may be repeated (env TOPOLOGY_BPF_OVERRIDES, semicolon separated)")
+	fs.Var(&apiOrigins, "api-origin", "web origin allowed to open the change feed over WebSocket, may be repeated (env TOPOLOGY_API_ORIGINS, comma separated)")
+	fs.Var(&daemons, "daemon", "address of a further daemon to watch, may be repeated (env TOPOLOGY_DAEMONS, comma separated)")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	cfg.Args = fs.Args()
+
+	path := os.Getenv("TOPOLOGY_CONFIG")
+	if *configFile != "" {
+		path = *configFile
+	}
+	if path != "" {
+		if err := loadFile(path, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	if err := loadEnv(&cfg); err != nil {
+		return cfg, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "store":
+			cfg.Store.Backend = *storeBackend
+		case "store-dump":
+			cfg.Store.DumpFile = *storeDump
+		case "queue-size":
+			cfg.Store.QueueSize = *queueSize
+		case "batch-size":
+			cfg.Store.BatchSize = *batchSize
+		case "flush-interval":
+			cfg.Store.FlushInterval = *flushEvery
+		case "queue-policy":
+			cfg.Store.QueuePolicy = *queuePolicy
+		case "neo4j-url":
+			cfg.Neo4j.URL = *neo4jURL
+		case "neo4j-user":
+			cfg.Neo4j.User = *neo4jUser
+		case "neo4j-password-file":
+			cfg.Neo4j.PasswordFile = *passwordFile
+		case "neo4j-database":
+			cfg.Neo4j.Database = *neo4jDB
+		case "runtime":
+			cfg.Docker.Runtime = *runtime
+		case "docker-host":
+			cfg.Docker.Host = *dockerHost
+		case "docker-tls-ca":
+			cfg.Docker.TLSCA = *dockerCA
+		case "docker-tls-cert":
+			cfg.Docker.TLSCert = *dockerCert
+		case "docker-tls-key":
+			cfg.Docker.TLSKey = *dockerKey
+		case "daemon":
+			cfg.Docker.Daemons = daemonList(daemons)
+		case "reconcile-interval":
+			cfg.Docker.ReconcileInterval = *reconcile
+		case "snaplen":
+			cfg.Capture.Snaplen = *snaplen
+		case "promisc":
+			cfg.Capture.Promiscuous = *promisc
+		case "bpf":
+			cfg.Capture.BPFFilter = *bpfFilter
+		case "metrics-interval":
+			cfg.Capture.MetricsInterval = *metricsEvery
+		case "collector":
+			cfg.Cluster.Collector = *collector
+		case "listen":
+			cfg.Cluster.Listen = *listen
+		case "push-interval":
+			cfg.Cluster.PushInterval = *pushEvery
+		case "agent-buffer":
+			cfg.Cluster.BufferSize = *agentBuffer
+		case "cluster-tls-ca":
+			cfg.Cluster.TLSCA = *clusterCA
+		case "cluster-tls-cert":
+			cfg.Cluster.TLSCert = *clusterCert
+		case "cluster-tls-key":
+			cfg.Cluster.TLSKey = *clusterKey
+		case "api":
+			cfg.API.Listen = *apiListen
+		case "api-origin":
+			cfg.API.Origins = []string(apiOrigins)
+		case "analyzers":
+			cfg.Analyzers = splitList(*analyzers)
+		case "bpf-override":
+			if cfg.Capture.BPFOverrides == nil {
+				cfg.Capture.BPFOverrides = make(map[string]string)
+			}
+			for k, v := range bpfOverrides {
+				cfg.Capture.BPFOverrides[k] = v
+			}
+		}
+	})
+
+	if cfg.Neo4j.PasswordFile != "" {
+		data, err := ioutil.ReadFile(cfg.Neo4j.PasswordFile)
+		if err != nil {
+			return cfg, fmt.Errorf("neo4j password: %w", err)
+		}
+		cfg.Neo4j.Password = strings.TrimRight(string(data), "\r\n")
+	}
+
+	return cfg, cfg.Validate()
+}
+
+func loadFile(path string, cfg *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("config file %s: unknown key %q", path, undecoded[0].String())
+		}
+	default:
+		return fmt.Errorf("config file %s: unsupported extension, use .yaml, .yml or .toml", path)
+	}
+	return nil
+}
+
+func loadEnv(cfg *Config) error {
+	if v, ok := os.LookupEnv("TOPOLOGY_STORE"); ok {
+		cfg.Store.Backend = v
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_STORE_DUMP"); ok {
+		cfg.Store.DumpFile = v
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_QUEUE_SIZE"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("TOPOLOGY_QUEUE_SIZE: %q is not a number", v)
+		}
+		cfg.Store.QueueSize = n
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_BATCH_SIZE"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("TOPOLOGY_BATCH_SIZE: %q is not a number", v)
+		}
+		cfg.Store.BatchSize = n
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_FLUSH_INTERVAL"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("TOPOLOGY_FLUSH_INTERVAL: %q is not a duration", v)
+		}
+		cfg.Store.FlushInterval = d
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_QUEUE_POLICY"); ok {
+		cfg.Store.QueuePolicy = v
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_NEO4J_URL"); ok {
+		cfg.Neo4j.URL = v
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_NEO4J_USER"); ok {
+		cfg.Neo4j.User = v
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_NEO4J_PASSWORD"); ok {
+		cfg.Neo4j.Password = v
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_NEO4J_PASSWORD_FILE"); ok {
+		cfg.Neo4j.PasswordFile = v
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_NEO4J_DATABASE"); ok {
+		cfg.Neo4j.Database = v
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_RUNTIME"); ok {
+		cfg.Docker.Runtime = v
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_DOCKER_HOST"); ok {
+		cfg.Docker.Host = v
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_DOCKER_TLS_CA"); ok {
+		cfg.Docker.TLSCA = v
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_DOCKER_TLS_CERT"); ok {
+		cfg.Docker.TLSCert = v
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_DOCKER_TLS_KEY"); ok {
+		cfg.Docker.TLSKey = v
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_DAEMONS"); ok {
+		cfg.Docker.Daemons = daemonList(splitList(v))
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_RECONCILE_INTERVAL"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("TOPOLOGY_RECONCILE_INTERVAL: %q is not a duration", v)
+		}
+		cfg.Docker.ReconcileInterval = d
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_SNAPLEN"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("TOPOLOGY_SNAPLEN: %q is not a number", v)
+		}
+		cfg.Capture.Snaplen = n
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_PROMISC"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("TOPOLOGY_PROMISC: %q is not a boolean", v)
+		}
+		cfg.Capture.Promiscuous = b
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_BPF_FILTER"); ok {
+		cfg.Capture.BPFFilter = v
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_BPF_OVERRIDES"); ok {
+		// name=filter pairs, semicolon separated
+		overrides := keyValueFlag{}
+		for _, pair := range strings.Split(v, ";") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			if err := overrides.Set(pair); err != nil {
+				return fmt.Errorf("TOPOLOGY_BPF_OVERRIDES: %w", err)
+			}
+		}
+		cfg.Capture.BPFOverrides = overrides
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_METRICS_INTERVAL"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("TOPOLOGY_METRICS_INTERVAL: %q is not a duration", v)
+		}
+		cfg.Capture.MetricsInterval = d
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_COLLECTOR"); ok {
+		cfg.Cluster.Collector = v
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_LISTEN"); ok {
+		cfg.Cluster.Listen = v
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_PUSH_INTERVAL"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("TOPOLOGY_PUSH_INTERVAL: %q is not a duration", v)
+		}
+		cfg.Cluster.PushInterval = d
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_AGENT_BUFFER"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("TOPOLOGY_AGENT_BUFFER: %q is not a number", v)
+		}
+		cfg.Cluster.BufferSize = n
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_CLUSTER_TLS_CA"); ok {
+		cfg.Cluster.TLSCA = v
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_CLUSTER_TLS_CERT"); ok {
+		cfg.Cluster.TLSCert = v
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_CLUSTER_TLS_KEY"); ok {
+		cfg.Cluster.TLSKey = v
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_API"); ok {
+		cfg.API.Listen = v
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_API_ORIGINS"); ok {
+		cfg.API.Origins = splitList(v)
+	}
+	if v, ok := os.LookupEnv("TOPOLOGY_ANALYZERS"); ok {
+		cfg.Analyzers = splitList(v)
+	}
+	return nil
+}
+
+// Validate checks every setting and reports all problems at once.
+func (c Config) Validate() error {
+	var problems []string
+
+	switch c.Store.Backend {
+	case StoreNeo4j:
+		if u, err := url.Parse(c.Neo4j.URL); err != nil || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("neo4j url %q is not a valid URL", c.Neo4j.URL))
+		} else {
+			switch u.Scheme {
+			case "neo4j", "neo4j+s", "neo4j+ssc", "bolt", "bolt+s", "bolt+ssc":
+			default:
+				problems = append(problems, fmt.Sprintf("neo4j url scheme %q is not supported, use neo4j:// or bolt://", u.Scheme))
+			}
+		}
+		if c.Neo4j.User == "" {
+			problems = append(problems, "neo4j user must not be empty")
+		}
+		if c.Store.QueueSize < 0 {
+			problems = append(problems, fmt.Sprintf("queue size %d must not be negative", c.Store.QueueSize))
+		}
+		if c.Store.QueueSize > 0 {
+			if c.Store.BatchSize <= 0 {
+				problems = append(problems, fmt.Sprintf("batch size %d must be positive", c.Store.BatchSize))
+			}
+			if c.Store.FlushInterval <= 0 {
+				problems = append(problems, fmt.Sprintf("flush interval %s must be positive", c.Store.FlushInterval))
+			}
+			switch c.Store.QueuePolicy {
+			case QueueBlock, QueueDrop:
+			default:
+				problems = append(problems, fmt.Sprintf("unknown queue policy %q, valid ones are %s and %s", c.Store.QueuePolicy, QueueBlock, QueueDrop))
+			}
+		}
+	case StoreMemory:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown store backend %q, valid ones are %s and %s", c.Store.Backend, StoreNeo4j, StoreMemory))
+	}
+
+	seen := make(map[string]bool)
+	for i, d := range c.Docker.AllDaemons() {
+		problems = append(problems, d.problems(i > 0)...)
+		if seen[d.Host] {
+			problems = append(problems, fmt.Sprintf("daemon %q is listed twice", d.Host))
+		}
+		seen[d.Host] = true
+	}
+
+	if c.Docker.ReconcileInterval < 0 {
+		problems = append(problems, fmt.Sprintf("reconcile interval %s must not be negative", c.Docker.ReconcileInterval))
+	}
+
+	if c.Capture.Snaplen <= 0 || c.Capture.Snaplen > maxSnaplen {
+		problems = append(problems, fmt.Sprintf("snaplen %d must be between 1 and %d", c.Capture.Snaplen, maxSnaplen))
+	}
+	if c.Capture.MetricsInterval <= 0 {
+		problems = append(problems, fmt.Sprintf("metrics interval %s must be positive", c.Capture.MetricsInterval))
+	}
+	for name, filter := range c.Capture.BPFOverrides {
+		if name == "" || strings.TrimSpace(filter) == "" {
+			problems = append(problems, fmt.Sprintf("bpf override %q=%q needs both a container and a filter", name, filter))
+		}
+	}
+
+	if c.Cluster.Collector != "" {
+		if _, _, err := net.SplitHostPort(c.Cluster.Collector); err != nil {
+			problems = append(problems, fmt.Sprintf("collector %q must be host:port", c.Cluster.Collector))
+		}
+		if c.Cluster.PushInterval <= 0 {
+			problems = append(problems, fmt.Sprintf("push interval %s must be positive", c.Cluster.PushInterval))
+		}
+		if c.Cluster.BufferSize <= 0 {
+			problems = append(problems, fmt.Sprintf("agent buffer %d must be positive", c.Cluster.BufferSize))
+		}
+	}
+	if _, _, err := net.SplitHostPort(c.Cluster.Listen); err != nil {
+		problems = append(problems, fmt.Sprintf("listen address %q must be [host]:port", c.Cluster.Listen))
+	}
+	if (c.Cluster.TLSCert == "") != (c.Cluster.TLSKey == "") {
+		problems = append(problems, "cluster tls cert and key go together")
+	}
+	if c.API.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.API.Listen); err != nil {
+			problems = append(problems, fmt.Sprintf("api address %q must be [host]:port", c.API.Listen))
+		}
+	}
+
+	if len(c.Analyzers) == 0 {
+		problems = append(problems, "at least one analyzer must be enabled")
+	}
+	for _, a := range c.Analyzers {
+		switch a {
+		case AnalyzerDocker, AnalyzerTraffic:
+		default:
+			problems = append(problems, fmt.Sprintf("unknown analyzer %q, valid ones are %s and %s", a, AnalyzerDocker, AnalyzerTraffic))
+		}
+	}
+	if c.Enabled(AnalyzerTraffic) && !c.Enabled(AnalyzerDocker) {
+		problems = append(problems, "the traffic analyzer needs the docker analyzer to resolve container IPs")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  - " + strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// problems returns what is wrong with d. A further daemon, unlike the
+// first one, needs an address.
+func (d Daemon) problems(further bool) []string {
+	var problems []string
+	switch d.Runtime {
+	case RuntimeDocker, RuntimePodman:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown runtime %q, valid ones are %s and %s", d.Runtime, RuntimeDocker, RuntimePodman))
+	}
+	if d.Host == "" {
+		if further {
+			problems = append(problems, "a further daemon needs a host")
+		}
+		return problems
+	}
+	u, err := url.Parse(d.Host)
+	if err != nil {
+		return append(problems, fmt.Sprintf("docker host %q is not a valid address", d.Host))
+	}
+	switch u.Scheme {
+	case "unix", "tcp", "npipe":
+	case "ssh":
+		if d.Runtime == RuntimePodman {
+			problems = append(problems, fmt.Sprintf("podman host %q: ssh is only supported for docker", d.Host))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("docker host scheme %q is not supported, use unix://, tcp://, ssh:// or npipe://", u.Scheme))
+	}
+	if (d.TLSCA != "" || d.TLSCert != "" || d.TLSKey != "") && u.Scheme != "tcp" {
+		problems = append(problems, fmt.Sprintf("docker host %q: tls files only apply to tcp://", d.Host))
+	}
+	return problems
+}
+
+// daemonList returns the further daemons at hosts, with the default runtime.
+func daemonList(hosts []string) []Daemon {
+	daemons := make([]Daemon, 0, len(hosts))
+	for _, host := range hosts {
+		daemons = append(daemons, Daemon{Host: host})
+	}
+	return daemons
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// listFlag collects repeated flags.
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// keyValueFlag collects repeated key=value flags.
+type keyValueFlag map[string]string
+
+func (f keyValueFlag) String() string {
+	var pairs []string
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f keyValueFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected name=filter, got %q", s)
+	}
+	f[s[:i]] = s[i+1:]
+	return nil
+}
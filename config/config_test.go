@@ -0,0 +1,174 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	const (
+		yamlFile = "neo4j:\n  user: file\ncapture:\n  snaplen: 1500\nanalyzers: [docker]\n"
+		tomlFile = "analyzers = [\"docker\"]\n[neo4j]\nuser = \"file\"\n[capture]\nsnaplen = 1500\n"
+	)
+	tests := []struct {
+		name      string
+		file      string // extension of the config file, none if empty
+		env       map[string]string
+		args      []string
+		user      string
+		snaplen   int
+		analyzers []string
+	}{
+		{
+			name:      "defaults",
+			user:      "neo4j",
+			snaplen:   256000,
+			analyzers: []string{AnalyzerDocker, AnalyzerTraffic},
+		},
+		{
+			name:      "yaml file over defaults",
+			file:      ".yaml",
+			user:      "file",
+			snaplen:   1500,
+			analyzers: []string{AnalyzerDocker},
+		},
+		{
+			name:      "toml file over defaults",
+			file:      ".toml",
+			user:      "file",
+			snaplen:   1500,
+			analyzers: []string{AnalyzerDocker},
+		},
+		{
+			name:      "env over file",
+			file:      ".yaml",
+			env:       map[string]string{"TOPOLOGY_SNAPLEN": "9000", "TOPOLOGY_ANALYZERS": "docker,traffic"},
+			user:      "file",
+			snaplen:   9000,
+			analyzers: []string{AnalyzerDocker, AnalyzerTraffic},
+		},
+		{
+			name:      "flags over env",
+			file:      ".yaml",
+			env:       map[string]string{"TOPOLOGY_SNAPLEN": "9000", "TOPOLOGY_NEO4J_USER": "env"},
+			args:      []string{"-snaplen", "65535"},
+			user:      "env",
+			snaplen:   65535,
+			analyzers: []string{AnalyzerDocker},
+		},
+		{
+			name:      "flags only override what they set",
+			env:       map[string]string{"TOPOLOGY_SNAPLEN": "9000", "TOPOLOGY_NEO4J_USER": "env"},
+			args:      []string{"-neo4j-user", "flag"},
+			user:      "flag",
+			snaplen:   9000,
+			analyzers: []string{AnalyzerDocker, AnalyzerTraffic},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TOPOLOGY_CONFIG", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			args := append([]string{"-store", StoreMemory}, tt.args...)
+			if tt.file != "" {
+				content := yamlFile
+				if tt.file == ".toml" {
+					content = tomlFile
+				}
+				path := filepath.Join(t.TempDir(), "topology"+tt.file)
+				if err := ioutil.WriteFile(path, []byte(content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				args = append(args, "-config", path)
+			}
+			cfg, err := Load(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Neo4j.User != tt.user {
+				t.Errorf("neo4j user = %q, want %q", cfg.Neo4j.User, tt.user)
+			}
+			if cfg.Capture.Snaplen != tt.snaplen {
+				t.Errorf("snaplen = %d, want %d", cfg.Capture.Snaplen, tt.snaplen)
+			}
+			if !reflect.DeepEqual(cfg.Analyzers, tt.analyzers) {
+				t.Errorf("analyzers = %q, want %q", cfg.Analyzers, tt.analyzers)
+			}
+		})
+	}
+}
+
+func TestLoadNeo4jPassword(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	if err := ioutil.WriteFile(path, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		env      map[string]string
+		args     []string
+		password string
+	}{
+		{"env", map[string]string{"TOPOLOGY_NEO4J_PASSWORD": "from-env"}, nil, "from-env"},
+		{"file flag over env", map[string]string{"TOPOLOGY_NEO4J_PASSWORD": "from-env"}, []string{"-neo4j-password-file", path}, "from-file"},
+		{"file env", map[string]string{"TOPOLOGY_NEO4J_PASSWORD_FILE": path}, nil, "from-file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TOPOLOGY_CONFIG", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := Load(append([]string{"-store", StoreMemory}, tt.args...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Neo4j.Password != tt.password {
+				t.Errorf("password = %q, want %q", cfg.Neo4j.Password, tt.password)
+			}
+		})
+	}
+}
+
+func TestLoadBPFOverridesEnv(t *testing.T) {
+	t.Setenv("TOPOLOGY_CONFIG", "")
+	t.Setenv("TOPOLOGY_BPF_OVERRIDES", "postgres=src 172.18.0.5 and tcp; web=port 80")
+	cfg, err := Load([]string{"-store", StoreMemory, "-bpf-override", "web=port 8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"postgres": "src 172.18.0.5 and tcp", "web": "port 8080"}
+	if !reflect.DeepEqual(cfg.Capture.BPFOverrides, want) {
+		t.Errorf("bpf overrides = %q, want %q", cfg.Capture.BPFOverrides, want)
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"unknown backend", []string{"-store", "sqlite"}},
+		{"unknown analyzer", []string{"-analyzers", "docker,dns"}},
+		{"traffic without docker", []string{"-analyzers", "traffic"}},
+		{"snaplen too large", []string{"-snaplen", "300000"}},
+		{"cert without key", []string{"-cluster-tls-cert", "agent.pem"}},
+		{"listen without port", []string{"-listen", "localhost"}},
+		{"docker tls on a unix socket", []string{"-docker-host", "unix:///var/run/docker.sock", "-docker-tls-ca", "ca.pem"}},
+		{"password as a flag", []string{"-neo4j-password", "s3cr3t"}},
+		{"missing password file", []string{"-neo4j-password-file", "/nonexistent/password"}},
+		{"neo4j url without scheme", []string{"-store", StoreNeo4j, "-neo4j-url", "localhost:7687"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TOPOLOGY_CONFIG", "")
+			if _, err := Load(append([]string{"-store", StoreMemory}, tt.args...)); err == nil {
+				t.Error("Load succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/client"
+	"github.com/lucianolacurcia/sprint-5/veth"
+)
+
+// dockerRuntime is a Docker daemon, or anything speaking its API.
+type dockerRuntime struct {
+	cli      *client.Client
+	endpoint string
+	local    bool
+}
+
+func newDocker(e Endpoint) (*dockerRuntime, error) {
+	// the DOCKER_* environment describes the default daemon only, a daemon
+	// given by address brings its own TLS files
+	opts := []client.Opt{client.FromEnv}
+	if e.Host != "" {
+		opts = []client.Opt{client.WithAPIVersionNegotiation()}
+	}
+	if strings.HasPrefix(e.Host, "ssh://") {
+		dial, err := sshDialer(e.Host)
+		if err != nil {
+			return nil, err
+		}
+		// the host only names the daemon in requests, ssh does the dialing
+		opts = append(opts, client.WithHost("http://docker.example.com"), client.WithDialContext(dial))
+	} else if e.Host != "" {
+		opts = append(opts, client.WithHost(e.Host))
+	}
+	if e.tls() {
+		opts = append(opts, client.WithTLSClientConfig(e.TLSCA, e.TLSCert, e.TLSKey))
+	}
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, err
+	}
+	d := &dockerRuntime{cli: cli, endpoint: e.Host}
+	if d.endpoint == "" {
+		d.endpoint = cli.DaemonHost()
+	}
+	d.local = isLocal(d.endpoint)
+	return d, nil
+}
+
+func (d *dockerRuntime) Name() string {
+	return Docker
+}
+
+func (d *dockerRuntime) Endpoint() string {
+	return d.endpoint
+}
+
+func (d *dockerRuntime) Local() bool {
+	return d.local
+}
+
+func (d *dockerRuntime) ListContainers(ctx context.Context) ([]string, error) {
+	containers, err := d.cli.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(containers))
+	for _, container := range containers {
+		ids = append(ids, container.ID)
+	}
+	return ids, nil
+}
+
+func (d *dockerRuntime) InspectContainer(ctx context.Context, id string) (types.ContainerJSON, error) {
+	return d.cli.ContainerInspect(ctx, id)
+}
+
+func (d *dockerRuntime) ListNetworks(ctx context.Context) ([]string, error) {
+	networks, err := d.cli.NetworkList(ctx, types.NetworkListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(networks))
+	for _, network := range networks {
+		ids = append(ids, network.ID)
+	}
+	return ids, nil
+}
+
+func (d *dockerRuntime) InspectNetwork(ctx context.Context, id string) (types.NetworkResource, error) {
+	return d.cli.NetworkInspect(ctx, id, types.NetworkInspectOptions{Verbose: true})
+}
+
+func (d *dockerRuntime) Events(ctx context.Context, since time.Time) (<-chan events.Message, <-chan error) {
+	options := types.EventsOptions{}
+	if !since.IsZero() {
+		options.Since = eventsTimestamp(since)
+	}
+	return d.cli.Events(ctx, options)
+}
+
+func (d *dockerRuntime) Interfaces(container types.ContainerJSON) (map[string]veth.Interface, error) {
+	if !d.local {
+		return nil, ErrRemote
+	}
+	if err := checkRunning(container); err != nil {
+		return nil, err
+	}
+	ifaces, err := veth.Discover(container.State.Pid)
+	if err != nil {
+		return nil, err
+	}
+	return veth.ByNetwork(ifaces, macsByNetwork(container)), nil
+}
+
+func (d *dockerRuntime) Close() error {
+	return d.cli.Close()
+}
+
+func checkRunning(container types.ContainerJSON) error {
+	if container.ContainerJSONBase == nil || container.State == nil || !container.State.Running {
+		return errors.New("container is not running")
+	}
+	return nil
+}
+
+// macsByNetwork returns the MAC address of container on each network.
+func macsByNetwork(container types.ContainerJSON) map[string]string {
+	macs := make(map[string]string)
+	if container.NetworkSettings != nil {
+		for name, endpoint := range container.NetworkSettings.Networks {
+			if endpoint != nil {
+				macs[name] = endpoint.MacAddress
+			}
+		}
+	}
+	return macs
+}
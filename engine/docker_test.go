@@ -0,0 +1,26 @@
+package engine
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestNewDockerEnvironment(t *testing.T) {
+	t.Setenv("DOCKER_HOST", "tcp://from-env:2376")
+	t.Setenv("DOCKER_TLS_VERIFY", "1")
+	t.Setenv("DOCKER_CERT_PATH", filepath.Join(t.TempDir(), "missing"))
+
+	// the default daemon reads the environment, so its missing certificates
+	if _, err := newDocker(Endpoint{Runtime: Docker}); err == nil {
+		t.Error("default daemon ignored DOCKER_CERT_PATH")
+	}
+
+	d, err := newDocker(Endpoint{Runtime: Docker, Host: "tcp://build01:2375"})
+	if err != nil {
+		t.Fatalf("daemon with an address read the environment: %v", err)
+	}
+	defer d.Close()
+	if got := d.cli.DaemonHost(); got != "tcp://build01:2375" {
+		t.Errorf("daemon host = %q, want tcp://build01:2375", got)
+	}
+}
@@ -0,0 +1,123 @@
+// Package engine talks to the container engines the analyzer watches:
+// Docker, and Podman through the Docker compatible API of its socket. Both
+// hand out containers, networks and events as Docker API types.
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/client"
+	"github.com/lucianolacurcia/sprint-5/veth"
+)
+
+// Engine kinds accepted by New.
+const (
+	Docker = "docker"
+	Podman = "podman"
+)
+
+// ErrRemote is returned for the interfaces of containers of an engine on
+// another host, whose network namespaces are out of reach.
+var ErrRemote = errors.New("container runs on a remote engine")
+
+// Endpoint says how to reach an engine.
+type Endpoint struct {
+	// Runtime is the kind of engine, Docker or Podman.
+	Runtime string
+	// Host is the address of the engine: unix://, tcp:// or, for Docker,
+	// ssh://[user@]host[:port]. Empty selects the engine's default.
+	Host string
+	// TLSCA, TLSCert and TLSKey are the files used to verify a tcp:// engine
+	// and authenticate to it. The DOCKER_TLS_VERIFY and DOCKER_CERT_PATH
+	// environment applies only to a Docker engine without Host.
+	TLSCA   string
+	TLSCert string
+	TLSKey  string
+}
+
+func (e Endpoint) tls() bool {
+	return e.TLSCA != "" || e.TLSCert != "" || e.TLSKey != ""
+}
+
+// Runtime is a container engine. Implementations must be safe for
+// concurrent use.
+type Runtime interface {
+	// Name is the kind of engine, Docker or Podman.
+	Name() string
+	// Endpoint is the address the engine is reached at, which tags the
+	// containers and networks read from it.
+	Endpoint() string
+	// Local reports whether the engine runs on this host, where the network
+	// namespaces of its containers can be entered.
+	Local() bool
+	// ListContainers returns the IDs of the running containers.
+	ListContainers(ctx context.Context) ([]string, error)
+	InspectContainer(ctx context.Context, id string) (types.ContainerJSON, error)
+	// ListNetworks returns the IDs of the networks.
+	ListNetworks(ctx context.Context) ([]string, error)
+	// InspectNetwork returns network id, by ID or name, with the endpoints
+	// of its containers.
+	InspectNetwork(ctx context.Context, id string) (types.NetworkResource, error)
+	// Events streams the container and network events since the given time,
+	// or from now on if it is zero, with Docker's types and actions. The
+	// error channel receives why the stream ended; an engine that cannot be
+	// reached has its error waiting by the time Events returns.
+	Events(ctx context.Context, since time.Time) (<-chan events.Message, <-chan error)
+	// Interfaces returns the interfaces of a running container, keyed by
+	// network name. It fails with ErrRemote if the engine is not Local.
+	Interfaces(container types.ContainerJSON) (map[string]veth.Interface, error)
+	Close() error
+}
+
+// New connects to the engine at e. An empty host selects the engine's
+// default: the DOCKER_* environment for Docker, the socket of the current
+// user for Podman.
+func New(e Endpoint) (Runtime, error) {
+	switch e.Runtime {
+	case Docker:
+		return newDocker(e)
+	case Podman:
+		return newPodman(e)
+	}
+	return nil, fmt.Errorf("unknown container engine %q", e.Runtime)
+}
+
+// isLocal reports whether the engine at host runs on this host: behind a
+// socket, or on a loopback TCP address.
+func isLocal(host string) bool {
+	u, err := url.Parse(host)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "unix", "npipe":
+		return true
+	case "tcp":
+		if u.Hostname() == "localhost" {
+			return true
+		}
+		ip := net.ParseIP(u.Hostname())
+		return ip != nil && ip.IsLoopback()
+	}
+	return false
+}
+
+// IsNotFound reports whether err says that a container or network does not
+// exist.
+func IsNotFound(err error) bool {
+	return client.IsErrNotFound(err)
+}
+
+// eventsTimestamp formats t for the Since option, one nanosecond after t so
+// that the event seen last is not applied twice.
+func eventsTimestamp(t time.Time) string {
+	t = t.Add(time.Nanosecond)
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
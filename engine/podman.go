@@ -0,0 +1,161 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/client"
+	"github.com/lucianolacurcia/sprint-5/veth"
+)
+
+// Sockets of the Podman API service, started with
+// `systemctl [--user] start podman.socket`.
+const (
+	podmanRootSocket     = "unix:///run/podman/podman.sock"
+	podmanRootlessSocket = "podman/podman.sock" // under XDG_RUNTIME_DIR
+)
+
+// podmanRuntime is Podman reached through the Docker compatible endpoints
+// of its API socket. The listing and inspect calls answer as Docker would;
+// events and interfaces need translating.
+type podmanRuntime struct {
+	dockerRuntime
+	// rootless is set for the engine of an unprivileged user, whose
+	// container veths are not in the host namespace.
+	rootless bool
+}
+
+func newPodman(e Endpoint) (*podmanRuntime, error) {
+	host := e.Host
+	if strings.HasPrefix(host, "ssh://") {
+		return nil, errors.New("podman over ssh is not supported, expose its socket on tcp://")
+	}
+	rootless := os.Geteuid() != 0
+	if host == "" {
+		host = podmanRootSocket
+		if rootless {
+			dir := os.Getenv("XDG_RUNTIME_DIR")
+			if dir == "" {
+				dir = filepath.Join("/run/user", strconv.Itoa(os.Getuid()))
+			}
+			host = "unix://" + filepath.Join(dir, podmanRootlessSocket)
+		}
+	} else {
+		// the analyzer itself usually runs as root even when it watches
+		// the engine of a user
+		rootless = strings.HasPrefix(strings.TrimPrefix(host, "unix://"), "/run/user/")
+	}
+	opts := []client.Opt{client.WithHost(host), client.WithAPIVersionNegotiation()}
+	if e.tls() {
+		opts = append(opts, client.WithTLSClientConfig(e.TLSCA, e.TLSCert, e.TLSKey))
+	}
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &podmanRuntime{
+		dockerRuntime: dockerRuntime{cli: cli, endpoint: host, local: isLocal(host)},
+		rootless:      rootless,
+	}, nil
+}
+
+func (p *podmanRuntime) Name() string {
+	return Podman
+}
+
+// podmanStates maps the container states Podman reports to the ones Docker
+// reports for the same phase, the only ones the graph knows.
+var podmanStates = map[string]string{
+	"configured":  "created",
+	"initialized": "created",
+	"stopping":    "running",
+	"stopped":     "exited",
+}
+
+// InspectContainer reports the state of the container with Docker's name
+// for it.
+func (p *podmanRuntime) InspectContainer(ctx context.Context, id string) (types.ContainerJSON, error) {
+	container, err := p.dockerRuntime.InspectContainer(ctx, id)
+	if err == nil && container.ContainerJSONBase != nil && container.State != nil {
+		if state, ok := podmanStates[container.State.Status]; ok {
+			container.State.Status = state
+		}
+	}
+	return container, err
+}
+
+// Events translates Podman's events to the actions Docker sends for the
+// same changes.
+func (p *podmanRuntime) Events(ctx context.Context, since time.Time) (<-chan events.Message, <-chan error) {
+	in, errc := p.dockerRuntime.Events(ctx, since)
+	out := make(chan events.Message)
+	go func() {
+		for {
+			select {
+			case event := <-in:
+				select {
+				case out <- podmanEvent(event):
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, errc
+}
+
+// podmanEvent rewrites event the way Docker would have sent it. Podman says
+// remove where Docker says destroy, and died where Docker says die, and it
+// reports network connections with the container as the actor and the
+// network as an attribute.
+func podmanEvent(event events.Message) events.Message {
+	switch event.Action {
+	case "remove":
+		event.Action = "destroy"
+	case "died":
+		event.Action = "die"
+	}
+	if event.Type == events.NetworkEventType {
+		if network := event.Actor.Attributes["network"]; network != "" && event.Actor.ID != network {
+			attributes := make(map[string]string, len(event.Actor.Attributes)+1)
+			for k, v := range event.Actor.Attributes {
+				attributes[k] = v
+			}
+			attributes["container"] = event.Actor.ID
+			event.Actor = events.Actor{ID: network, Attributes: attributes}
+		}
+	}
+	return event
+}
+
+// Interfaces reads the interfaces of rootless containers inside their own
+// namespace. Networks without a matching MAC, such as slirp4netns or pasta
+// which Podman does not list, are keyed by interface name.
+func (p *podmanRuntime) Interfaces(container types.ContainerJSON) (map[string]veth.Interface, error) {
+	if !p.rootless || !p.local {
+		return p.dockerRuntime.Interfaces(container)
+	}
+	if err := checkRunning(container); err != nil {
+		return nil, err
+	}
+	ifaces, err := veth.DiscoverDetached(container.State.Pid)
+	if err != nil {
+		return nil, err
+	}
+	byNetwork := veth.ByNetwork(ifaces, macsByNetwork(container))
+	if len(byNetwork) == 0 {
+		for _, iface := range ifaces {
+			byNetwork[iface.Name] = iface
+		}
+	}
+	return byNetwork, nil
+}
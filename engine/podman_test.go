@@ -0,0 +1,57 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types/events"
+)
+
+func TestPodmanEvent(t *testing.T) {
+	tests := []struct {
+		name  string
+		event events.Message
+		want  events.Message
+	}{
+		{
+			name:  "died is die",
+			event: events.Message{Type: events.ContainerEventType, Action: "died", Actor: events.Actor{ID: "c1"}},
+			want:  events.Message{Type: events.ContainerEventType, Action: "die", Actor: events.Actor{ID: "c1"}},
+		},
+		{
+			name:  "remove is destroy",
+			event: events.Message{Type: events.ContainerEventType, Action: "remove", Actor: events.Actor{ID: "c1"}},
+			want:  events.Message{Type: events.ContainerEventType, Action: "destroy", Actor: events.Actor{ID: "c1"}},
+		},
+		{
+			name:  "docker actions are kept",
+			event: events.Message{Type: events.ContainerEventType, Action: "stop", Actor: events.Actor{ID: "c1"}},
+			want:  events.Message{Type: events.ContainerEventType, Action: "stop", Actor: events.Actor{ID: "c1"}},
+		},
+		{
+			name: "network connection has the network as actor",
+			event: events.Message{Type: events.NetworkEventType, Action: "connect", Actor: events.Actor{
+				ID: "c1", Attributes: map[string]string{"network": "n1"},
+			}},
+			want: events.Message{Type: events.NetworkEventType, Action: "connect", Actor: events.Actor{
+				ID: "n1", Attributes: map[string]string{"network": "n1", "container": "c1"},
+			}},
+		},
+		{
+			name: "network event of docker is kept",
+			event: events.Message{Type: events.NetworkEventType, Action: "connect", Actor: events.Actor{
+				ID: "n1", Attributes: map[string]string{"container": "c1"},
+			}},
+			want: events.Message{Type: events.NetworkEventType, Action: "connect", Actor: events.Actor{
+				ID: "n1", Attributes: map[string]string{"container": "c1"},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := podmanEvent(tt.event); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("event = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os/exec"
+	"time"
+)
+
+// sshDialer returns a dialer reaching the Docker daemon at an
+// ssh://[user@]host[:port] address, the way the docker CLI does: every
+// connection runs `docker system dial-stdio` on the remote host and talks
+// to the daemon over its standard input and output. Authentication is left
+// to the ssh client, its config and agent.
+func sshDialer(host string) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" || (u.Path != "" && u.Path != "/") {
+		return nil, fmt.Errorf("ssh host %q must be ssh://[user@]host[:port]", host)
+	}
+	args := []string{"-o", "BatchMode=yes"}
+	if u.User != nil {
+		args = append(args, "-l", u.User.Username())
+	}
+	if port := u.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	args = append(args, "--", u.Hostname(), "docker", "system", "dial-stdio")
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// not CommandContext: the connection outlives the dial
+		cmd := exec.Command("ssh", args...)
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("ssh to %s: %w", u.Hostname(), err)
+		}
+		return &cmdConn{cmd: cmd, stdin: stdin, stdout: stdout, host: u.Host}, nil
+	}, nil
+}
+
+// cmdConn is a connection over the standard input and output of a command.
+// Deadlines are not supported.
+type cmdConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	host   string
+}
+
+func (c *cmdConn) Read(p []byte) (int, error) {
+	return c.stdout.Read(p)
+}
+
+func (c *cmdConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+func (c *cmdConn) Close() error {
+	c.stdin.Close()
+	if c.cmd.Process != nil {
+		c.cmd.Process.Kill()
+	}
+	// the exit status of a killed command says nothing
+	c.cmd.Wait()
+	return nil
+}
+
+func (c *cmdConn) LocalAddr() net.Addr {
+	return sshAddr("localhost")
+}
+
+func (c *cmdConn) RemoteAddr() net.Addr {
+	return sshAddr(c.host)
+}
+
+func (c *cmdConn) SetDeadline(time.Time) error      { return nil }
+func (c *cmdConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *cmdConn) SetWriteDeadline(time.Time) error { return nil }
+
+type sshAddr string
+
+func (a sshAddr) Network() string { return "ssh" }
+func (a sshAddr) String() string  { return string(a) }
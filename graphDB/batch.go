@@ -0,0 +1,426 @@
+package graphDB
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// Batch is a set of writes merged by what they write to: the last state
+// written for a container wins, app layers are merged and metrics deltas
+// are added up. Applying a batch has the same effect as applying its
+// writes one by one, in order. Its write methods are those of
+// TopologyStore; nodes are built as this host writes them.
+type Batch struct {
+	containers   map[string]*containerWrite
+	noContainers map[string]bool
+	networks     map[string]*networkWrite
+	// attachments holds the full set of attachments of each container
+	// written, by container ID.
+	attachments  map[string][]Attachment
+	dependencies map[Edge]*dependencyWrite
+	metrics      map[Edge]Metrics
+}
+
+// containerWrite is what a batch writes to one Container node. A state set
+// is written before the node is marked removed.
+type containerWrite struct {
+	node  ContainerNode
+	label string
+	// set is true when node and label hold a state to write, upsert when
+	// the node is created if missing.
+	set     bool
+	upsert  bool
+	removed bool
+}
+
+// networkWrite is what a batch writes to one Network node. A node set is
+// written before it is removed.
+type networkWrite struct {
+	node    NetworkNode
+	set     bool
+	removed bool
+}
+
+// dependencyWrite is what a batch writes to one DEPENDE_DE relationship.
+type dependencyWrite struct {
+	// create is true when the relationship is created if missing; otherwise
+	// app is only set on an existing one.
+	create bool
+	app    AppLayer
+}
+
+func NewBatch() *Batch {
+	return &Batch{
+		containers:   make(map[string]*containerWrite),
+		noContainers: make(map[string]bool),
+		networks:     make(map[string]*networkWrite),
+		attachments:  make(map[string][]Attachment),
+		dependencies: make(map[Edge]*dependencyWrite),
+		metrics:      make(map[Edge]Metrics),
+	}
+}
+
+// Len returns the number of nodes and relationships the batch writes to.
+func (b *Batch) Len() int {
+	return len(b.containers) + len(b.noContainers) + len(b.networks) + len(b.attachments) +
+		len(b.dependencies) + len(b.metrics)
+}
+
+func (b *Batch) container(id string) *containerWrite {
+	w, ok := b.containers[id]
+	if !ok {
+		w = &containerWrite{}
+		b.containers[id] = w
+	}
+	return w
+}
+
+func (b *Batch) InsertContainer(container types.ContainerJSON, ip, daemon string) {
+	w := b.container(container.ID)
+	w.node = NewContainerNode(container, ip, daemon)
+	w.label = statusLabel(container)
+	w.set = true
+	w.upsert = true
+	w.removed = false
+}
+
+func (b *Batch) UpdateContainer(container types.ContainerJSON, ip, daemon string) {
+	w := b.container(container.ID)
+	w.node = NewContainerNode(container, ip, daemon)
+	w.label = statusLabel(container)
+	w.set = true
+	w.removed = false
+}
+
+func (b *Batch) MarkContainerRemoved(id string) {
+	b.container(id).removed = true
+}
+
+func (b *Batch) InsertNoContainerNode(ip string) {
+	b.noContainers[ip] = true
+}
+
+func (b *Batch) network(id string) *networkWrite {
+	w, ok := b.networks[id]
+	if !ok {
+		w = &networkWrite{}
+		b.networks[id] = w
+	}
+	return w
+}
+
+func (b *Batch) InsertNetwork(network types.NetworkResource, daemon string) {
+	w := b.network(network.ID)
+	w.node = NewNetworkNode(network, daemon)
+	w.set = true
+	w.removed = false
+}
+
+func (b *Batch) RemoveNetwork(id string) {
+	b.network(id).removed = true
+}
+
+func (b *Batch) SetAttachments(id string, attachments []Attachment) {
+	b.attachments[id] = append([]Attachment{}, attachments...)
+}
+
+func (b *Batch) AddDependency(edge Edge, app AppLayer) {
+	w, ok := b.dependencies[edge]
+	if !ok {
+		w = &dependencyWrite{}
+		b.dependencies[edge] = w
+	}
+	w.create = true
+	w.app = w.app.merge(app)
+}
+
+func (b *Batch) UpdateDependencyAppLayer(edge Edge, app AppLayer) {
+	w, ok := b.dependencies[edge]
+	if !ok {
+		w = &dependencyWrite{}
+		b.dependencies[edge] = w
+	}
+	w.app = w.app.merge(app)
+}
+
+func (b *Batch) AddDependencyMetrics(edge Edge, delta Metrics) {
+	if m, ok := b.metrics[edge]; ok {
+		delta = m.Add(delta)
+	}
+	b.metrics[edge] = delta
+}
+
+// Merge adds the writes of o after those of b.
+func (b *Batch) Merge(o *Batch) {
+	for id, src := range o.containers {
+		w := b.container(id)
+		if src.set {
+			w.node = src.node
+			w.label = src.label
+			w.set = true
+			w.upsert = w.upsert || src.upsert
+			w.removed = false
+		}
+		if src.removed {
+			w.removed = true
+		}
+	}
+	for ip := range o.noContainers {
+		b.noContainers[ip] = true
+	}
+	for id, src := range o.networks {
+		w := b.network(id)
+		if src.set {
+			w.node = src.node
+			w.set = true
+			w.removed = false
+		}
+		if src.removed {
+			w.removed = true
+		}
+	}
+	for id, attachments := range o.attachments {
+		b.attachments[id] = attachments
+	}
+	for edge, src := range o.dependencies {
+		if src.create {
+			b.AddDependency(edge, src.app)
+		} else {
+			b.UpdateDependencyAppLayer(edge, src.app)
+		}
+	}
+	for edge, delta := range o.metrics {
+		b.AddDependencyMetrics(edge, delta)
+	}
+}
+
+// Inventory returns the writes of b to Container and Network nodes and to
+// the attachments between them.
+func (b *Batch) Inventory() *Batch {
+	out := NewBatch()
+	for id, w := range b.containers {
+		copied := *w
+		out.containers[id] = &copied
+	}
+	for id, w := range b.networks {
+		copied := *w
+		out.networks[id] = &copied
+	}
+	for id, attachments := range b.attachments {
+		out.attachments[id] = attachments
+	}
+	return out
+}
+
+// newApplied returns the batch reporting what applying b changed, for the
+// store applying it to fill with keepState, keepRemoval, keepDependency and
+// keepMetrics. The writes to Network and NoContainer nodes and to
+// attachments are not reported on and are in it from the start.
+func newApplied(b *Batch) *Batch {
+	a := NewBatch()
+	for ip := range b.noContainers {
+		a.noContainers[ip] = true
+	}
+	for id, w := range b.networks {
+		copied := *w
+		a.networks[id] = &copied
+	}
+	for id, attachments := range b.attachments {
+		a.attachments[id] = attachments
+	}
+	return a
+}
+
+// keepState records in a that the state b writes to container id was
+// applied.
+func (a *Batch) keepState(b *Batch, id string) {
+	src := b.containers[id]
+	w := a.container(id)
+	w.node = src.node
+	w.label = src.label
+	w.set = true
+	w.upsert = src.upsert
+}
+
+// keepRemoval records in a that container id was marked removed.
+func (a *Batch) keepRemoval(id string) {
+	a.container(id).removed = true
+}
+
+// keepDependency records in a that the write of b to edge was applied.
+func (a *Batch) keepDependency(b *Batch, edge Edge) {
+	copied := *b.dependencies[edge]
+	a.dependencies[edge] = &copied
+}
+
+// keepMetrics records in a that the metrics b adds to edge were added.
+func (a *Batch) keepMetrics(b *Batch, edge Edge) {
+	a.metrics[edge] = b.metrics[edge]
+}
+
+// RewriteEdges replaces every edge written by b with the one rewrite
+// returns, merging the writes of edges that end up the same, and drops the
+// metrics of the edge when rewrite says they are counted elsewhere. A
+// rewritten edge whose app layer or metrics are written is created as
+// well, since only the original may exist.
+func (b *Batch) RewriteEdges(rewrite func(Edge) (Edge, bool)) {
+	dependencies, metrics := b.dependencies, b.metrics
+	b.dependencies = make(map[Edge]*dependencyWrite, len(dependencies))
+	b.metrics = make(map[Edge]Metrics, len(metrics))
+	for edge, w := range dependencies {
+		to, _ := rewrite(edge)
+		if w.create || to != edge {
+			b.AddDependency(to, w.app)
+		} else {
+			b.UpdateDependencyAppLayer(to, w.app)
+		}
+	}
+	for edge, delta := range metrics {
+		to, counted := rewrite(edge)
+		if to != edge {
+			b.AddDependency(to, AppLayer{})
+		}
+		if counted {
+			b.AddDependencyMetrics(to, delta)
+		}
+	}
+}
+
+// GraphBatch returns a batch writing the whole of g but the metrics, which
+// are kept as deltas.
+func GraphBatch(g Graph) *Batch {
+	b := NewBatch()
+	for _, node := range g.Containers {
+		w := b.container(node.ID)
+		w.node = node
+		w.label = node.Status
+		if w.label == "" {
+			w.label = "unknown"
+		}
+		w.set = true
+		w.upsert = true
+		w.removed = node.Status == StatusRemoved
+	}
+	for _, node := range g.Networks {
+		w := b.network(node.ID)
+		w.node = node
+		w.set = true
+	}
+	for _, node := range g.NoContainers {
+		b.noContainers[node.IP] = true
+	}
+	for _, a := range g.Attachments {
+		b.attachments[a.ContainerID] = append(b.attachments[a.ContainerID], a.Attachment)
+	}
+	for _, d := range g.Dependencies {
+		b.AddDependency(d.Edge, d.AppLayer)
+	}
+	return b
+}
+
+// batchJSON is how a Batch travels between hosts: the maps keyed by edge
+// become lists.
+type batchJSON struct {
+	Containers   []containerWriteJSON    `json:"containers,omitempty"`
+	NoContainers []string                `json:"noContainers,omitempty"`
+	Networks     []networkWriteJSON      `json:"networks,omitempty"`
+	Attachments  map[string][]Attachment `json:"attachments,omitempty"`
+	Dependencies []dependencyWriteJSON   `json:"dependencies,omitempty"`
+	Metrics      []metricsWriteJSON      `json:"metrics,omitempty"`
+}
+
+type containerWriteJSON struct {
+	ID      string        `json:"id"`
+	Node    ContainerNode `json:"node"`
+	Label   string        `json:"label,omitempty"`
+	Set     bool          `json:"set,omitempty"`
+	Upsert  bool          `json:"upsert,omitempty"`
+	Removed bool          `json:"removed,omitempty"`
+}
+
+type networkWriteJSON struct {
+	ID      string      `json:"id"`
+	Node    NetworkNode `json:"node"`
+	Set     bool        `json:"set,omitempty"`
+	Removed bool        `json:"removed,omitempty"`
+}
+
+type dependencyWriteJSON struct {
+	Edge   Edge     `json:"edge"`
+	Create bool     `json:"create,omitempty"`
+	App    AppLayer `json:"app"`
+}
+
+type metricsWriteJSON struct {
+	Edge  Edge    `json:"edge"`
+	Delta Metrics `json:"delta"`
+}
+
+func (b *Batch) MarshalJSON() ([]byte, error) {
+	out := batchJSON{Attachments: b.attachments}
+	for id, w := range b.containers {
+		out.Containers = append(out.Containers, containerWriteJSON{
+			ID: id, Node: w.node, Label: w.label, Set: w.set, Upsert: w.upsert, Removed: w.removed,
+		})
+	}
+	for ip := range b.noContainers {
+		out.NoContainers = append(out.NoContainers, ip)
+	}
+	for id, w := range b.networks {
+		out.Networks = append(out.Networks, networkWriteJSON{ID: id, Node: w.node, Set: w.set, Removed: w.removed})
+	}
+	for edge, w := range b.dependencies {
+		out.Dependencies = append(out.Dependencies, dependencyWriteJSON{Edge: edge, Create: w.create, App: w.app})
+	}
+	for edge, delta := range b.metrics {
+		out.Metrics = append(out.Metrics, metricsWriteJSON{Edge: edge, Delta: delta})
+	}
+	return json.Marshal(out)
+}
+
+func (b *Batch) UnmarshalJSON(data []byte) error {
+	var in batchJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	*b = *NewBatch()
+	for _, w := range in.Containers {
+		// the label ends up in Cypher as is
+		if w.Set && !isStatusLabel(w.Label) {
+			return fmt.Errorf("container %s: unknown status label %q", w.ID, w.Label)
+		}
+		b.containers[w.ID] = &containerWrite{node: w.Node, label: w.Label, set: w.Set, upsert: w.Upsert, removed: w.Removed}
+	}
+	for _, ip := range in.NoContainers {
+		b.noContainers[ip] = true
+	}
+	for _, w := range in.Networks {
+		b.networks[w.ID] = &networkWrite{node: w.Node, set: w.Set, removed: w.Removed}
+	}
+	for id, attachments := range in.Attachments {
+		b.attachments[id] = attachments
+	}
+	for _, w := range in.Dependencies {
+		b.dependencies[w.Edge] = &dependencyWrite{create: w.Create, app: w.App}
+	}
+	for _, w := range in.Metrics {
+		b.metrics[w.Edge] = w.Delta
+	}
+	return nil
+}
+
+// statusLabel returns the label for the state of container, unknown for a
+// state outside statusLabels, which the engines are expected to map.
+func statusLabel(container types.ContainerJSON) string {
+	if container.State == nil || !isStatusLabel(container.State.Status) {
+		return "unknown"
+	}
+	return container.State.Status
+}
+
+func isStatusLabel(label string) bool {
+	return label != "" && strings.Contains(statusLabels+":", ":"+label+":")
+}
@@ -0,0 +1,174 @@
+package graphDB
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+func testContainer(id, status string, labels map[string]string) types.ContainerJSON {
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    id,
+			Name:  "/" + id,
+			State: &types.ContainerState{Status: status},
+		},
+		Config: &container.Config{Labels: labels},
+	}
+}
+
+func compose(project, service string) map[string]string {
+	return map[string]string{ComposeProjectLabel: project, ComposeServiceLabel: service}
+}
+
+func TestBatchMerge(t *testing.T) {
+	edge := Edge{From: ContainerEndpoint("a"), To: ContainerEndpoint("b"), Port: 80, Protocol: "tcp"}
+	first := time.Date(2021, 9, 1, 10, 0, 0, 0, time.UTC)
+	last := first.Add(time.Minute)
+
+	tests := []struct {
+		name  string
+		into  func(b *Batch)
+		from  func(b *Batch)
+		check func(t *testing.T, b *Batch)
+	}{
+		{
+			name: "later state wins",
+			into: func(b *Batch) { b.InsertContainer(testContainer("a", "created", nil), "", "") },
+			from: func(b *Batch) { b.UpdateContainer(testContainer("a", "running", nil), "172.17.0.2", "") },
+			check: func(t *testing.T, b *Batch) {
+				w := b.containers["a"]
+				if w.node.Status != "running" || w.label != "running" || w.node.IP != "172.17.0.2" {
+					t.Errorf("container = %+v, want the running state", w)
+				}
+				if !w.upsert {
+					t.Error("upsert of the insert was lost")
+				}
+			},
+		},
+		{
+			name: "removal after a state",
+			into: func(b *Batch) { b.InsertContainer(testContainer("a", "running", nil), "", "") },
+			from: func(b *Batch) { b.MarkContainerRemoved("a") },
+			check: func(t *testing.T, b *Batch) {
+				if w := b.containers["a"]; !w.set || !w.removed {
+					t.Errorf("container = %+v, want set then removed", w)
+				}
+			},
+		},
+		{
+			name: "state after a removal",
+			into: func(b *Batch) { b.MarkContainerRemoved("a") },
+			from: func(b *Batch) { b.InsertContainer(testContainer("a", "running", nil), "", "") },
+			check: func(t *testing.T, b *Batch) {
+				if w := b.containers["a"]; !w.set || w.removed {
+					t.Errorf("container = %+v, want set and not removed", w)
+				}
+			},
+		},
+		{
+			name: "update keeps the create of a dependency",
+			into: func(b *Batch) { b.AddDependency(edge, AppLayer{Protocol: "http"}) },
+			from: func(b *Batch) { b.UpdateDependencyAppLayer(edge, AppLayer{Method: "GET"}) },
+			check: func(t *testing.T, b *Batch) {
+				w := b.dependencies[edge]
+				if !w.create || w.app != (AppLayer{Protocol: "http", Method: "GET"}) {
+					t.Errorf("dependency = %+v, want created with both app fields", w)
+				}
+			},
+		},
+		{
+			name: "metrics add up",
+			into: func(b *Batch) { b.AddDependencyMetrics(edge, Metrics{BytesOut: 10, FirstSeen: last, LastSeen: last}) },
+			from: func(b *Batch) { b.AddDependencyMetrics(edge, Metrics{BytesOut: 5, FirstSeen: first, LastSeen: first}) },
+			check: func(t *testing.T, b *Batch) {
+				want := Metrics{BytesOut: 15, FirstSeen: first, LastSeen: last}
+				if got := b.metrics[edge]; got != want {
+					t.Errorf("metrics = %+v, want %+v", got, want)
+				}
+			},
+		},
+		{
+			name: "attachments are replaced",
+			into: func(b *Batch) { b.SetAttachments("a", []Attachment{{NetworkID: "n1"}, {NetworkID: "n2"}}) },
+			from: func(b *Batch) { b.SetAttachments("a", []Attachment{{NetworkID: "n2"}}) },
+			check: func(t *testing.T, b *Batch) {
+				if got, want := b.attachments["a"], []Attachment{{NetworkID: "n2"}}; !reflect.DeepEqual(got, want) {
+					t.Errorf("attachments = %+v, want %+v", got, want)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, o := NewBatch(), NewBatch()
+			tt.into(b)
+			tt.from(o)
+			b.Merge(o)
+			tt.check(t, b)
+		})
+	}
+}
+
+func TestBatchJSON(t *testing.T) {
+	edge := Edge{From: ContainerEndpoint("a"), To: NoContainerEndpoint("10.0.0.53"), Port: 53, Protocol: "udp", Network: "n1"}
+	seen := time.Date(2021, 9, 1, 10, 0, 0, 0, time.UTC)
+
+	full := NewBatch()
+	full.InsertContainer(testContainer("a", "running", compose("shop", "web")), "172.17.0.2", "unix:///var/run/docker.sock")
+	full.UpdateContainer(testContainer("b", "exited", nil), "", "")
+	full.MarkContainerRemoved("b")
+	full.InsertNoContainerNode("10.0.0.53")
+	full.RemoveNetwork("n2")
+	full.SetAttachments("a", []Attachment{{NetworkID: "n1"}})
+	full.AddDependency(edge, AppLayer{Protocol: "dns"})
+	full.UpdateDependencyAppLayer(Edge{From: ContainerEndpoint("a"), To: ContainerEndpoint("b"), Port: 80, Protocol: "tcp"}, AppLayer{Status: 404})
+	full.AddDependencyMetrics(edge, Metrics{PacketsOut: 2, FirstSeen: seen, LastSeen: seen})
+
+	tests := []struct {
+		name  string
+		batch *Batch
+	}{
+		{"empty", NewBatch()},
+		{"every write", full},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.batch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := NewBatch()
+			if err := json.Unmarshal(data, got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.batch) {
+				t.Errorf("round trip = %+v, want %+v", got, tt.batch)
+			}
+		})
+	}
+}
+
+func TestBatchJSONRejectsLabels(t *testing.T) {
+	tests := []struct {
+		label string
+		ok    bool
+	}{
+		{"running", true},
+		{"unknown", true},
+		{"", false},
+		{"running:Admin", false},
+		{"x` SET c.owned = true //", false},
+	}
+	for _, tt := range tests {
+		data, _ := json.Marshal(batchJSON{Containers: []containerWriteJSON{{ID: "a", Label: tt.label, Set: true}}})
+		err := json.Unmarshal(data, NewBatch())
+		if (err == nil) != tt.ok {
+			t.Errorf("label %q: err = %v, want ok %v", tt.label, err, tt.ok)
+		}
+	}
+}
@@ -1,261 +1,1102 @@
-// Package graphDB provides handling for neo4j needed operations
 package graphDB
 
 import (
 	"fmt"
-	"os"
+	"sort"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/neo4j/neo4j-go-driver/v4/neo4j"
 )
 
-var (
-	driver neo4j.Driver
-)
+// Neo4jStore is a TopologyStore backed by a Neo4j server.
+type Neo4jStore struct {
+	appliedHook
+	driver   neo4j.Driver
+	database string
+}
 
-func InitDB(url string, user string, pass string) error {
-	var err error
-	driver, err = neo4j.NewDriver(url, neo4j.BasicAuth(user, pass, ""))
+// NewNeo4jStore connects to the Neo4j server at url. An empty db selects
+// the server's default database.
+func NewNeo4jStore(url, user, pass, db string) (*Neo4jStore, error) {
+	store, err := connectNeo4j(url, user, pass, db)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return nil
+	if err = store.ensureSchema(); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
 }
 
-func InsertContainer(container types.ContainerJSON, ip string) error {
-	hostname, err := os.Hostname()
+// WipeNeo4j deletes what docker-topology wrote to the Neo4j server at url,
+// as Wipe does, without creating the schema first: the duplicate nodes of
+// older versions keep the constraints from being created until then.
+func WipeNeo4j(url, user, pass, db string) error {
+	store, err := connectNeo4j(url, user, pass, db)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	session := driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
-	defer session.Close()
-	ports := ""
-	for portContainer, portHostMap := range container.NetworkSettings.Ports {
-		for _, portHost := range portHostMap {
-			ports = portContainer.Port() + "/" + portContainer.Proto() + " -> " + portHost.HostIP + ":" + portHost.HostPort + "\n"
-		}
+	defer store.Close()
+	return store.Wipe()
+}
+
+// ClaimLegacyNeo4j tags with the owner the nodes that versions older than
+// the owner property wrote to the Neo4j server at url, so that Wipe deletes
+// them too, and returns how many Container and NoContainer nodes it tagged.
+// Like WipeNeo4j it does not create the schema first.
+func ClaimLegacyNeo4j(url, user, pass, db string) (containers, noContainers int64, err error) {
+	store, err := connectNeo4j(url, user, pass, db)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer store.Close()
+	if containers, err = store.claimLegacy("Container", legacyContainer); err != nil {
+		return 0, 0, err
+	}
+	if noContainers, err = store.claimLegacy("NoContainer", legacyNoContainer); err != nil {
+		return containers, 0, err
+	}
+	return containers, noContainers, nil
+}
+
+func connectNeo4j(url, user, pass, db string) (*Neo4jStore, error) {
+	driver, err := neo4j.NewDriver(url, neo4j.BasicAuth(user, pass, ""))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to neo4j at %s: %w", url, err)
+	}
+	if err = driver.VerifyConnectivity(); err != nil {
+		driver.Close()
+		return nil, fmt.Errorf("connecting to neo4j at %s: %w", url, err)
 	}
-	_, err = session.WriteTransaction(func(transaction neo4j.Transaction) (interface{}, error) {
+	return &Neo4jStore{driver: driver, database: db}, nil
+}
+
+// schema holds the constraints and indexes the writes rely on. The
+// uniqueness constraints are what make MERGE safe under concurrent writers,
+// and come with an index on the property.
+var schema = []string{
+	"CREATE CONSTRAINT container_id IF NOT EXISTS ON (n:Container) ASSERT n.id IS UNIQUE",
+	"CREATE CONSTRAINT nocontainer_ip IF NOT EXISTS ON (n:NoContainer) ASSERT n.ip IS UNIQUE",
+	"CREATE CONSTRAINT network_id IF NOT EXISTS ON (n:Network) ASSERT n.id IS UNIQUE",
+	"CREATE CONSTRAINT project_name IF NOT EXISTS ON (n:Project) ASSERT n.name IS UNIQUE",
+	"CREATE CONSTRAINT service_key IF NOT EXISTS ON (n:Service) ASSERT n.key IS UNIQUE",
+	"CREATE INDEX container_hostname IF NOT EXISTS FOR (n:Container) ON (n.hostname)",
+}
+
+// legacyContainer and legacyNoContainer match the only nodes older
+// versions wrote, which carried no owner: a Container with nothing but its
+// name, id, ports, ip and hostname, and a NoContainer with nothing but its
+// ip. Nodes of the same labels written by anything else are left alone.
+const (
+	legacyContainer = "n.id IS NOT NULL AND n.hostname IS NOT NULL AND n.ports IS NOT NULL" +
+		" AND all(k IN keys(n) WHERE k IN ['name', 'id', 'ports', 'ip', 'hostname'])"
+	legacyNoContainer = "keys(n) = ['ip']"
+)
+
+// claimLegacy tags with the owner the nodes with label that have none and
+// match where, and returns how many it tagged.
+func (db *Neo4jStore) claimLegacy(label, where string) (int64, error) {
+	session := db.newWriteSession()
+	defer session.Close()
+	count, err := session.WriteTransaction(func(transaction neo4j.Transaction) (interface{}, error) {
 		result, err := transaction.Run(
-			"CREATE (a:Container :"+container.State.Status+" {name: $name, id: $id, ports: $ports, ip: $ip, hostname: $hostname})",
-			map[string]interface{}{"name": container.Name, "id": container.ID, "ports": ports, "pid": container.State.Pid, "ip": ip, "hostname": hostname})
+			"MATCH (n:"+label+") WHERE n.owner IS NULL AND "+where+
+				" SET n.owner = $owner RETURN count(n)",
+			map[string]interface{}{"owner": Owner})
 		if err != nil {
 			return nil, err
 		}
-
-		if result.Next() {
-			return result.Record().Values[0], nil
+		record, err := result.Single()
+		if err != nil {
+			return nil, err
 		}
-
-		return nil, result.Err()
+		return record.Values[0], nil
 	})
 	if err != nil {
-		return err
+		return 0, wrapErr("tag legacy "+label+" nodes", err)
 	}
-	return err
+	return count.(int64), nil
 }
 
-func DropDB() error {
-	session := driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+// ensureSchema creates whatever part of schema is missing.
+func (db *Neo4jStore) ensureSchema() error {
+	session := db.newWriteSession()
 	defer session.Close()
-	_, err := session.WriteTransaction(func(transaction neo4j.Transaction) (interface{}, error) {
-		result, err := transaction.Run("MATCH (n) DETACH DELETE (n)", map[string]interface{}{})
+	for _, statement := range schema {
+		// schema changes cannot share a transaction with anything else
+		result, err := session.Run(statement, map[string]interface{}{})
+		if err == nil {
+			_, err = result.Consume()
+		}
 		if err != nil {
-			return nil, err
+			return wrapErr("create schema", fmt.Errorf("%s: %w", statement, err))
 		}
+	}
+	return nil
+}
 
-		if result.Next() {
-			return result.Record().Values[0], nil
-		}
+func (db *Neo4jStore) Close() error {
+	return db.driver.Close()
+}
+
+func (db *Neo4jStore) newWriteSession() neo4j.Session {
+	return db.driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite, DatabaseName: db.database})
+}
+
+func (db *Neo4jStore) newReadSession() neo4j.Session {
+	return db.driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeRead, DatabaseName: db.database})
+}
+
+// statusLabels are the labels a Container node may carry for its status:
+// the states Docker reports, plus removed. Setting a status removes them
+// all first, in the same statement.
+const statusLabels = ":created:restarting:running:removing:paused:exited:dead:unknown:" + StatusRemoved
+
+// statement is a Cypher query with its parameters.
+type statement struct {
+	query  string
+	params map[string]interface{}
+	// applied, if set, records in the batch of what was applied each
+	// record the query returns, one per row it wrote.
+	applied func(a *Batch, record *neo4j.Record)
+}
+
+// WriteBatch applies every write of b in a single transaction, one UNWIND
+// statement per kind of write.
+func (db *Neo4jStore) WriteBatch(b *Batch) error {
+	return db.write("write batch", b)
+}
+
+// writeOne applies the single write that add puts in a batch.
+func (db *Neo4jStore) writeOne(op string, add func(b *Batch)) error {
+	b := NewBatch()
+	add(b)
+	return db.write(op, b)
+}
 
-		return nil, result.Err()
+// write applies b and reports what it applied.
+func (db *Neo4jStore) write(op string, b *Batch) error {
+	applied, err := db.apply(b)
+	if err != nil {
+		return wrapErr(op, err)
+	}
+	db.report(applied)
+	return nil
+}
+
+// apply executes the statements of b in order in one write transaction,
+// and returns what they applied.
+func (db *Neo4jStore) apply(b *Batch) (*Batch, error) {
+	statements := batchStatements(b)
+	if len(statements) == 0 {
+		return NewBatch(), nil
+	}
+	session := db.newWriteSession()
+	defer session.Close()
+	applied, err := session.WriteTransaction(func(transaction neo4j.Transaction) (interface{}, error) {
+		// a retried transaction starts over
+		applied := newApplied(b)
+		for _, s := range statements {
+			result, err := transaction.Run(s.query, s.params)
+			if err != nil {
+				return nil, err
+			}
+			if s.applied == nil {
+				_, err = result.Consume()
+			} else {
+				for result.Next() {
+					s.applied(applied, result.Record())
+				}
+				err = result.Err()
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return applied, nil
 	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return applied.(*Batch), nil
+}
+
+// InsertContainer creates the node of container, or brings it up to date if
+// it already exists.
+func (db *Neo4jStore) InsertContainer(container types.ContainerJSON, ip, daemon string) error {
+	return db.writeOne("insert container", func(b *Batch) { b.InsertContainer(container, ip, daemon) })
+}
+
+// UpdateContainer brings the node of container up to date. It does nothing
+// if the node does not exist.
+func (db *Neo4jStore) UpdateContainer(container types.ContainerJSON, ip, daemon string) error {
+	return db.writeOne("update container", func(b *Batch) { b.UpdateContainer(container, ip, daemon) })
+}
+
+func (db *Neo4jStore) MarkContainerRemoved(id string) error {
+	return db.writeOne("mark container removed", func(b *Batch) { b.MarkContainerRemoved(id) })
+}
+
+func (db *Neo4jStore) InsertNoContainerNode(ip string) error {
+	return db.writeOne("insert NoContainer", func(b *Batch) { b.InsertNoContainerNode(ip) })
+}
+
+func (db *Neo4jStore) InsertNetwork(network types.NetworkResource, daemon string) error {
+	return db.writeOne("insert network", func(b *Batch) { b.InsertNetwork(network, daemon) })
+}
+
+func (db *Neo4jStore) RemoveNetwork(id string) error {
+	return db.writeOne("remove network", func(b *Batch) { b.RemoveNetwork(id) })
+}
+
+func (db *Neo4jStore) SetAttachments(id string, attachments []Attachment) error {
+	return db.writeOne("set attachments", func(b *Batch) { b.SetAttachments(id, attachments) })
+}
+
+// AddDependency creates the relationship of edge unless it exists, and sets
+// app on it.
+func (db *Neo4jStore) AddDependency(edge Edge, app AppLayer) error {
+	return db.writeOne("add dependency", func(b *Batch) { b.AddDependency(edge, app) })
+}
+
+func (db *Neo4jStore) UpdateDependencyAppLayer(edge Edge, app AppLayer) error {
+	return db.writeOne("update dependency", func(b *Batch) { b.UpdateDependencyAppLayer(edge, app) })
+}
+
+func (db *Neo4jStore) AddDependencyMetrics(edge Edge, delta Metrics) error {
+	return db.writeOne("add dependency metrics", func(b *Batch) { b.AddDependencyMetrics(edge, delta) })
+}
+
+// ownedLabels are the labels of the nodes the analyzer writes, which Wipe
+// deletes.
+var ownedLabels = []string{"Container", "NoContainer", "Network", "Project", "Service"}
+
+// wipeBatch is how many nodes Wipe deletes per transaction, so that a large
+// graph does not have to fit in the memory of one.
+const wipeBatch = 1000
+
+func (db *Neo4jStore) Wipe() error {
+	for _, label := range ownedLabels {
+		if err := db.wipeLabel(label); err != nil {
+			return err
+		}
 	}
-	return err
+	return nil
 }
 
-func InsertNoContainerNode(ip string) error {
-	session := driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+// wipeLabel deletes the owned nodes with label, with their relationships,
+// wipeBatch at a time.
+func (db *Neo4jStore) wipeLabel(label string) error {
+	session := db.newWriteSession()
 	defer session.Close()
-	_, err := session.WriteTransaction(func(transaction neo4j.Transaction) (interface{}, error) {
-		result, err := transaction.Run(
-			"CREATE (a:NoContainer{ip: $ip})",
-			map[string]interface{}{"ip": ip})
+	for {
+		deleted, err := session.WriteTransaction(func(transaction neo4j.Transaction) (interface{}, error) {
+			result, err := transaction.Run(
+				"MATCH (n:"+label+" {owner: $owner}) WITH n LIMIT $limit DETACH DELETE n RETURN count(*)",
+				map[string]interface{}{"owner": Owner, "limit": wipeBatch})
+			if err != nil {
+				return nil, err
+			}
+			record, err := result.Single()
+			if err != nil {
+				return nil, err
+			}
+			return record.Values[0], nil
+		})
 		if err != nil {
-			return nil, err
+			return wrapErr("wipe "+label+" nodes", err)
+		}
+		if deleted.(int64) < wipeBatch {
+			return nil
 		}
+	}
+}
 
-		if result.Next() {
-			return result.Record().Values[0], nil
+// batchStatements returns the statements applying b: nodes first, then the
+// relationships between them, then what is set on existing relationships.
+func batchStatements(b *Batch) []statement {
+	var statements []statement
+
+	// labels cannot be parameters, so containers go by status label
+	upserts := make(map[string][]interface{})
+	updates := make(map[string][]interface{})
+	var removed, replicas []interface{}
+	for id, w := range b.containers {
+		if w.set {
+			row := map[string]interface{}{
+				"id":       id,
+				"name":     w.node.Name,
+				"ports":    w.node.Ports,
+				"ip":       w.node.IP,
+				"hostname": w.node.Hostname,
+				"daemon":   w.node.Daemon,
+				"project":  w.node.Project,
+				"service":  w.node.Service,
+			}
+			if w.node.Service != "" {
+				replicas = append(replicas, row)
+			}
+			if w.upsert {
+				upserts[w.label] = append(upserts[w.label], row)
+			} else {
+				updates[w.label] = append(updates[w.label], row)
+			}
 		}
+		if w.removed {
+			removed = append(removed, id)
+		}
+	}
+	for _, label := range sortedKeys(upserts) {
+		statements = append(statements, statement{
+			query: "UNWIND $rows AS row" +
+				" MERGE (n:Container {id: row.id})" +
+				" ON CREATE SET n.owner = $owner" +
+				" REMOVE n" + statusLabels +
+				" SET n:" + label +
+				" SET n.name = row.name, n.ports = row.ports, n.ip = row.ip, n.hostname = row.hostname," +
+				" n.daemon = row.daemon, n.project = row.project, n.service = row.service" +
+				removedAt(label) +
+				" RETURN row.id AS id",
+			params:  map[string]interface{}{"rows": upserts[label], "owner": Owner},
+			applied: stateApplied(b),
+		})
+	}
+	for _, label := range sortedKeys(updates) {
+		statements = append(statements, statement{
+			query: "UNWIND $rows AS row" +
+				" MATCH (n:Container {id: row.id})" +
+				" REMOVE n" + statusLabels +
+				" SET n:" + label +
+				" SET n.name = row.name, n.ports = row.ports, n.ip = row.ip," +
+				" n.daemon = row.daemon, n.project = row.project, n.service = row.service" +
+				removedAt(label) +
+				" RETURN row.id AS id",
+			params:  map[string]interface{}{"rows": updates[label]},
+			applied: stateApplied(b),
+		})
+	}
+	if len(replicas) > 0 {
+		statements = append(statements, statement{
+			query: "UNWIND $rows AS row" +
+				" MATCH (n:Container {id: row.id})" +
+				" MERGE (p:Project {name: row.project})" +
+				" ON CREATE SET p.owner = $owner" +
+				" MERGE (s:Service {key: row.project + '/' + row.service})" +
+				" ON CREATE SET s.owner = $owner, s.project = row.project, s.name = row.service" +
+				" MERGE (s)-[pr:PART_OF]->(p)" +
+				" ON CREATE SET pr.owner = $owner" +
+				" MERGE (n)-[rr:REPLICA_OF]->(s)" +
+				" ON CREATE SET rr.owner = $owner",
+			params: map[string]interface{}{"rows": replicas, "owner": Owner},
+		})
+	}
+	if len(removed) > 0 {
+		statements = append(statements, statement{
+			query: "UNWIND $ids AS id" +
+				" MATCH (n:Container {id: id})" +
+				" WHERE NOT n:" + StatusRemoved +
+				" REMOVE n" + statusLabels +
+				" SET n:" + StatusRemoved +
+				" SET n.removedAt = datetime()" +
+				" RETURN id",
+			params: map[string]interface{}{"ids": removed},
+			applied: func(a *Batch, record *neo4j.Record) {
+				id, _ := valueOf(record, "id").(string)
+				a.keepRemoval(id)
+			},
+		})
+	}
 
-		return nil, result.Err()
-	})
-	if err != nil {
-		return err
+	var networks, removedNetworks []interface{}
+	for id, w := range b.networks {
+		if w.set {
+			networks = append(networks, map[string]interface{}{
+				"id":       id,
+				"name":     w.node.Name,
+				"driver":   w.node.Driver,
+				"scope":    w.node.Scope,
+				"internal": w.node.Internal,
+				"subnets":  w.node.Subnets,
+				"gateways": w.node.Gateways,
+				"hostname": w.node.Hostname,
+				"daemon":   w.node.Daemon,
+			})
+		}
+		if w.removed {
+			removedNetworks = append(removedNetworks, id)
+		}
+	}
+	if len(networks) > 0 {
+		statements = append(statements, statement{
+			query: "UNWIND $rows AS row" +
+				" MERGE (n:Network {id: row.id})" +
+				" ON CREATE SET n.owner = $owner" +
+				" SET n.name = row.name, n.driver = row.driver, n.scope = row.scope, n.internal = row.internal," +
+				" n.subnets = row.subnets, n.gateways = row.gateways, n.hostname = row.hostname, n.daemon = row.daemon",
+			params: map[string]interface{}{"rows": networks, "owner": Owner},
+		})
+	}
+	if len(removedNetworks) > 0 {
+		statements = append(statements, statement{
+			query:  "UNWIND $ids AS id MATCH (n:Network {id: id}) DETACH DELETE n",
+			params: map[string]interface{}{"ids": removedNetworks},
+		})
+	}
+
+	if len(b.noContainers) > 0 {
+		ips := make([]interface{}, 0, len(b.noContainers))
+		for ip := range b.noContainers {
+			ips = append(ips, ip)
+		}
+		statements = append(statements, statement{
+			query:  "UNWIND $ips AS ip MERGE (a:NoContainer {ip: ip}) ON CREATE SET a.owner = $owner",
+			params: map[string]interface{}{"ips": ips, "owner": Owner},
+		})
+	}
+
+	if len(b.attachments) > 0 {
+		var sets, rows []interface{}
+		for id, attachments := range b.attachments {
+			networkIDs := make([]string, 0, len(attachments))
+			for _, a := range attachments {
+				networkIDs = append(networkIDs, a.NetworkID)
+				rows = append(rows, map[string]interface{}{
+					"container": id,
+					"network":   a.NetworkID,
+					"ip":        a.IP,
+					"ipv6":      a.IPv6,
+					"aliases":   a.Aliases,
+				})
+			}
+			sets = append(sets, map[string]interface{}{"container": id, "networks": networkIDs})
+		}
+		statements = append(statements, statement{
+			query: "UNWIND $sets AS set" +
+				" MATCH (:Container {id: set.container})-[r:ATTACHED_TO]->(n:Network)" +
+				" WHERE NOT n.id IN set.networks" +
+				" DELETE r",
+			params: map[string]interface{}{"sets": sets},
+		})
+		if len(rows) > 0 {
+			statements = append(statements, statement{
+				query: "UNWIND $rows AS row" +
+					" MATCH (c:Container {id: row.container}), (n:Network {id: row.network})" +
+					" MERGE (c)-[r:ATTACHED_TO]->(n)" +
+					" ON CREATE SET r.owner = $owner" +
+					" SET r.ip = row.ip, r.ipv6 = row.ipv6, r.aliases = row.aliases",
+				params: map[string]interface{}{"rows": rows, "owner": Owner},
+			})
+		}
+	}
+
+	// the pattern matching an endpoint depends on its kind, so edges go by
+	// the kinds of their ends
+	creates := make(edgeGroups)
+	appUpdates := make(edgeGroups)
+	for edge, w := range b.dependencies {
+		row := edgeRow(edge, map[string]interface{}{"props": w.app.properties()})
+		if w.create {
+			creates.add(edge, row)
+		} else if len(w.app.properties()) > 0 {
+			appUpdates.add(edge, row)
+		}
+	}
+	metrics := make(edgeGroups)
+	for edge, delta := range b.metrics {
+		metrics.add(edge, edgeRow(edge, map[string]interface{}{
+			"bytesOut":    delta.BytesOut,
+			"bytesIn":     delta.BytesIn,
+			"packetsOut":  delta.PacketsOut,
+			"packetsIn":   delta.PacketsIn,
+			"connections": delta.Connections,
+			"firstSeen":   delta.FirstSeen,
+			"lastSeen":    delta.LastSeen,
+		}))
+	}
+
+	for _, kind := range edgeKinds {
+		if g, ok := creates[kind]; ok {
+			statements = append(statements, statement{
+				query: "UNWIND $rows AS row" +
+					" MATCH " + g.from.match("a", "row.from") + ", " + g.to.match("b", "row.to") +
+					" MERGE (a)-[r:DEPENDE_DE {serverPort: row.port, protocol: row.protocol, network: row.network}]->(b)" +
+					" ON CREATE SET r.owner = $owner" +
+					" SET r += row.props" +
+					" RETURN row.i AS i",
+				params:  map[string]interface{}{"rows": g.rows, "owner": Owner},
+				applied: g.applied(b, (*Batch).keepDependency),
+			})
+		}
+	}
+	// the service view follows the new container edges
+	for _, kind := range edgeKinds {
+		if g, ok := creates[kind]; ok && (kind.from || kind.to) {
+			statements = append(statements, statement{
+				query: "UNWIND $rows AS row" +
+					" MATCH " + g.from.matchService("a", "row.from") + ", " + g.to.matchService("b", "row.to") +
+					" WHERE a <> b" +
+					" MERGE (a)-[r:DEPENDS_ON {serverPort: row.port, protocol: row.protocol}]->(b)" +
+					" ON CREATE SET r.owner = $owner",
+				params: map[string]interface{}{"rows": g.rows, "owner": Owner},
+			})
+		}
+	}
+	for _, kind := range edgeKinds {
+		if g, ok := appUpdates[kind]; ok {
+			statements = append(statements, statement{
+				query:   "UNWIND $rows AS row " + g.matchEdge() + "SET r += row.props RETURN row.i AS i",
+				params:  map[string]interface{}{"rows": g.rows},
+				applied: g.applied(b, (*Batch).keepDependency),
+			})
+		}
+	}
+	for _, kind := range edgeKinds {
+		if g, ok := metrics[kind]; ok {
+			statements = append(statements, statement{
+				query: "UNWIND $rows AS row " + g.matchEdge() +
+					"SET r.bytesOut = coalesce(r.bytesOut, 0) + row.bytesOut, " +
+					"r.bytesIn = coalesce(r.bytesIn, 0) + row.bytesIn, " +
+					"r.packetsOut = coalesce(r.packetsOut, 0) + row.packetsOut, " +
+					"r.packetsIn = coalesce(r.packetsIn, 0) + row.packetsIn, " +
+					"r.connections = coalesce(r.connections, 0) + row.connections, " +
+					"r.firstSeen = CASE WHEN r.firstSeen IS NULL OR row.firstSeen < r.firstSeen THEN row.firstSeen ELSE r.firstSeen END, " +
+					"r.lastSeen = CASE WHEN r.lastSeen IS NULL OR row.lastSeen > r.lastSeen THEN row.lastSeen ELSE r.lastSeen END " +
+					"RETURN row.i AS i",
+				params:  map[string]interface{}{"rows": g.rows},
+				applied: g.applied(b, (*Batch).keepMetrics),
+			})
+		}
+	}
+	return statements
+}
+
+// stateApplied records the container states written by the rows a
+// statement returns the id of.
+func stateApplied(b *Batch) func(a *Batch, record *neo4j.Record) {
+	return func(a *Batch, record *neo4j.Record) {
+		id, _ := valueOf(record, "id").(string)
+		a.keepState(b, id)
 	}
-	return err
 }
 
-func DeleteContainer(id string) error {
-	session := driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+// removedAt returns the clause keeping the removedAt property of nodes
+// given the status label: set once removed, dropped otherwise.
+func removedAt(label string) string {
+	if label == StatusRemoved {
+		return " SET n.removedAt = coalesce(n.removedAt, datetime())"
+	}
+	return " REMOVE n.removedAt"
+}
+
+func sortedKeys(m map[string][]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func parseInterfaceToString(i interface{}) (s []string, err error) {
+	converted, ok := i.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Argument is not a slice")
+	}
+	for _, v := range converted {
+		s = append(s, v.(string))
+	}
+	return
+}
+
+// match returns a MATCH pattern binding node to the endpoint, whose key is
+// given by the expression key.
+func (e Endpoint) match(node, key string) string {
+	if e.IsContainer() {
+		return "(" + node + ":Container {id: " + key + "})"
+	}
+	return "(" + node + ":NoContainer {ip: " + key + "})"
+}
+
+// matchService returns a MATCH pattern binding node to the end of the
+// service view standing for the endpoint: the Service its container is a
+// replica of, or its NoContainer node.
+func (e Endpoint) matchService(node, key string) string {
+	if e.IsContainer() {
+		return "(:Container {id: " + key + "})-[:REPLICA_OF]->(" + node + ":Service)"
+	}
+	return "(" + node + ":NoContainer {ip: " + key + "})"
+}
+
+// edgeKind tells whether the client and the server of an edge are
+// containers.
+type edgeKind struct {
+	from, to bool
+}
+
+// edgeKinds lists every edgeKind, in the order statements are written.
+var edgeKinds = []edgeKind{{true, true}, {true, false}, {false, true}, {false, false}}
+
+// edgeGroup holds the rows of edges of the same kind, along with the ends of
+// one of them. Row i is the one of edges[i].
+type edgeGroup struct {
+	from, to Endpoint
+	rows     []interface{}
+	edges    []Edge
+}
+
+type edgeGroups map[edgeKind]*edgeGroup
+
+func (groups edgeGroups) add(edge Edge, row map[string]interface{}) {
+	kind := edgeKind{edge.From.IsContainer(), edge.To.IsContainer()}
+	g, ok := groups[kind]
+	if !ok {
+		g = &edgeGroup{from: edge.From, to: edge.To}
+		groups[kind] = g
+	}
+	row["i"] = len(g.rows)
+	g.rows = append(g.rows, row)
+	g.edges = append(g.edges, edge)
+}
+
+// applied returns the function recording with keep the edges of the rows
+// a statement returns the index i of.
+func (g *edgeGroup) applied(b *Batch, keep func(a *Batch, b *Batch, edge Edge)) func(a *Batch, record *neo4j.Record) {
+	return func(a *Batch, record *neo4j.Record) {
+		if i := int64Of(record, "i"); i >= 0 && i < int64(len(g.edges)) {
+			keep(a, b, g.edges[i])
+		}
+	}
+}
+
+// matchEdge returns a MATCH clause binding r to the relationship of the
+// current row, as built by edgeRow.
+func (g *edgeGroup) matchEdge() string {
+	return "MATCH " + g.from.match("a", "row.from") +
+		"-[r:DEPENDE_DE {serverPort: row.port, protocol: row.protocol, network: row.network}]->" +
+		g.to.match("b", "row.to") + " "
+}
+
+// edgeRow returns the UNWIND row identifying edge, plus extra.
+func edgeRow(edge Edge, extra map[string]interface{}) map[string]interface{} {
+	row := map[string]interface{}{
+		"from":     edge.From.String(),
+		"to":       edge.To.String(),
+		"port":     edge.Port,
+		"protocol": edge.Protocol,
+		"network":  edge.Network,
+	}
+	for k, v := range extra {
+		row[k] = v
+	}
+	return row
+}
+
+func (db *Neo4jStore) Containers() ([]ContainerNode, error) {
+	return db.HostContainers(localHostname())
+}
+
+func (db *Neo4jStore) HostContainers(hostname string) ([]ContainerNode, error) {
+	session := db.newReadSession()
 	defer session.Close()
-	_, err := session.WriteTransaction(func(transaction neo4j.Transaction) (interface{}, error) {
+	nodes, err := session.ReadTransaction(func(transaction neo4j.Transaction) (interface{}, error) {
 		result, err := transaction.Run(
-			"MATCH (n {id: $id}) DETACH DELETE n",
-			map[string]interface{}{"id": id})
+			"MATCH (n:Container {hostname: $hostname}) RETURN "+containerColumns,
+			map[string]interface{}{"hostname": hostname})
 		if err != nil {
 			return nil, err
 		}
 
-		if result.Next() {
-			return result.Record().Values[0], nil
+		var nodes []ContainerNode
+		for result.Next() {
+			node, err := containerNodeOf(result.Record())
+			if err != nil {
+				return nil, err
+			}
+			node.Hostname = hostname
+			nodes = append(nodes, node)
 		}
-
-		return nil, result.Err()
+		return nodes, result.Err()
 	})
 	if err != nil {
-		return err
+		return nil, wrapErr("list containers", err)
+	}
+	return nodes.([]ContainerNode), nil
+}
+
+// containerColumns returns the columns containerNodeOf reads, for the
+// Container node n.
+const containerColumns = "n.id AS id, n.name AS name, n.ports AS ports, n.ip AS ip, n.hostname AS hostname, " +
+	"n.daemon AS daemon, n.project AS project, n.service AS service, labels(n) AS labels"
+
+func containerNodeOf(record *neo4j.Record) (ContainerNode, error) {
+	var node ContainerNode
+	node.ID, _ = valueOf(record, "id").(string)
+	node.Name, _ = valueOf(record, "name").(string)
+	node.Ports, _ = valueOf(record, "ports").(string)
+	node.IP, _ = valueOf(record, "ip").(string)
+	node.Hostname, _ = valueOf(record, "hostname").(string)
+	node.Daemon, _ = valueOf(record, "daemon").(string)
+	node.Project, _ = valueOf(record, "project").(string)
+	node.Service, _ = valueOf(record, "service").(string)
+	if labs := valueOf(record, "labels"); labs != nil {
+		labels, err := parseInterfaceToString(labs)
+		if err != nil {
+			return node, err
+		}
+		// the status is kept as a second label
+		for _, label := range labels {
+			if label != "Container" {
+				node.Status = label
+			}
+		}
 	}
-	return err
+	return node, nil
+}
+
+func valueOf(record *neo4j.Record, key string) interface{} {
+	v, _ := record.Get(key)
+	return v
+}
+
+func (db *Neo4jStore) Networks() ([]NetworkNode, error) {
+	return db.HostNetworks(localHostname())
 }
 
-func UpdateContainer(container types.ContainerJSON, ip string) error {
-	session := driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+func (db *Neo4jStore) HostNetworks(hostname string) ([]NetworkNode, error) {
+	session := db.newReadSession()
 	defer session.Close()
-	// get labels of node for deleting
-	labels, err := session.WriteTransaction(func(transaction neo4j.Transaction) (interface{}, error) {
+	nodes, err := session.ReadTransaction(func(transaction neo4j.Transaction) (interface{}, error) {
 		result, err := transaction.Run(
-			"MATCH (n {id: $id}) return labels(n) as labels",
-			map[string]interface{}{"id": container.ID})
+			"MATCH (n:Network {hostname: $hostname}) RETURN "+networkColumns,
+			map[string]interface{}{"hostname": hostname})
 		if err != nil {
 			return nil, err
 		}
 
-		var labels []string
+		var nodes []NetworkNode
 		for result.Next() {
-			record := result.Record()
-
-			labs, ok := record.Get("labels")
-			if !ok {
-				return nil, fmt.Errorf("Couldn't get labels")
-			}
-
-			var l []string
-			if labs != nil {
-				l, err = parseInterfaceToString(labs)
-				if err != nil {
-					return nil, err
-				}
+			node, err := networkNodeOf(result.Record())
+			if err != nil {
+				return nil, err
 			}
-
-			labels = l
+			node.Hostname = hostname
+			nodes = append(nodes, node)
 		}
-		return labels, result.Err()
+		return nodes, result.Err()
 	})
 	if err != nil {
-		return err
+		return nil, wrapErr("list networks", err)
 	}
+	return nodes.([]NetworkNode), nil
+}
 
-	assertedLabels, ok := labels.([]string)
-	if !ok {
-		return nil
-	}
+// networkColumns returns the columns networkNodeOf reads, for the Network
+// node n.
+const networkColumns = "n.id AS id, n.name AS name, n.driver AS driver, n.scope AS scope, " +
+	"n.internal AS internal, n.subnets AS subnets, n.gateways AS gateways, n.hostname AS hostname, n.daemon AS daemon"
 
-	// ports to string
-	ports := ""
-	for portContainer, portHostMap := range container.NetworkSettings.Ports {
-		for _, portHost := range portHostMap {
-			ports = portContainer.Port() + "/" + portContainer.Proto() + " -> " + portHost.HostIP + ":" + portHost.HostPort + "\n"
+func networkNodeOf(record *neo4j.Record) (NetworkNode, error) {
+	var err error
+	node := NetworkNode{Subnets: []string{}, Gateways: []string{}}
+	node.ID, _ = valueOf(record, "id").(string)
+	node.Name, _ = valueOf(record, "name").(string)
+	node.Driver, _ = valueOf(record, "driver").(string)
+	node.Scope, _ = valueOf(record, "scope").(string)
+	node.Internal, _ = valueOf(record, "internal").(bool)
+	node.Hostname, _ = valueOf(record, "hostname").(string)
+	node.Daemon, _ = valueOf(record, "daemon").(string)
+	if v := valueOf(record, "subnets"); v != nil {
+		if node.Subnets, err = parseInterfaceToString(v); err != nil {
+			return node, err
 		}
 	}
+	if v := valueOf(record, "gateways"); v != nil {
+		if node.Gateways, err = parseInterfaceToString(v); err != nil {
+			return node, err
+		}
+	}
+	return node, nil
+}
 
-	//labels string
-	labelsToRemove := ""
-	for _, label := range assertedLabels {
-		labelsToRemove += ":" + label
+func (db *Neo4jStore) NoContainers() ([]NoContainerNode, error) {
+	session := db.newReadSession()
+	defer session.Close()
+	nodes, err := session.ReadTransaction(func(transaction neo4j.Transaction) (interface{}, error) {
+		result, err := transaction.Run("MATCH (n:NoContainer) RETURN n.ip AS ip", map[string]interface{}{})
+		if err != nil {
+			return nil, err
+		}
+
+		var nodes []NoContainerNode
+		for result.Next() {
+			var node NoContainerNode
+			node.IP, _ = valueOf(result.Record(), "ip").(string)
+			nodes = append(nodes, node)
+		}
+		return nodes, result.Err()
+	})
+	if err != nil {
+		return nil, wrapErr("list NoContainers", err)
 	}
+	return nodes.([]NoContainerNode), nil
+}
 
-	_, err = session.WriteTransaction(func(transaction neo4j.Transaction) (interface{}, error) {
+func (db *Neo4jStore) Dependencies() ([]Edge, error) {
+	session := db.newReadSession()
+	defer session.Close()
+	edges, err := session.ReadTransaction(func(transaction neo4j.Transaction) (interface{}, error) {
 		result, err := transaction.Run(
-			"MATCH (n:Container {id: $id}) "+
-				" REMOVE n"+labelsToRemove+
-				" SET n:Container:"+container.State.Status+
-				" SET n.name = $name"+
-				" SET n.ports = $ports"+
-				" SET n.id = $id"+
-				" SET n.ip = $ip",
-			map[string]interface{}{"name": container.Name, "id": container.ID, "ports": ports, "ip": ip})
+			"MATCH (a)-[r:DEPENDE_DE]->(b) "+
+				"RETURN a.id AS fromID, a.ip AS fromIP, 'Container' IN labels(a) AS fromContainer, "+
+				"b.id AS toID, b.ip AS toIP, 'Container' IN labels(b) AS toContainer, "+
+				"r.serverPort AS port, r.protocol AS protocol, r.network AS network",
+			map[string]interface{}{})
 		if err != nil {
 			return nil, err
 		}
 
-		if result.Next() {
-			return result.Record().Values[0], nil
+		var edges []Edge
+		for result.Next() {
+			record := result.Record()
+			edge := Edge{
+				From: endpointOf(record, "from"),
+				To:   endpointOf(record, "to"),
+			}
+			port, _ := valueOf(record, "port").(int64)
+			edge.Port = int(port)
+			edge.Protocol, _ = valueOf(record, "protocol").(string)
+			edge.Network, _ = valueOf(record, "network").(string)
+			edges = append(edges, edge)
+		}
+		return edges, result.Err()
+	})
+	if err != nil {
+		return nil, wrapErr("list dependencies", err)
+	}
+	return edges.([]Edge), nil
+}
+
+func (db *Neo4jStore) ServiceDependencies() ([]ServiceEdge, error) {
+	session := db.newReadSession()
+	defer session.Close()
+	edges, err := session.ReadTransaction(func(transaction neo4j.Transaction) (interface{}, error) {
+		result, err := transaction.Run(
+			"MATCH (a)-[r:DEPENDS_ON]->(b) "+
+				"RETURN a.project AS fromProject, a.name AS fromService, a.ip AS fromIP, 'Service' IN labels(a) AS fromIsService, "+
+				"b.project AS toProject, b.name AS toService, b.ip AS toIP, 'Service' IN labels(b) AS toIsService, "+
+				"r.serverPort AS port, r.protocol AS protocol",
+			map[string]interface{}{})
+		if err != nil {
+			return nil, err
 		}
 
-		return nil, result.Err()
+		var edges []ServiceEdge
+		for result.Next() {
+			record := result.Record()
+			edge := ServiceEdge{
+				From: serviceEndpointOf(record, "from"),
+				To:   serviceEndpointOf(record, "to"),
+			}
+			port, _ := valueOf(record, "port").(int64)
+			edge.Port = int(port)
+			edge.Protocol, _ = valueOf(record, "protocol").(string)
+			edges = append(edges, edge)
+		}
+		return edges, result.Err()
 	})
 	if err != nil {
-		return err
+		return nil, wrapErr("list service dependencies", err)
 	}
+	return edges.([]ServiceEdge), nil
+}
 
-	return err
+// Graph reads the whole graph in one transaction. The service view is
+// derived from the dependencies read, as MemoryStore does.
+func (db *Neo4jStore) Graph() (Graph, error) {
+	return db.readGraph("read graph", true)
 }
 
-func parseInterfaceToString(i interface{}) (s []string, err error) {
-	converted, ok := i.([]interface{})
-	if !ok {
-		return nil, fmt.Errorf("Argument is not a slice")
-	}
-	for _, v := range converted {
-		s = append(s, v.(string))
-	}
-	return
+// Nodes reads the graph but its dependencies in one transaction.
+func (db *Neo4jStore) Nodes() (Graph, error) {
+	return db.readGraph("read nodes", false)
 }
 
-func AddDependency(contOri, contDest types.ContainerJSON, appLayerHeader string) error {
-	fmt.Printf("Añadiendo flecha: %s -> %s\n", contOri.Name, contDest.Name)
-	session := driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+func (db *Neo4jStore) readGraph(op string, withDependencies bool) (Graph, error) {
+	session := db.newReadSession()
 	defer session.Close()
-	_, err := session.WriteTransaction(func(transaction neo4j.Transaction) (interface{}, error) {
-		result, err := transaction.Run("MATCH (a:Container), (b:Container) WHERE a.id = $idA AND b.id = $idB CREATE (a)-[r:DEPENDE_DE {AppLayerContent: $appLayerHeader}]->(b) RETURN type(r), r.name", map[string]interface{}{"idA": contOri.ID, "idB": contDest.ID, "appLayerHeader": appLayerHeader})
+	g, err := session.ReadTransaction(func(transaction neo4j.Transaction) (interface{}, error) {
+		g := Graph{
+			Containers:   []ContainerNode{},
+			Networks:     []NetworkNode{},
+			NoContainers: []NoContainerNode{},
+			Attachments:  []ContainerAttachment{},
+			Dependencies: []Dependency{},
+		}
+		read := func(query string, row func(record *neo4j.Record) error) error {
+			result, err := transaction.Run(query, map[string]interface{}{})
+			if err != nil {
+				return err
+			}
+			for result.Next() {
+				if err := row(result.Record()); err != nil {
+					return err
+				}
+			}
+			return result.Err()
+		}
+
+		err := read("MATCH (n:Container) RETURN "+containerColumns, func(record *neo4j.Record) error {
+			node, err := containerNodeOf(record)
+			g.Containers = append(g.Containers, node)
+			return err
+		})
 		if err != nil {
 			return nil, err
 		}
-
-		if result.Next() {
-			return result.Record().Values[0], nil
+		err = read("MATCH (n:Network) RETURN "+networkColumns, func(record *neo4j.Record) error {
+			node, err := networkNodeOf(record)
+			g.Networks = append(g.Networks, node)
+			return err
+		})
+		if err != nil {
+			return nil, err
 		}
-
-		return nil, result.Err()
+		err = read("MATCH (n:NoContainer) RETURN n.ip AS ip", func(record *neo4j.Record) error {
+			ip, _ := valueOf(record, "ip").(string)
+			g.NoContainers = append(g.NoContainers, NoContainerNode{IP: ip})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = read("MATCH (c:Container)-[r:ATTACHED_TO]->(n:Network) "+
+			"RETURN c.id AS container, n.id AS network, r.ip AS ip, r.ipv6 AS ipv6, r.aliases AS aliases",
+			func(record *neo4j.Record) error {
+				var a ContainerAttachment
+				a.ContainerID, _ = valueOf(record, "container").(string)
+				a.NetworkID, _ = valueOf(record, "network").(string)
+				a.IP, _ = valueOf(record, "ip").(string)
+				a.IPv6, _ = valueOf(record, "ipv6").(string)
+				a.Aliases = []string{}
+				if v := valueOf(record, "aliases"); v != nil {
+					aliases, err := parseInterfaceToString(v)
+					if err != nil {
+						return err
+					}
+					a.Aliases = aliases
+				}
+				g.Attachments = append(g.Attachments, a)
+				return nil
+			})
+		if err != nil {
+			return nil, err
+		}
+		if !withDependencies {
+			return g, nil
+		}
+		err = read("MATCH (a)-[r:DEPENDE_DE]->(b) RETURN "+dependencyColumns, func(record *neo4j.Record) error {
+			g.Dependencies = append(g.Dependencies, dependencyOf(record))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return g, nil
 	})
 	if err != nil {
-		panic(err)
+		return Graph{}, wrapErr(op, err)
 	}
-	return err
+	graph := g.(Graph)
+	graph.ServiceDependencies = ServiceEdges(graph.Containers, graph.Dependencies)
+	graph.sort()
+	return graph, nil
 }
 
-func AddDependencyNonContianerContainer(ip string, contOri types.ContainerJSON, appLayerHeader string) error {
-	fmt.Printf("Añadiendo flecha: %s -> %s\n", contOri.Name, ip)
-	session := driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+// ContainerDependencies reads the dependencies container id is at either
+// end of. Each end is matched on its own, so that both use the index of
+// the container_id constraint.
+func (db *Neo4jStore) ContainerDependencies(id string) ([]Dependency, error) {
+	session := db.newReadSession()
 	defer session.Close()
-	_, err := session.WriteTransaction(func(transaction neo4j.Transaction) (interface{}, error) {
-		result, err := transaction.Run("MATCH (a:Container), (b:NoContainer) WHERE a.id = $idA AND b.ip = $ip CREATE (a)-[r:DEPENDE_DE {AppLayerContent: $appLayerHeader}]->(b) RETURN type(r), r.name", map[string]interface{}{"idA": contOri.ID, "ip": ip, "appLayerHeader": appLayerHeader})
+	deps, err := session.ReadTransaction(func(transaction neo4j.Transaction) (interface{}, error) {
+		result, err := transaction.Run(
+			"MATCH (a:Container {id: $id})-[r:DEPENDE_DE]->(b) RETURN "+dependencyColumns+
+				" UNION MATCH (a)-[r:DEPENDE_DE]->(b:Container {id: $id}) RETURN "+dependencyColumns,
+			map[string]interface{}{"id": id})
 		if err != nil {
 			return nil, err
 		}
 
-		if result.Next() {
-			return result.Record().Values[0], nil
+		deps := []Dependency{}
+		for result.Next() {
+			deps = append(deps, dependencyOf(result.Record()))
 		}
-
-		return nil, result.Err()
+		return deps, result.Err()
 	})
 	if err != nil {
-		panic(err)
+		return nil, wrapErr("list container dependencies", err)
+	}
+	out := deps.([]Dependency)
+	sortDependencies(out)
+	return out, nil
+}
+
+// dependencyColumns returns the columns dependencyOf reads, for the
+// DEPENDE_DE relationship r from a to b.
+const dependencyColumns = "a.id AS fromID, a.ip AS fromIP, 'Container' IN labels(a) AS fromContainer, " +
+	"b.id AS toID, b.ip AS toIP, 'Container' IN labels(b) AS toContainer, " +
+	"r.serverPort AS port, r.protocol AS protocol, r.network AS network, " +
+	"r.appProtocol AS appProtocol, r.httpMethod AS httpMethod, r.httpHost AS httpHost, " +
+	"r.httpPath AS httpPath, r.httpStatus AS httpStatus, " +
+	"r.bytesOut AS bytesOut, r.bytesIn AS bytesIn, r.packetsOut AS packetsOut, r.packetsIn AS packetsIn, " +
+	"r.connections AS connections, r.firstSeen AS firstSeen, r.lastSeen AS lastSeen"
+
+func dependencyOf(record *neo4j.Record) Dependency {
+	d := Dependency{Edge: Edge{From: endpointOf(record, "from"), To: endpointOf(record, "to")}}
+	d.Port = int(int64Of(record, "port"))
+	d.Protocol, _ = valueOf(record, "protocol").(string)
+	d.Network, _ = valueOf(record, "network").(string)
+	d.AppLayer.Protocol, _ = valueOf(record, "appProtocol").(string)
+	d.AppLayer.Method, _ = valueOf(record, "httpMethod").(string)
+	d.AppLayer.Host, _ = valueOf(record, "httpHost").(string)
+	d.AppLayer.Path, _ = valueOf(record, "httpPath").(string)
+	d.AppLayer.Status = int(int64Of(record, "httpStatus"))
+	d.Metrics.BytesOut = int64Of(record, "bytesOut")
+	d.Metrics.BytesIn = int64Of(record, "bytesIn")
+	d.Metrics.PacketsOut = int64Of(record, "packetsOut")
+	d.Metrics.PacketsIn = int64Of(record, "packetsIn")
+	d.Metrics.Connections = int64Of(record, "connections")
+	d.Metrics.FirstSeen, _ = valueOf(record, "firstSeen").(time.Time)
+	d.Metrics.LastSeen, _ = valueOf(record, "lastSeen").(time.Time)
+	return d
+}
+
+func int64Of(record *neo4j.Record, key string) int64 {
+	n, _ := valueOf(record, key).(int64)
+	return n
+}
+
+// serviceEndpointOf reads the service endpoint returned under the given
+// column prefix.
+func serviceEndpointOf(record *neo4j.Record, prefix string) ServiceEndpoint {
+	if isService, _ := valueOf(record, prefix+"IsService").(bool); isService {
+		var e ServiceEndpoint
+		e.Project, _ = valueOf(record, prefix+"Project").(string)
+		e.Service, _ = valueOf(record, prefix+"Service").(string)
+		return e
+	}
+	ip, _ := valueOf(record, prefix+"IP").(string)
+	return ServiceEndpoint{IP: ip}
+}
+
+// endpointOf reads the endpoint returned under the given column prefix.
+func endpointOf(record *neo4j.Record, prefix string) Endpoint {
+	if isContainer, _ := valueOf(record, prefix+"Container").(bool); isContainer {
+		id, _ := valueOf(record, prefix+"ID").(string)
+		return ContainerEndpoint(id)
 	}
-	return err
+	ip, _ := valueOf(record, prefix+"IP").(string)
+	return NoContainerEndpoint(ip)
 }
@@ -0,0 +1,63 @@
+package graphDB
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/neo4j/neo4j-go-driver/v4/neo4j"
+)
+
+// StoreError is a write that the store could not carry out.
+type StoreError struct {
+	Op  string
+	Err error
+}
+
+func (e *StoreError) Error() string {
+	return fmt.Sprintf("graph store: %s: %v", e.Op, e.Err)
+}
+
+func (e *StoreError) Unwrap() error {
+	return e.Err
+}
+
+// Unavailable reports whether the store could not be reached at all, or is
+// too far behind to queue the write, as opposed to rejecting it. The neo4j
+// driver has already retried transient failures by the time it gives up.
+func (e *StoreError) Unavailable() bool {
+	return errors.Is(e.Err, ErrQueueFull) ||
+		neo4j.IsConnectivityError(e.Err) || neo4j.IsTransactionExecutionLimit(e.Err)
+}
+
+// Rejected reports whether the store refused the write itself, which no
+// retry can fix: Neo4j rejected a statement as a client error, such as a
+// constraint violation, or the driver was misused. Authentication and
+// authorization failures are left out, they are fixed on the server.
+func (e *StoreError) Rejected() bool {
+	var neo4jErr *neo4j.Neo4jError
+	if errors.As(e.Err, &neo4jErr) {
+		return neo4jErr.Classification() == "ClientError" && neo4jErr.Category() != "Security"
+	}
+	return neo4j.IsUsageError(e.Err)
+}
+
+// IsRejected reports whether err is a write the store refused for good.
+func IsRejected(err error) bool {
+	var storeErr *StoreError
+	return errors.As(err, &storeErr) && storeErr.Rejected()
+}
+
+// IsUnavailable reports whether err comes from a store that could not be
+// reached.
+func IsUnavailable(err error) bool {
+	var storeErr *StoreError
+	return errors.As(err, &storeErr) && storeErr.Unavailable()
+}
+
+// wrapErr returns err as a StoreError for op, or nil.
+func wrapErr(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &StoreError{Op: op, Err: err}
+}
@@ -0,0 +1,110 @@
+package graphDB
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Types of Change.
+const (
+	ContainerCreated   = "container.created"
+	ContainerStarted   = "container.started"
+	ContainerStopped   = "container.stopped"
+	ContainerDestroyed = "container.destroyed"
+	EdgeAdded          = "edge.added"
+	EdgeMetrics        = "edge.metrics"
+)
+
+// ErrLagged is the error of a subscription dropped because it did not
+// keep up with the changes.
+var ErrLagged = errors.New("subscriber too slow, changes were dropped")
+
+// Change is a change to the graph, as published on a Feed.
+type Change struct {
+	// Seq numbers the changes of a feed from 1, without gaps.
+	Seq  uint64    `json:"seq"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Container is the node of the container changes apply to, as written.
+	// A destroyed container keeps the last state known.
+	Container *ContainerNode `json:"container,omitempty"`
+	// Edge is the dependency edge changes apply to.
+	Edge *Edge `json:"edge,omitempty"`
+	// Metrics are the counters an EdgeMetrics change added to the edge.
+	Metrics *Metrics `json:"metrics,omitempty"`
+}
+
+// Feed broadcasts changes to subscribers. Publishing never blocks: a
+// subscriber whose buffer is full is dropped, and can read the graph again
+// before subscribing anew.
+type Feed struct {
+	mu   sync.Mutex
+	seq  uint64
+	subs map[*Subscription]bool
+}
+
+func NewFeed() *Feed {
+	return &Feed{subs: make(map[*Subscription]bool)}
+}
+
+// Subscription receives the changes published after it was made.
+type Subscription struct {
+	feed *Feed
+	ch   chan Change
+	err  error
+}
+
+// Subscribe returns a subscription buffering up to buffer changes.
+func (f *Feed) Subscribe(buffer int) *Subscription {
+	s := &Subscription{feed: f, ch: make(chan Change, buffer)}
+	f.mu.Lock()
+	f.subs[s] = true
+	f.mu.Unlock()
+	return s
+}
+
+// Publish numbers c and sends it to every subscriber.
+func (f *Feed) Publish(c Change) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	c.Seq = f.seq
+	for s := range f.subs {
+		select {
+		case s.ch <- c:
+		default:
+			f.drop(s, ErrLagged)
+		}
+	}
+}
+
+// drop closes s with err. f.mu must be held.
+func (f *Feed) drop(s *Subscription, err error) {
+	if !f.subs[s] {
+		return
+	}
+	delete(f.subs, s)
+	s.err = err
+	close(s.ch)
+}
+
+// Changes returns the channel changes are received on. It is closed once
+// the subscription is.
+func (s *Subscription) Changes() <-chan Change {
+	return s.ch
+}
+
+// Err returns ErrLagged once the subscription was dropped, nil otherwise.
+func (s *Subscription) Err() error {
+	s.feed.mu.Lock()
+	defer s.feed.mu.Unlock()
+	return s.err
+}
+
+// Close stops the subscription.
+func (s *Subscription) Close() {
+	s.feed.mu.Lock()
+	defer s.feed.mu.Unlock()
+	s.feed.drop(s, nil)
+}
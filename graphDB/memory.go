@@ -0,0 +1,498 @@
+package graphDB
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+)
+
+// NoContainerNode is an endpoint that does not belong to any known container.
+type NoContainerNode struct {
+	IP string `json:"ip"`
+}
+
+// Dependency is a DEPENDE_DE relationship.
+type Dependency struct {
+	Edge
+	AppLayer AppLayer `json:"appLayer"`
+	Metrics  Metrics  `json:"metrics"`
+}
+
+// ContainerAttachment is an ATTACHED_TO relationship.
+type ContainerAttachment struct {
+	ContainerID string `json:"containerId"`
+	Attachment
+}
+
+// Graph is a point in time copy of a MemoryStore.
+type Graph struct {
+	Containers   []ContainerNode       `json:"containers"`
+	Networks     []NetworkNode         `json:"networks"`
+	NoContainers []NoContainerNode     `json:"noContainers"`
+	Attachments  []ContainerAttachment `json:"attachments"`
+	Dependencies []Dependency          `json:"dependencies"`
+	// ServiceDependencies is the service view of Dependencies.
+	ServiceDependencies []ServiceEdge `json:"serviceDependencies"`
+}
+
+// MemoryStore is a TopologyStore that keeps the graph in process memory.
+type MemoryStore struct {
+	appliedHook
+	mu           sync.RWMutex
+	containers   map[string]ContainerNode
+	networks     map[string]NetworkNode
+	noContainers map[string]NoContainerNode
+	attachments  map[string][]Attachment // by container ID
+	dependencies map[Edge]Dependency
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		containers:   make(map[string]ContainerNode),
+		networks:     make(map[string]NetworkNode),
+		noContainers: make(map[string]NoContainerNode),
+		attachments:  make(map[string][]Attachment),
+		dependencies: make(map[Edge]Dependency),
+	}
+}
+
+// write applies the single write that add puts in a batch.
+func (m *MemoryStore) write(add func(b *Batch)) error {
+	b := NewBatch()
+	add(b)
+	return m.WriteBatch(b)
+}
+
+func (m *MemoryStore) InsertContainer(container types.ContainerJSON, ip, daemon string) error {
+	return m.write(func(b *Batch) { b.InsertContainer(container, ip, daemon) })
+}
+
+func (m *MemoryStore) UpdateContainer(container types.ContainerJSON, ip, daemon string) error {
+	return m.write(func(b *Batch) { b.UpdateContainer(container, ip, daemon) })
+}
+
+func (m *MemoryStore) MarkContainerRemoved(id string) error {
+	return m.write(func(b *Batch) { b.MarkContainerRemoved(id) })
+}
+
+func (m *MemoryStore) InsertNoContainerNode(ip string) error {
+	return m.write(func(b *Batch) { b.InsertNoContainerNode(ip) })
+}
+
+func (m *MemoryStore) InsertNetwork(network types.NetworkResource, daemon string) error {
+	return m.write(func(b *Batch) { b.InsertNetwork(network, daemon) })
+}
+
+func (m *MemoryStore) RemoveNetwork(id string) error {
+	return m.write(func(b *Batch) { b.RemoveNetwork(id) })
+}
+
+func (m *MemoryStore) removeNetworkLocked(id string) {
+	delete(m.networks, id)
+	for container, attachments := range m.attachments {
+		m.attachments[container] = dropAttachment(attachments, id)
+	}
+}
+
+// dropAttachment returns attachments without the one to network id.
+func dropAttachment(attachments []Attachment, id string) []Attachment {
+	var out []Attachment
+	for _, a := range attachments {
+		if a.NetworkID != id {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+func (m *MemoryStore) SetAttachments(id string, attachments []Attachment) error {
+	return m.write(func(b *Batch) { b.SetAttachments(id, attachments) })
+}
+
+func (m *MemoryStore) setAttachmentsLocked(id string, attachments []Attachment) {
+	if _, ok := m.containers[id]; !ok {
+		return
+	}
+	var kept []Attachment
+	for _, a := range attachments {
+		if _, ok := m.networks[a.NetworkID]; ok {
+			kept = append(kept, a)
+		}
+	}
+	if len(kept) == 0 {
+		delete(m.attachments, id)
+	} else {
+		m.attachments[id] = kept
+	}
+}
+
+// exists reports whether the node of e is in the store. m.mu must be held.
+func (m *MemoryStore) exists(e Endpoint) bool {
+	if e.IsContainer() {
+		_, ok := m.containers[e.ContainerID]
+		return ok
+	}
+	_, ok := m.noContainers[e.IP]
+	return ok
+}
+
+func (m *MemoryStore) AddDependency(edge Edge, app AppLayer) error {
+	return m.write(func(b *Batch) { b.AddDependency(edge, app) })
+}
+
+// addDependencyLocked reports whether both ends of edge exist, and so
+// whether the dependency was added.
+func (m *MemoryStore) addDependencyLocked(edge Edge, app AppLayer) bool {
+	if !m.exists(edge.From) || !m.exists(edge.To) {
+		return false
+	}
+	d, ok := m.dependencies[edge]
+	if !ok {
+		d.Edge = edge
+	}
+	d.AppLayer = d.AppLayer.merge(app)
+	m.dependencies[edge] = d
+	return true
+}
+
+func (m *MemoryStore) UpdateDependencyAppLayer(edge Edge, app AppLayer) error {
+	return m.write(func(b *Batch) { b.UpdateDependencyAppLayer(edge, app) })
+}
+
+func (m *MemoryStore) updateAppLayerLocked(edge Edge, app AppLayer) bool {
+	d, ok := m.dependencies[edge]
+	if ok {
+		d.AppLayer = d.AppLayer.merge(app)
+		m.dependencies[edge] = d
+	}
+	return ok
+}
+
+func (m *MemoryStore) AddDependencyMetrics(edge Edge, delta Metrics) error {
+	return m.write(func(b *Batch) { b.AddDependencyMetrics(edge, delta) })
+}
+
+func (m *MemoryStore) addMetricsLocked(edge Edge, delta Metrics) bool {
+	d, ok := m.dependencies[edge]
+	if ok {
+		d.Metrics = d.Metrics.Add(delta)
+		m.dependencies[edge] = d
+	}
+	return ok
+}
+
+// WriteBatch applies b in the order a Neo4jStore does: nodes, then
+// attachments and dependencies. What it applied is reported before it
+// returns.
+func (m *MemoryStore) WriteBatch(b *Batch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	applied := newApplied(b)
+	for id, w := range b.containers {
+		if w.set {
+			if old, ok := m.containers[id]; ok || w.upsert {
+				node := w.node
+				if ok && !w.upsert {
+					node.Hostname = old.Hostname
+				}
+				m.containers[id] = node
+				applied.keepState(b, id)
+			}
+		}
+		if node, ok := m.containers[id]; ok && w.removed {
+			if node.Status != StatusRemoved {
+				applied.keepRemoval(id)
+			}
+			node.Status = StatusRemoved
+			m.containers[id] = node
+		}
+	}
+	for id, w := range b.networks {
+		if w.set {
+			m.networks[id] = w.node
+		}
+		if w.removed {
+			m.removeNetworkLocked(id)
+		}
+	}
+	for ip := range b.noContainers {
+		m.noContainers[ip] = NoContainerNode{IP: ip}
+	}
+	for id, attachments := range b.attachments {
+		m.setAttachmentsLocked(id, attachments)
+	}
+	for edge, w := range b.dependencies {
+		var ok bool
+		if w.create {
+			ok = m.addDependencyLocked(edge, w.app)
+		} else {
+			ok = m.updateAppLayerLocked(edge, w.app)
+		}
+		if ok {
+			applied.keepDependency(b, edge)
+		}
+	}
+	for edge := range b.metrics {
+		if m.addMetricsLocked(edge, b.metrics[edge]) {
+			applied.keepMetrics(b, edge)
+		}
+	}
+	// reported under the lock, so that writes are reported in order
+	m.report(applied)
+	return nil
+}
+
+func (m *MemoryStore) Wipe() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.containers = make(map[string]ContainerNode)
+	m.networks = make(map[string]NetworkNode)
+	m.noContainers = make(map[string]NoContainerNode)
+	m.attachments = make(map[string][]Attachment)
+	m.dependencies = make(map[Edge]Dependency)
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+func (m *MemoryStore) Containers() ([]ContainerNode, error) {
+	return m.HostContainers(localHostname())
+}
+
+func (m *MemoryStore) HostContainers(hostname string) ([]ContainerNode, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var out []ContainerNode
+	for _, node := range m.containers {
+		if node.Hostname == hostname {
+			out = append(out, node)
+		}
+	}
+	return out, nil
+}
+
+func (m *MemoryStore) Networks() ([]NetworkNode, error) {
+	return m.HostNetworks(localHostname())
+}
+
+func (m *MemoryStore) HostNetworks(hostname string) ([]NetworkNode, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var out []NetworkNode
+	for _, node := range m.networks {
+		if node.Hostname == hostname {
+			out = append(out, node)
+		}
+	}
+	return out, nil
+}
+
+func (m *MemoryStore) NoContainers() ([]NoContainerNode, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]NoContainerNode, 0, len(m.noContainers))
+	for _, node := range m.noContainers {
+		out = append(out, node)
+	}
+	return out, nil
+}
+
+func (m *MemoryStore) Dependencies() ([]Edge, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]Edge, 0, len(m.dependencies))
+	for _, d := range m.dependencies {
+		out = append(out, d.Edge)
+	}
+	return out, nil
+}
+
+func (m *MemoryStore) ServiceDependencies() ([]ServiceEdge, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return serviceEdges(m.containers, m.dependencyList()), nil
+}
+
+// dependencyList returns the dependencies, in no particular order. m.mu
+// must be held.
+func (m *MemoryStore) dependencyList() []Dependency {
+	out := make([]Dependency, 0, len(m.dependencies))
+	for _, d := range m.dependencies {
+		out = append(out, d)
+	}
+	return out
+}
+
+// ServiceEdges returns the service view of dependencies between
+// containers.
+func ServiceEdges(containers []ContainerNode, dependencies []Dependency) []ServiceEdge {
+	byID := make(map[string]ContainerNode, len(containers))
+	for _, node := range containers {
+		byID[node.ID] = node
+	}
+	return serviceEdges(byID, dependencies)
+}
+
+// serviceEdges aggregates dependencies by the services of their
+// containers. Edges with an end in a container outside Compose have no
+// service view.
+func serviceEdges(containers map[string]ContainerNode, dependencies []Dependency) []ServiceEdge {
+	seen := make(map[ServiceEdge]bool)
+	out := []ServiceEdge{}
+	for _, d := range dependencies {
+		from, ok := serviceEndpoint(containers, d.From)
+		if !ok {
+			continue
+		}
+		to, ok := serviceEndpoint(containers, d.To)
+		if !ok || from == to {
+			continue
+		}
+		edge := ServiceEdge{From: from, To: to, Port: d.Port, Protocol: d.Protocol}
+		if !seen[edge] {
+			seen[edge] = true
+			out = append(out, edge)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].From != out[j].From {
+			return out[i].From.String() < out[j].From.String()
+		}
+		if out[i].To != out[j].To {
+			return out[i].To.String() < out[j].To.String()
+		}
+		if out[i].Port != out[j].Port {
+			return out[i].Port < out[j].Port
+		}
+		return out[i].Protocol < out[j].Protocol
+	})
+	return out
+}
+
+// serviceEndpoint returns the end of the service view standing for e.
+func serviceEndpoint(containers map[string]ContainerNode, e Endpoint) (ServiceEndpoint, bool) {
+	if !e.IsContainer() {
+		return ServiceEndpoint{IP: e.IP}, true
+	}
+	node, ok := containers[e.ContainerID]
+	if !ok || node.Service == "" {
+		return ServiceEndpoint{}, false
+	}
+	return ServiceEndpoint{Project: node.Project, Service: node.Service}, true
+}
+
+// Container returns the node with the given ID.
+func (m *MemoryStore) Container(id string) (ContainerNode, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	node, ok := m.containers[id]
+	return node, ok
+}
+
+// DependenciesOf returns the dependencies going out of container id.
+func (m *MemoryStore) DependenciesOf(id string) []Dependency {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var out []Dependency
+	for _, d := range m.dependencies {
+		if d.From == ContainerEndpoint(id) {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// Snapshot returns a copy of the whole graph with nodes sorted by key.
+func (m *MemoryStore) Snapshot() Graph {
+	return m.snapshot(true)
+}
+
+// snapshot copies the graph, without the dependencies unless asked for.
+func (m *MemoryStore) snapshot(withDependencies bool) Graph {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	dependencies := []Dependency{}
+	if withDependencies {
+		dependencies = m.dependencyList()
+	}
+	g := Graph{
+		Containers:   make([]ContainerNode, 0, len(m.containers)),
+		Networks:     make([]NetworkNode, 0, len(m.networks)),
+		NoContainers: make([]NoContainerNode, 0, len(m.noContainers)),
+		Attachments:  []ContainerAttachment{},
+		Dependencies: dependencies,
+
+		ServiceDependencies: serviceEdges(m.containers, dependencies),
+	}
+	for _, c := range m.containers {
+		g.Containers = append(g.Containers, c)
+	}
+	for _, n := range m.networks {
+		g.Networks = append(g.Networks, n)
+	}
+	for id, attachments := range m.attachments {
+		for _, a := range attachments {
+			g.Attachments = append(g.Attachments, ContainerAttachment{ContainerID: id, Attachment: a})
+		}
+	}
+	for _, n := range m.noContainers {
+		g.NoContainers = append(g.NoContainers, n)
+	}
+	g.sort()
+	return g
+}
+
+// Graph returns the whole graph, as Snapshot does.
+func (m *MemoryStore) Graph() (Graph, error) {
+	return m.Snapshot(), nil
+}
+
+func (m *MemoryStore) Nodes() (Graph, error) {
+	return m.snapshot(false), nil
+}
+
+func (m *MemoryStore) ContainerDependencies(id string) ([]Dependency, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	self := ContainerEndpoint(id)
+	out := []Dependency{}
+	for _, d := range m.dependencies {
+		if d.From == self || d.To == self {
+			out = append(out, d)
+		}
+	}
+	sortDependencies(out)
+	return out, nil
+}
+
+// sort orders nodes by key and relationships by their ends.
+func (g *Graph) sort() {
+	sort.Slice(g.Containers, func(i, j int) bool { return g.Containers[i].ID < g.Containers[j].ID })
+	sort.Slice(g.Networks, func(i, j int) bool { return g.Networks[i].ID < g.Networks[j].ID })
+	sort.Slice(g.Attachments, func(i, j int) bool {
+		if g.Attachments[i].ContainerID != g.Attachments[j].ContainerID {
+			return g.Attachments[i].ContainerID < g.Attachments[j].ContainerID
+		}
+		return g.Attachments[i].NetworkID < g.Attachments[j].NetworkID
+	})
+	sort.Slice(g.NoContainers, func(i, j int) bool { return g.NoContainers[i].IP < g.NoContainers[j].IP })
+	sortDependencies(g.Dependencies)
+}
+
+func sortDependencies(dependencies []Dependency) {
+	sort.SliceStable(dependencies, func(i, j int) bool {
+		return dependencies[i].String() < dependencies[j].String()
+	})
+}
+
+// WriteJSON serializes a snapshot of the graph to w.
+func (m *MemoryStore) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m.Snapshot())
+}
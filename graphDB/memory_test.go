@@ -0,0 +1,146 @@
+package graphDB
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	web := Edge{From: ContainerEndpoint("a"), To: ContainerEndpoint("b"), Port: 80, Protocol: "tcp"}
+	dns := Edge{From: ContainerEndpoint("a"), To: NoContainerEndpoint("10.0.0.53"), Port: 53, Protocol: "udp"}
+	first := time.Date(2021, 9, 1, 10, 0, 0, 0, time.UTC)
+	last := first.Add(time.Minute)
+
+	tests := []struct {
+		name       string
+		write      func(m *MemoryStore)
+		containers []ContainerNode
+		deps       []Dependency
+	}{
+		{
+			name: "update without insert",
+			write: func(m *MemoryStore) {
+				m.UpdateContainer(testContainer("a", "running", nil), "172.17.0.2", "")
+			},
+			containers: []ContainerNode{},
+			deps:       []Dependency{},
+		},
+		{
+			name: "update refreshes compose labels",
+			write: func(m *MemoryStore) {
+				m.InsertContainer(testContainer("a", "created", nil), "", "")
+				m.UpdateContainer(testContainer("a", "running", compose("shop", "web")), "172.17.0.2", "")
+			},
+			containers: []ContainerNode{{
+				ID: "a", Name: "/a", Status: "running", IP: "172.17.0.2", Hostname: localHostname(),
+				Project: "shop", Service: "web",
+			}},
+			deps: []Dependency{},
+		},
+		{
+			name: "removed container keeps its node",
+			write: func(m *MemoryStore) {
+				m.InsertContainer(testContainer("a", "running", nil), "", "")
+				m.MarkContainerRemoved("a")
+			},
+			containers: []ContainerNode{{ID: "a", Name: "/a", Status: StatusRemoved, Hostname: localHostname()}},
+			deps:       []Dependency{},
+		},
+		{
+			name: "dependency needs both ends",
+			write: func(m *MemoryStore) {
+				m.InsertContainer(testContainer("a", "running", nil), "", "")
+				m.AddDependency(web, AppLayer{Protocol: "http"})
+				m.AddDependency(dns, AppLayer{})
+			},
+			containers: []ContainerNode{{ID: "a", Name: "/a", Status: "running", Hostname: localHostname()}},
+			deps:       []Dependency{},
+		},
+		{
+			name: "app layers merge and metrics add up",
+			write: func(m *MemoryStore) {
+				m.InsertContainer(testContainer("a", "running", nil), "", "")
+				m.InsertContainer(testContainer("b", "running", nil), "", "")
+				m.AddDependency(web, AppLayer{Protocol: "http"})
+				m.UpdateDependencyAppLayer(web, AppLayer{Method: "GET", Path: "/"})
+				m.AddDependency(web, AppLayer{Status: 200})
+				m.AddDependencyMetrics(web, Metrics{BytesOut: 100, PacketsOut: 1, FirstSeen: last, LastSeen: last})
+				m.AddDependencyMetrics(web, Metrics{BytesIn: 50, PacketsIn: 1, FirstSeen: first, LastSeen: first})
+			},
+			containers: []ContainerNode{
+				{ID: "a", Name: "/a", Status: "running", Hostname: localHostname()},
+				{ID: "b", Name: "/b", Status: "running", Hostname: localHostname()},
+			},
+			deps: []Dependency{{
+				Edge:     web,
+				AppLayer: AppLayer{Protocol: "http", Method: "GET", Path: "/", Status: 200},
+				Metrics:  Metrics{BytesOut: 100, BytesIn: 50, PacketsOut: 1, PacketsIn: 1, FirstSeen: first, LastSeen: last},
+			}},
+		},
+		{
+			name: "app layer and metrics of a missing edge are dropped",
+			write: func(m *MemoryStore) {
+				m.InsertContainer(testContainer("a", "running", nil), "", "")
+				m.InsertContainer(testContainer("b", "running", nil), "", "")
+				m.UpdateDependencyAppLayer(web, AppLayer{Protocol: "http"})
+				m.AddDependencyMetrics(web, Metrics{BytesOut: 100})
+			},
+			containers: []ContainerNode{
+				{ID: "a", Name: "/a", Status: "running", Hostname: localHostname()},
+				{ID: "b", Name: "/b", Status: "running", Hostname: localHostname()},
+			},
+			deps: []Dependency{},
+		},
+		{
+			name: "wipe",
+			write: func(m *MemoryStore) {
+				m.InsertContainer(testContainer("a", "running", nil), "", "")
+				m.InsertNoContainerNode("10.0.0.53")
+				m.AddDependency(dns, AppLayer{})
+				m.Wipe()
+			},
+			containers: []ContainerNode{},
+			deps:       []Dependency{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMemoryStore()
+			tt.write(m)
+			g := m.Snapshot()
+			if !reflect.DeepEqual(g.Containers, tt.containers) {
+				t.Errorf("containers = %+v, want %+v", g.Containers, tt.containers)
+			}
+			if !reflect.DeepEqual(g.Dependencies, tt.deps) {
+				t.Errorf("dependencies = %+v, want %+v", g.Dependencies, tt.deps)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreServiceDependencies(t *testing.T) {
+	m := NewMemoryStore()
+	m.InsertContainer(testContainer("a1", "running", compose("shop", "web")), "", "")
+	m.InsertContainer(testContainer("a2", "running", compose("shop", "web")), "", "")
+	m.InsertContainer(testContainer("b", "running", compose("shop", "db")), "", "")
+	m.InsertContainer(testContainer("c", "running", nil), "", "")
+	for _, from := range []string{"a1", "a2"} {
+		m.AddDependency(Edge{From: ContainerEndpoint(from), To: ContainerEndpoint("b"), Port: 5432, Protocol: "tcp"}, AppLayer{})
+	}
+	m.AddDependency(Edge{From: ContainerEndpoint("c"), To: ContainerEndpoint("b"), Port: 5432, Protocol: "tcp"}, AppLayer{})
+
+	got, err := m.ServiceDependencies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ServiceEdge{{
+		From:     ServiceEndpoint{Project: "shop", Service: "web"},
+		To:       ServiceEndpoint{Project: "shop", Service: "db"},
+		Port:     5432,
+		Protocol: "tcp",
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("service dependencies = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,266 @@
+package graphDB
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+var errNotShared = errors.New("the store does not take the writes of other hosts")
+
+// Notifier is a TopologyStore that publishes on a Feed the changes the
+// store it wraps reports it applied, so that a write that changed nothing,
+// such as the update of a missing container, publishes nothing. Whatever
+// writes to the graph, the Docker events, reconciliation, captures or the
+// pushes of agents, shows on the feed the same way. A store that is not an
+// AppliedReporter publishes nothing.
+type Notifier struct {
+	store TopologyStore
+	feed  *Feed
+
+	mu sync.Mutex
+	// containers holds the last node written for each container not
+	// removed yet.
+	containers map[string]ContainerNode
+	// edges holds the edges already published as added, forgotten with
+	// the containers at their ends.
+	edges map[Edge]bool
+}
+
+func NewNotifier(store TopologyStore, feed *Feed) *Notifier {
+	n := &Notifier{
+		store:      store,
+		feed:       feed,
+		containers: make(map[string]ContainerNode),
+		edges:      make(map[Edge]bool),
+	}
+	if reporter, ok := store.(AppliedReporter); ok {
+		reporter.OnApplied(n.publish)
+	}
+	return n
+}
+
+func (n *Notifier) InsertContainer(container types.ContainerJSON, ip, daemon string) error {
+	return n.store.InsertContainer(container, ip, daemon)
+}
+
+func (n *Notifier) UpdateContainer(container types.ContainerJSON, ip, daemon string) error {
+	return n.store.UpdateContainer(container, ip, daemon)
+}
+
+func (n *Notifier) MarkContainerRemoved(id string) error {
+	return n.store.MarkContainerRemoved(id)
+}
+
+func (n *Notifier) InsertNoContainerNode(ip string) error {
+	return n.store.InsertNoContainerNode(ip)
+}
+
+func (n *Notifier) InsertNetwork(network types.NetworkResource, daemon string) error {
+	return n.store.InsertNetwork(network, daemon)
+}
+
+func (n *Notifier) RemoveNetwork(id string) error {
+	return n.store.RemoveNetwork(id)
+}
+
+func (n *Notifier) SetAttachments(id string, attachments []Attachment) error {
+	return n.store.SetAttachments(id, attachments)
+}
+
+func (n *Notifier) AddDependency(edge Edge, app AppLayer) error {
+	return n.store.AddDependency(edge, app)
+}
+
+func (n *Notifier) UpdateDependencyAppLayer(edge Edge, app AppLayer) error {
+	return n.store.UpdateDependencyAppLayer(edge, app)
+}
+
+func (n *Notifier) AddDependencyMetrics(edge Edge, delta Metrics) error {
+	return n.store.AddDependencyMetrics(edge, delta)
+}
+
+// WriteBatch applies b to the store, which must be a SharedStore.
+func (n *Notifier) WriteBatch(b *Batch) error {
+	shared, ok := n.store.(SharedStore)
+	if !ok {
+		return errNotShared
+	}
+	return shared.WriteBatch(b)
+}
+
+func (n *Notifier) HostContainers(hostname string) ([]ContainerNode, error) {
+	shared, ok := n.store.(SharedStore)
+	if !ok {
+		return nil, errNotShared
+	}
+	return shared.HostContainers(hostname)
+}
+
+func (n *Notifier) HostNetworks(hostname string) ([]NetworkNode, error) {
+	shared, ok := n.store.(SharedStore)
+	if !ok {
+		return nil, errNotShared
+	}
+	return shared.HostNetworks(hostname)
+}
+
+func (n *Notifier) Containers() ([]ContainerNode, error) {
+	return n.store.Containers()
+}
+
+func (n *Notifier) Networks() ([]NetworkNode, error) {
+	return n.store.Networks()
+}
+
+func (n *Notifier) NoContainers() ([]NoContainerNode, error) {
+	return n.store.NoContainers()
+}
+
+func (n *Notifier) Dependencies() ([]Edge, error) {
+	return n.store.Dependencies()
+}
+
+func (n *Notifier) ServiceDependencies() ([]ServiceEdge, error) {
+	return n.store.ServiceDependencies()
+}
+
+// Err returns the error the store keeps from its writes in the background,
+// if it keeps one: a WriteBehind, or an agent.
+func (n *Notifier) Err() error {
+	if queued, ok := n.store.(interface{ Err() error }); ok {
+		return queued.Err()
+	}
+	return nil
+}
+
+// Stats returns the queue statistics of the store, zero if it has no
+// queue.
+func (n *Notifier) Stats() QueueStats {
+	if queued, ok := n.store.(interface{ Stats() QueueStats }); ok {
+		return queued.Stats()
+	}
+	return QueueStats{}
+}
+
+func (n *Notifier) Wipe() error {
+	if err := n.store.Wipe(); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.containers = make(map[string]ContainerNode)
+	n.edges = make(map[Edge]bool)
+	return nil
+}
+
+func (n *Notifier) Close() error {
+	return n.store.Close()
+}
+
+// publish publishes the changes of b, what the store applied: containers
+// first, then new edges, then traffic.
+func (n *Notifier) publish(b *Batch) {
+	now := time.Now()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	ids := make([]string, 0, len(b.containers))
+	for id := range b.containers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		w := b.containers[id]
+		if _, known := n.containers[id]; !known && w.set && w.node.Status == StatusRemoved {
+			// the whole graph of an agent repeats the containers removed
+			// long ago
+			continue
+		}
+		if w.set && w.node.Status != StatusRemoved {
+			n.containerWritten(w.node, now)
+		}
+		if w.removed {
+			n.containerRemoved(id, now)
+		}
+	}
+
+	var added []Edge
+	for edge, w := range b.dependencies {
+		if w.create && !n.edges[edge] {
+			n.edges[edge] = true
+			added = append(added, edge)
+		}
+	}
+	sortEdges(added)
+	for i := range added {
+		n.feed.Publish(Change{Type: EdgeAdded, Time: now, Edge: &added[i]})
+	}
+
+	measured := make([]Edge, 0, len(b.metrics))
+	for edge := range b.metrics {
+		measured = append(measured, edge)
+	}
+	sortEdges(measured)
+	for i := range measured {
+		m := b.metrics[measured[i]]
+		n.feed.Publish(Change{Type: EdgeMetrics, Time: now, Edge: &measured[i], Metrics: &m})
+	}
+}
+
+// containerWritten publishes how the phase of a container changed with
+// node: created when first seen, started when it turns running, stopped
+// when it stops running. n.mu must be held.
+func (n *Notifier) containerWritten(node ContainerNode, now time.Time) {
+	prev, known := n.containers[node.ID]
+	n.containers[node.ID] = node
+	phase, prevPhase := StatusPhase(node.Status), ""
+	if known {
+		prevPhase = StatusPhase(prev.Status)
+	} else {
+		n.publishContainer(ContainerCreated, node, now)
+	}
+	if phase == prevPhase {
+		return
+	}
+	switch {
+	case phase == PhaseRunning:
+		n.publishContainer(ContainerStarted, node, now)
+	case phase == PhaseStopped && prevPhase == PhaseRunning:
+		n.publishContainer(ContainerStopped, node, now)
+	}
+}
+
+// containerRemoved publishes that a container was destroyed, with the last
+// state known of it, and forgets it and its edges. n.mu must be held.
+func (n *Notifier) containerRemoved(id string, now time.Time) {
+	node, known := n.containers[id]
+	if !known {
+		node = ContainerNode{ID: id}
+	}
+	node.Status = StatusRemoved
+	delete(n.containers, id)
+	// removals are rare next to edges, scanning them all is fine
+	for edge := range n.edges {
+		if edge.From.ContainerID == id || edge.To.ContainerID == id {
+			delete(n.edges, edge)
+		}
+	}
+	n.publishContainer(ContainerDestroyed, node, now)
+}
+
+func (n *Notifier) publishContainer(typ string, node ContainerNode, now time.Time) {
+	n.feed.Publish(Change{Type: typ, Time: now, Container: &node})
+}
+
+func sortEdges(edges []Edge) {
+	sort.Slice(edges, func(i, j int) bool { return edges[i].String() < edges[j].String() })
+}
+
+var (
+	_ TopologyStore = (*Notifier)(nil)
+	_ SharedStore   = (*Notifier)(nil)
+)
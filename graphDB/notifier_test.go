@@ -0,0 +1,74 @@
+package graphDB
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNotifierPublishesApplied(t *testing.T) {
+	web := Edge{From: ContainerEndpoint("a"), To: ContainerEndpoint("b"), Port: 80, Protocol: "tcp"}
+
+	tests := []struct {
+		name  string
+		write func(n *Notifier)
+		types []string
+	}{
+		{
+			name: "update of a missing container",
+			write: func(n *Notifier) {
+				n.UpdateContainer(testContainer("a", "running", nil), "", "")
+			},
+			types: nil,
+		},
+		{
+			name: "insert then start",
+			write: func(n *Notifier) {
+				n.InsertContainer(testContainer("a", "created", nil), "", "")
+				n.UpdateContainer(testContainer("a", "running", nil), "", "")
+			},
+			types: []string{ContainerCreated, ContainerStarted},
+		},
+		{
+			name: "removal of a missing container",
+			write: func(n *Notifier) {
+				n.MarkContainerRemoved("a")
+			},
+			types: nil,
+		},
+		{
+			name: "edge to a missing container",
+			write: func(n *Notifier) {
+				n.InsertContainer(testContainer("a", "created", nil), "", "")
+				n.AddDependency(web, AppLayer{})
+				n.AddDependencyMetrics(web, Metrics{BytesOut: 10})
+			},
+			types: []string{ContainerCreated},
+		},
+		{
+			name: "edge added once",
+			write: func(n *Notifier) {
+				n.InsertContainer(testContainer("a", "created", nil), "", "")
+				n.InsertContainer(testContainer("b", "created", nil), "", "")
+				n.AddDependency(web, AppLayer{})
+				n.AddDependency(web, AppLayer{Protocol: "http"})
+				n.AddDependencyMetrics(web, Metrics{BytesOut: 10})
+			},
+			types: []string{ContainerCreated, ContainerCreated, EdgeAdded, EdgeMetrics},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			feed := NewFeed()
+			sub := feed.Subscribe(16)
+			tt.write(NewNotifier(NewMemoryStore(), feed))
+			sub.Close()
+			var types []string
+			for c := range sub.Changes() {
+				types = append(types, c.Type)
+			}
+			if !reflect.DeepEqual(types, tt.types) {
+				t.Errorf("changes = %q, want %q", types, tt.types)
+			}
+		})
+	}
+}
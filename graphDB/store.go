@@ -0,0 +1,491 @@
+// Package graphDB stores the discovered topology as a graph of containers,
+// external endpoints and the dependencies between them.
+package graphDB
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// TopologyStore is where the analyzer writes what it discovers.
+// Implementations must be safe for concurrent use, and every write but
+// AddDependencyMetrics, which adds deltas, must be safe to repeat.
+type TopologyStore interface {
+	// InsertContainer creates the node of container, run by the engine at
+	// the daemon endpoint, or updates it if it exists.
+	InsertContainer(container types.ContainerJSON, ip, daemon string) error
+	// UpdateContainer updates the node of container if it exists.
+	UpdateContainer(container types.ContainerJSON, ip, daemon string) error
+	// MarkContainerRemoved labels the node of a container that no longer
+	// exists as removed. Its dependencies are kept.
+	MarkContainerRemoved(id string) error
+	InsertNoContainerNode(ip string) error
+	// InsertNetwork creates the node of network, defined on the engine at
+	// the daemon endpoint, or updates it if it exists.
+	InsertNetwork(network types.NetworkResource, daemon string) error
+	// RemoveNetwork deletes the node of network id, with its attachments.
+	RemoveNetwork(id string) error
+	// SetAttachments makes attachments the ATTACHED_TO relationships of
+	// container id, dropping any other. Nodes missing on either end are
+	// skipped.
+	SetAttachments(id string, attachments []Attachment) error
+	// AddDependency creates the relationship from the client to the server
+	// of edge, unless it exists, and sets app on it. Both nodes must already
+	// exist.
+	AddDependency(edge Edge, app AppLayer) error
+	// UpdateDependencyAppLayer sets the non zero fields of app on edge.
+	UpdateDependencyAppLayer(edge Edge, app AppLayer) error
+	// AddDependencyMetrics adds the counters in delta to edge and widens its
+	// first and last seen times.
+	AddDependencyMetrics(edge Edge, delta Metrics) error
+	// Containers returns the Container nodes written from this host.
+	Containers() ([]ContainerNode, error)
+	// Networks returns the Network nodes written from this host.
+	Networks() ([]NetworkNode, error)
+	// NoContainers returns the NoContainer nodes.
+	NoContainers() ([]NoContainerNode, error)
+	// Dependencies returns the edges of every DEPENDE_DE relationship.
+	Dependencies() ([]Edge, error)
+	// ServiceDependencies returns the dependencies between Compose services,
+	// and between services and NoContainer nodes, aggregated over every
+	// replica a service ever had.
+	ServiceDependencies() ([]ServiceEdge, error)
+	// Wipe deletes the nodes and relationships written by docker-topology,
+	// leaving anything else in the database alone.
+	Wipe() error
+	Close() error
+}
+
+// SharedStore is a TopologyStore that also takes the writes of other hosts,
+// as the store of a collector does.
+type SharedStore interface {
+	TopologyStore
+	// WriteBatch applies writes merged on another host. Nodes keep the
+	// hostname they were built with.
+	WriteBatch(b *Batch) error
+	// HostContainers returns the Container nodes written from hostname.
+	HostContainers(hostname string) ([]ContainerNode, error)
+	// HostNetworks returns the Network nodes written from hostname.
+	HostNetworks(hostname string) ([]NetworkNode, error)
+}
+
+// AppliedReporter is a store that reports the writes it applied. Writes
+// that changed nothing are left out: the update or removal of a missing
+// Container node, a dependency between nodes that do not both exist, and
+// an app layer or metrics for a missing relationship.
+type AppliedReporter interface {
+	// OnApplied makes the store call fn with the writes it applies, as a
+	// batch, once they are written and in the order they are. fn must not
+	// use the store.
+	OnApplied(fn func(applied *Batch))
+}
+
+// appliedHook is the function a store reports what it applied to.
+type appliedHook struct {
+	mu sync.Mutex
+	fn func(applied *Batch)
+}
+
+func (h *appliedHook) OnApplied(fn func(applied *Batch)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.fn = fn
+}
+
+// report calls the hook with applied, unless it is empty.
+func (h *appliedHook) report(applied *Batch) {
+	h.mu.Lock()
+	fn := h.fn
+	h.mu.Unlock()
+	if fn != nil && applied.Len() > 0 {
+		fn(applied)
+	}
+}
+
+// GraphReader is a store that returns the graph, the partitions of every
+// host included: whole, or just the part a query needs.
+type GraphReader interface {
+	Graph() (Graph, error)
+	// Nodes returns the graph without its dependencies: the nodes and the
+	// attachments between them.
+	Nodes() (Graph, error)
+	// ContainerDependencies returns the dependencies container id is at
+	// either end of.
+	ContainerDependencies(id string) ([]Dependency, error)
+}
+
+// Owner is the value of the owner property of every node and relationship
+// written by docker-topology.
+const Owner = "docker-topology"
+
+// StatusRemoved is the status of a container that no longer exists.
+const StatusRemoved = "removed"
+
+// Phases of the life of a container, whatever the engine running it and
+// the state it reports.
+const (
+	PhaseCreated = "created"
+	PhaseRunning = "running"
+	PhaseStopped = "stopped"
+	PhaseRemoved = "removed"
+)
+
+// StatusPhase returns the phase of a container in status, as a node or an
+// engine reports it, or "" for a status it does not know. A paused or
+// restarting container is still running.
+func StatusPhase(status string) string {
+	switch status {
+	case "created", "configured", "initialized":
+		return PhaseCreated
+	case "running", "paused", "restarting", "stopping":
+		return PhaseRunning
+	case "exited", "dead", "stopped", "removing":
+		return PhaseStopped
+	case StatusRemoved:
+		return PhaseRemoved
+	}
+	return ""
+}
+
+// ContainerNode is a Container node as read back from a store.
+type ContainerNode struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Ports    string `json:"ports"`
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname"`
+	// Daemon is the endpoint of the engine running the container, empty for
+	// nodes written before several daemons could be watched.
+	Daemon string `json:"daemon,omitempty"`
+	// Project and Service name the Compose service the container is a
+	// replica of, if any.
+	Project string `json:"project,omitempty"`
+	Service string `json:"service,omitempty"`
+}
+
+// Labels set by Docker Compose on the containers it creates.
+const (
+	ComposeProjectLabel = "com.docker.compose.project"
+	ComposeServiceLabel = "com.docker.compose.service"
+)
+
+// NewContainerNode returns the node stores write for container from this
+// host, run by the engine at the daemon endpoint.
+func NewContainerNode(container types.ContainerJSON, ip, daemon string) ContainerNode {
+	node := ContainerNode{
+		ID:       container.ID,
+		Name:     container.Name,
+		Status:   container.State.Status,
+		Ports:    portsString(container),
+		IP:       ip,
+		Hostname: localHostname(),
+		Daemon:   daemon,
+	}
+	if container.Config != nil {
+		project := container.Config.Labels[ComposeProjectLabel]
+		service := container.Config.Labels[ComposeServiceLabel]
+		if project != "" && service != "" {
+			node.Project, node.Service = project, service
+		}
+	}
+	return node
+}
+
+// ServiceEndpoint is one end of a service-level dependency: a Compose
+// service, by project and name, or a NoContainer node, by IP.
+type ServiceEndpoint struct {
+	Project string `json:"project,omitempty"`
+	Service string `json:"service,omitempty"`
+	IP      string `json:"ip,omitempty"`
+}
+
+func (e ServiceEndpoint) IsService() bool {
+	return e.Service != ""
+}
+
+// key identifies the Service node of e.
+func (e ServiceEndpoint) key() string {
+	return e.Project + "/" + e.Service
+}
+
+func (e ServiceEndpoint) String() string {
+	if e.IsService() {
+		return e.key()
+	}
+	return e.IP
+}
+
+// ServiceEdge is a DEPENDS_ON relationship: some replica of the client
+// depended on some replica of the server, on the given port and protocol.
+type ServiceEdge struct {
+	From     ServiceEndpoint `json:"from"`
+	To       ServiceEndpoint `json:"to"`
+	Port     int             `json:"serverPort"`
+	Protocol string          `json:"protocol"`
+}
+
+// NetworkNode is a Docker network.
+type NetworkNode struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Driver   string   `json:"driver"`
+	Scope    string   `json:"scope"`
+	Internal bool     `json:"internal"`
+	Subnets  []string `json:"subnets"`
+	Gateways []string `json:"gateways"`
+	Hostname string   `json:"hostname"`
+	// Daemon is the endpoint of the engine the network is defined on.
+	Daemon string `json:"daemon,omitempty"`
+}
+
+// NewNetworkNode returns the node stores write for network from this host,
+// defined on the engine at the daemon endpoint.
+func NewNetworkNode(network types.NetworkResource, daemon string) NetworkNode {
+	node := NetworkNode{
+		ID:       network.ID,
+		Name:     network.Name,
+		Driver:   network.Driver,
+		Scope:    network.Scope,
+		Internal: network.Internal,
+		Subnets:  []string{},
+		Gateways: []string{},
+		Hostname: localHostname(),
+		Daemon:   daemon,
+	}
+	for _, config := range network.IPAM.Config {
+		if config.Subnet != "" {
+			node.Subnets = append(node.Subnets, config.Subnet)
+		}
+		if config.Gateway != "" {
+			node.Gateways = append(node.Gateways, config.Gateway)
+		}
+	}
+	return node
+}
+
+// Attachment is the ATTACHED_TO relationship of a container to a network.
+type Attachment struct {
+	NetworkID string `json:"networkId"`
+	// IP and IPv6 are the addresses of the container on the network, empty
+	// while it is not running or the network has no IPv6.
+	IP      string   `json:"ip"`
+	IPv6    string   `json:"ipv6,omitempty"`
+	Aliases []string `json:"aliases"`
+}
+
+// Attachments returns the attachments of container to the networks it is
+// connected to, sorted by network.
+func Attachments(container types.ContainerJSON) []Attachment {
+	if container.NetworkSettings == nil {
+		return nil
+	}
+	var out []Attachment
+	for _, endpoint := range container.NetworkSettings.Networks {
+		if endpoint == nil || endpoint.NetworkID == "" {
+			continue
+		}
+		aliases := append([]string{}, endpoint.Aliases...)
+		sort.Strings(aliases)
+		out = append(out, Attachment{
+			NetworkID: endpoint.NetworkID,
+			IP:        endpoint.IPAddress,
+			IPv6:      canonicalIP(endpoint.GlobalIPv6Address),
+			Aliases:   aliases,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].NetworkID < out[j].NetworkID })
+	return out
+}
+
+// Endpoint is one end of a dependency: a Container node, by ID, or a
+// NoContainer node, by IP.
+type Endpoint struct {
+	ContainerID string `json:"containerId,omitempty"`
+	IP          string `json:"ip,omitempty"`
+}
+
+func ContainerEndpoint(id string) Endpoint {
+	return Endpoint{ContainerID: id}
+}
+
+func NoContainerEndpoint(ip string) Endpoint {
+	return Endpoint{IP: ip}
+}
+
+func (e Endpoint) IsContainer() bool {
+	return e.ContainerID != ""
+}
+
+func (e Endpoint) String() string {
+	if e.IsContainer() {
+		return e.ContainerID
+	}
+	return e.IP
+}
+
+// Edge identifies a DEPENDE_DE relationship, which goes from the client of
+// a connection to its server. A client talking to several ports or
+// transport protocols of the same server, or over several networks, has
+// one edge for each.
+type Edge struct {
+	From Endpoint `json:"from"`
+	To   Endpoint `json:"to"`
+	// Port is the server port, 0 for protocols without ports.
+	Port int `json:"serverPort"`
+	// Protocol is the transport protocol: tcp, udp, icmpv4...
+	Protocol string `json:"protocol"`
+	// Network is the ID of the network the traffic crossed: the one of the
+	// container address involved, the client's if both are containers.
+	Network string `json:"network,omitempty"`
+}
+
+func (e Edge) String() string {
+	s := fmt.Sprintf("%s -> %s:%d/%s", e.From, e.To, e.Port, e.Protocol)
+	if e.Network != "" {
+		network := e.Network
+		if len(network) > 12 {
+			network = network[:12]
+		}
+		s += " on " + network
+	}
+	return s
+}
+
+// AppLayer is what was understood of the application protocol spoken over
+// a dependency.
+type AppLayer struct {
+	Protocol string `json:"appProtocol,omitempty"`
+	Method   string `json:"httpMethod,omitempty"`
+	Host     string `json:"httpHost,omitempty"`
+	Path     string `json:"httpPath,omitempty"`
+	Status   int    `json:"httpStatus,omitempty"`
+}
+
+// properties returns the set fields as DEPENDE_DE relationship properties.
+func (a AppLayer) properties() map[string]interface{} {
+	props := make(map[string]interface{})
+	if a.Protocol != "" {
+		props["appProtocol"] = a.Protocol
+	}
+	if a.Method != "" {
+		props["httpMethod"] = a.Method
+	}
+	if a.Host != "" {
+		props["httpHost"] = a.Host
+	}
+	if a.Path != "" {
+		props["httpPath"] = a.Path
+	}
+	if a.Status != 0 {
+		props["httpStatus"] = a.Status
+	}
+	return props
+}
+
+// merge returns a with the set fields of b applied over it.
+func (a AppLayer) merge(b AppLayer) AppLayer {
+	if b.Protocol != "" {
+		a.Protocol = b.Protocol
+	}
+	if b.Method != "" {
+		a.Method = b.Method
+	}
+	if b.Host != "" {
+		a.Host = b.Host
+	}
+	if b.Path != "" {
+		a.Path = b.Path
+	}
+	if b.Status != 0 {
+		a.Status = b.Status
+	}
+	return a
+}
+
+// Metrics are the traffic counters of a dependency. Out is the direction of
+// the relationship, from the dependent container to its dependency; In is
+// the way back.
+type Metrics struct {
+	BytesOut    int64     `json:"bytesOut"`
+	BytesIn     int64     `json:"bytesIn"`
+	PacketsOut  int64     `json:"packetsOut"`
+	PacketsIn   int64     `json:"packetsIn"`
+	Connections int64     `json:"connections"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+// Add returns m with the counters of d added and the seen times widened.
+func (m Metrics) Add(d Metrics) Metrics {
+	m.BytesOut += d.BytesOut
+	m.BytesIn += d.BytesIn
+	m.PacketsOut += d.PacketsOut
+	m.PacketsIn += d.PacketsIn
+	m.Connections += d.Connections
+	if m.FirstSeen.IsZero() || (!d.FirstSeen.IsZero() && d.FirstSeen.Before(m.FirstSeen)) {
+		m.FirstSeen = d.FirstSeen
+	}
+	if d.LastSeen.After(m.LastSeen) {
+		m.LastSeen = d.LastSeen
+	}
+	return m
+}
+
+var (
+	_ TopologyStore = (*Neo4jStore)(nil)
+	_ TopologyStore = (*MemoryStore)(nil)
+	_ TopologyStore = (*WriteBehind)(nil)
+
+	_ SharedStore = (*Neo4jStore)(nil)
+	_ SharedStore = (*MemoryStore)(nil)
+	_ SharedStore = (*WriteBehind)(nil)
+
+	_ GraphReader = (*Neo4jStore)(nil)
+	_ GraphReader = (*MemoryStore)(nil)
+	_ GraphReader = (*WriteBehind)(nil)
+
+	_ AppliedReporter = (*Neo4jStore)(nil)
+	_ AppliedReporter = (*MemoryStore)(nil)
+	_ AppliedReporter = (*WriteBehind)(nil)
+)
+
+// portsString lists the published ports of container, sorted so that the
+// same container always gives the same string.
+func portsString(container types.ContainerJSON) string {
+	if container.NetworkSettings == nil {
+		return ""
+	}
+	var lines []string
+	for portContainer, portHostMap := range container.NetworkSettings.Ports {
+		for _, portHost := range portHostMap {
+			lines = append(lines, portContainer.Port()+"/"+portContainer.Proto()+" -> "+portHost.HostIP+":"+portHost.HostPort+"\n")
+		}
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "")
+}
+
+// canonicalIP returns ip in its canonical form, as packets spell it, or ""
+// if it is not an address.
+func canonicalIP(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ""
+}
+
+func localHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return hostname
+}
@@ -0,0 +1,349 @@
+package graphDB
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// What a WriteBehind does with a write when its queue is full.
+const (
+	// PolicyBlock makes the writer wait for room, slowing the analyzer down
+	// to the pace of the store.
+	PolicyBlock = "block"
+	// PolicyDrop rejects the write with ErrQueueFull.
+	PolicyDrop = "drop"
+)
+
+var (
+	// ErrQueueFull is returned for writes dropped because the queue was
+	// full.
+	ErrQueueFull = errors.New("write queue full")
+	errClosed    = errors.New("store closed")
+)
+
+// QueueOptions configure a WriteBehind.
+type QueueOptions struct {
+	// Size is how many writes may wait to be merged into a batch.
+	Size int
+	// BatchSize is how many nodes and relationships a batch may touch
+	// before it is flushed without waiting for FlushInterval.
+	BatchSize int
+	// FlushInterval is how long a write may wait in a batch.
+	FlushInterval time.Duration
+	// Policy is PolicyBlock or PolicyDrop.
+	Policy string
+}
+
+// QueueStats describe the writes a WriteBehind has not written yet.
+type QueueStats struct {
+	// Queued writes not yet merged into a batch.
+	Queued int `json:"queued"`
+	// Pending nodes and relationships in the batch being built or retried.
+	Pending int `json:"pending"`
+	// Dropped writes since start, under PolicyDrop.
+	Dropped int64 `json:"dropped"`
+	// Flushed batches written since start.
+	Flushed int64 `json:"flushed"`
+	// Rejected batches dropped since start because the store refused them.
+	Rejected int64 `json:"rejected"`
+	// LastError is the error of the last flush, empty once one succeeds.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// WriteBehind is a TopologyStore that queues writes and applies them to a
+// Neo4jStore from a single goroutine, merged into batches of up to
+// BatchSize. A write returns once queued. A batch the store cannot take is
+// kept and retried every FlushInterval, and meanwhile writes wait in the
+// queue, which fills up and applies the queue policy; a batch the store
+// rejects for good is dropped and counted. Reads go to the store as it
+// is: they neither wait for the writes queued nor fail with them; Stats
+// tells how far behind it is, and Flush waits for it to catch up. What a
+// batch applied is reported once it is written.
+type WriteBehind struct {
+	appliedHook
+	store *Neo4jStore
+	opts  QueueOptions
+
+	queue    chan func(b *Batch)
+	flushReq chan chan error
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+
+	pending  int64 // atomic
+	dropped  int64 // atomic
+	flushed  int64 // atomic
+	rejected int64 // atomic
+
+	mu      sync.Mutex
+	lastErr error
+}
+
+// NewWriteBehind starts queueing writes to store.
+func NewWriteBehind(store *Neo4jStore, opts QueueOptions) *WriteBehind {
+	w := &WriteBehind{
+		store:    store,
+		opts:     opts,
+		queue:    make(chan func(b *Batch), opts.Size),
+		flushReq: make(chan chan error),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// enqueue hands a write to the writer goroutine, following the queue
+// policy when it is full.
+func (w *WriteBehind) enqueue(op string, write func(b *Batch)) error {
+	select {
+	case <-w.stop:
+		return wrapErr(op, errClosed)
+	default:
+	}
+	if w.opts.Policy == PolicyDrop {
+		select {
+		case w.queue <- write:
+			return nil
+		case <-w.stop:
+			return wrapErr(op, errClosed)
+		default:
+			atomic.AddInt64(&w.dropped, 1)
+			return wrapErr(op, ErrQueueFull)
+		}
+	}
+	select {
+	case w.queue <- write:
+		return nil
+	case <-w.stop:
+		return wrapErr(op, errClosed)
+	}
+}
+
+// run merges queued writes into a batch and flushes it when it is full,
+// every FlushInterval and when asked to.
+func (w *WriteBehind) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.opts.FlushInterval)
+	defer ticker.Stop()
+	b := NewBatch()
+	failing := false
+	for {
+		// while the store fails, writes are left in the queue rather than
+		// piled up in b, so that the queue policy applies
+		queue := w.queue
+		if failing {
+			queue = nil
+		}
+		select {
+		case write := <-queue:
+			write(b)
+			atomic.StoreInt64(&w.pending, int64(b.Len()))
+			if b.Len() >= w.opts.BatchSize {
+				b, failing = w.flush(b)
+			}
+		case <-ticker.C:
+			if b.Len() > 0 {
+				b, failing = w.flush(b)
+			}
+		case reply := <-w.flushReq:
+			b, failing = w.flushQueued(b, failing)
+			reply <- w.Err()
+		case <-w.stop:
+			w.flushQueued(b, failing)
+			return
+		}
+	}
+}
+
+// flushQueued flushes b, then the writes queued by now, a batch at a time,
+// until one fails.
+func (w *WriteBehind) flushQueued(b *Batch, failing bool) (*Batch, bool) {
+	if failing {
+		if b, failing = w.flush(b); failing {
+			return b, true
+		}
+	}
+	for n := len(w.queue); n > 0; n-- {
+		(<-w.queue)(b)
+		if b.Len() >= w.opts.BatchSize {
+			if b, failing = w.flush(b); failing {
+				return b, true
+			}
+		}
+	}
+	return w.flush(b)
+}
+
+// flush writes b and returns the batch to carry on with, and whether the
+// store is failing: b itself if it could not be written, a new one
+// otherwise. A batch the store rejects is dropped, retrying would not
+// help.
+func (w *WriteBehind) flush(b *Batch) (*Batch, bool) {
+	if b.Len() == 0 {
+		return b, false
+	}
+	applied, err := w.store.apply(b)
+	err = wrapErr("write batch", err)
+	w.mu.Lock()
+	w.lastErr = err
+	w.mu.Unlock()
+	switch {
+	case err == nil:
+		atomic.AddInt64(&w.flushed, 1)
+		w.report(applied)
+	case IsRejected(err):
+		atomic.AddInt64(&w.rejected, 1)
+		log.Printf("dropping a batch of %d writes the store rejected: %v", b.Len(), err)
+	default:
+		atomic.StoreInt64(&w.pending, int64(b.Len()))
+		return b, true
+	}
+	atomic.StoreInt64(&w.pending, 0)
+	return NewBatch(), false
+}
+
+// Flush writes everything queued so far and returns the error of doing so.
+func (w *WriteBehind) Flush() error {
+	reply := make(chan error)
+	select {
+	case w.flushReq <- reply:
+		return <-reply
+	case <-w.done:
+		return wrapErr("flush", errClosed)
+	}
+}
+
+// Err returns the error of the last flush, or nil once one succeeds. Writes
+// are accepted while flushes fail, so this is how to tell the store is
+// behind.
+func (w *WriteBehind) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lastErr
+}
+
+// Stats returns how far behind the store the queue is.
+func (w *WriteBehind) Stats() QueueStats {
+	stats := QueueStats{
+		Queued:   len(w.queue),
+		Pending:  int(atomic.LoadInt64(&w.pending)),
+		Dropped:  atomic.LoadInt64(&w.dropped),
+		Flushed:  atomic.LoadInt64(&w.flushed),
+		Rejected: atomic.LoadInt64(&w.rejected),
+	}
+	if err := w.Err(); err != nil {
+		stats.LastError = err.Error()
+	}
+	return stats
+}
+
+func (w *WriteBehind) InsertContainer(container types.ContainerJSON, ip, daemon string) error {
+	return w.enqueue("insert container", func(b *Batch) { b.InsertContainer(container, ip, daemon) })
+}
+
+func (w *WriteBehind) UpdateContainer(container types.ContainerJSON, ip, daemon string) error {
+	return w.enqueue("update container", func(b *Batch) { b.UpdateContainer(container, ip, daemon) })
+}
+
+func (w *WriteBehind) MarkContainerRemoved(id string) error {
+	return w.enqueue("mark container removed", func(b *Batch) { b.MarkContainerRemoved(id) })
+}
+
+func (w *WriteBehind) InsertNoContainerNode(ip string) error {
+	return w.enqueue("insert NoContainer", func(b *Batch) { b.InsertNoContainerNode(ip) })
+}
+
+func (w *WriteBehind) InsertNetwork(network types.NetworkResource, daemon string) error {
+	return w.enqueue("insert network", func(b *Batch) { b.InsertNetwork(network, daemon) })
+}
+
+func (w *WriteBehind) RemoveNetwork(id string) error {
+	return w.enqueue("remove network", func(b *Batch) { b.RemoveNetwork(id) })
+}
+
+func (w *WriteBehind) SetAttachments(id string, attachments []Attachment) error {
+	return w.enqueue("set attachments", func(b *Batch) { b.SetAttachments(id, attachments) })
+}
+
+func (w *WriteBehind) AddDependency(edge Edge, app AppLayer) error {
+	return w.enqueue("add dependency", func(b *Batch) { b.AddDependency(edge, app) })
+}
+
+func (w *WriteBehind) UpdateDependencyAppLayer(edge Edge, app AppLayer) error {
+	return w.enqueue("update dependency", func(b *Batch) { b.UpdateDependencyAppLayer(edge, app) })
+}
+
+func (w *WriteBehind) AddDependencyMetrics(edge Edge, delta Metrics) error {
+	return w.enqueue("add dependency metrics", func(b *Batch) { b.AddDependencyMetrics(edge, delta) })
+}
+
+// WriteBatch queues the writes of b, merged as one.
+func (w *WriteBehind) WriteBatch(b *Batch) error {
+	return w.enqueue("write batch", func(dst *Batch) { dst.Merge(b) })
+}
+
+func (w *WriteBehind) Containers() ([]ContainerNode, error) {
+	return w.store.Containers()
+}
+
+func (w *WriteBehind) Networks() ([]NetworkNode, error) {
+	return w.store.Networks()
+}
+
+func (w *WriteBehind) HostContainers(hostname string) ([]ContainerNode, error) {
+	return w.store.HostContainers(hostname)
+}
+
+func (w *WriteBehind) HostNetworks(hostname string) ([]NetworkNode, error) {
+	return w.store.HostNetworks(hostname)
+}
+
+func (w *WriteBehind) NoContainers() ([]NoContainerNode, error) {
+	return w.store.NoContainers()
+}
+
+func (w *WriteBehind) Dependencies() ([]Edge, error) {
+	return w.store.Dependencies()
+}
+
+func (w *WriteBehind) ServiceDependencies() ([]ServiceEdge, error) {
+	return w.store.ServiceDependencies()
+}
+
+func (w *WriteBehind) Graph() (Graph, error) {
+	return w.store.Graph()
+}
+
+func (w *WriteBehind) Nodes() (Graph, error) {
+	return w.store.Nodes()
+}
+
+func (w *WriteBehind) ContainerDependencies(id string) ([]Dependency, error) {
+	return w.store.ContainerDependencies(id)
+}
+
+// Wipe writes what is queued, so that none of it survives, then wipes.
+func (w *WriteBehind) Wipe() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return w.store.Wipe()
+}
+
+// Close writes what is queued, making one last attempt if the store is
+// failing, and closes the store. It returns the error of that attempt.
+func (w *WriteBehind) Close() error {
+	w.once.Do(func() { close(w.stop) })
+	<-w.done
+	err := w.Err()
+	if closeErr := w.store.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -1,16 +1,69 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/lucianolacurcia/sprint-5/analyzer"
+	"github.com/lucianolacurcia/sprint-5/api"
+	"github.com/lucianolacurcia/sprint-5/cluster"
+	"github.com/lucianolacurcia/sprint-5/config"
+	"github.com/lucianolacurcia/sprint-5/engine"
 	"github.com/lucianolacurcia/sprint-5/graphDB"
 )
 
 func main() {
+	cfg, err := config.Load(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	command, args := "", []string(nil)
+	if len(cfg.Args) > 0 {
+		command, args = cfg.Args[0], cfg.Args[1:]
+	}
+	switch command {
+	case "":
+		err = runLive(cfg)
+	case "snapshot":
+		err = runSnapshot(cfg, args)
+	case "replay":
+		err = runReplay(cfg, args)
+	case "wipe":
+		err = runWipe(cfg, args)
+	case "migrate":
+		err = runMigrate(cfg, args)
+	case "collector":
+		err = runCollector(cfg, args)
+	default:
+		err = fmt.Errorf("unknown command %q", command)
+	}
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// How often the depth of the graph write queue is logged.
+const queueReportInterval = 30 * time.Second
+
+// runLive watches Docker and captures traffic until SIGINT or SIGTERM.
+func runLive(cfg config.Config) error {
 	// listen to os signals:
 	sigs := make(chan os.Signal, 1)
 	done := make(chan bool, 1)
@@ -22,21 +75,365 @@ func main() {
 		done <- true
 	}()
 
-	// TODO: parametrizar
-	graphDB.InitDB("neo4j://localhost:7687", "neo4j", "s3cr3t")
+	store, err := openLiveStore(cfg)
+	if err != nil {
+		return err
+	}
+
+	runtimes, err := openRuntimes(cfg)
+	if err != nil {
+		store.Close()
+		return err
+	}
+	defer closeRuntimes(runtimes)
+
+	feed := graphDB.NewFeed()
+	if err := analyzer.InitDockerAnalyzer(runtimes, graphDB.NewNotifier(store, feed)); err != nil {
+		store.Close()
+		return err
+	}
 
-	analyzer.InitDockerAnalyzer()
-	analyzer.InitTrafficAnalizer()
+	if cfg.Enabled(config.AnalyzerTraffic) {
+		if err := analyzer.InitTrafficAnalizer(captureOptions(cfg)); err != nil {
+			store.Close()
+			return err
+		}
+	}
+
+	stopAPI, err := startAPI(cfg, store, feed)
+	if err != nil {
+		store.Close()
+		return err
+	}
+	defer stopAPI()
 
 	go analyzer.ListenEvents()
+	if queue, ok := store.(*graphDB.WriteBehind); ok {
+		go reportQueue(queue, queueReportInterval)
+	}
+	if cfg.Docker.ReconcileInterval > 0 {
+		go analyzer.ReconcileEvery(cfg.Docker.ReconcileInterval)
+	}
 
-	go analyzer.MonitorAllContainers()
+	if cfg.Enabled(config.AnalyzerTraffic) {
+		analyzer.MonitorAllContainers()
+		go analyzer.ReportMetrics(cfg.Capture.MetricsInterval)
+	}
 
 	fmt.Println("awaiting signal")
 	<-done
 	fmt.Println("terminating...")
-	// TODO: eliminar nodos, apagar monitores
-	graphDB.DropDB()
+	analyzer.StopMonitors()
+	analyzer.FlushMetrics()
+	stopAPI()
+	reportHealth()
+	if mem, ok := store.(*graphDB.MemoryStore); ok {
+		if err := dumpGraph(mem, cfg.Store.DumpFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	// the graph is kept for the next run, use the wipe command to delete it
+	if err := store.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
 	fmt.Println("exiting")
+	return nil
+}
+
+// runSnapshot saves the current container inventory for a later replay.
+func runSnapshot(cfg config.Config, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: snapshot FILE")
+	}
+	runtimes, err := openRuntimes(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeRuntimes(runtimes)
+	if err := analyzer.InitDockerAnalyzer(runtimes, graphDB.NewMemoryStore()); err != nil {
+		return err
+	}
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	if err := analyzer.WriteInventory(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// runReplay builds the graph from capture files and an inventory snapshot.
+func runReplay(cfg config.Config, args []string) (err error) {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	inventory := fs.String("inventory", "", "container inventory written by the snapshot command")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *inventory == "" || fs.NArg() == 0 {
+		return fmt.Errorf("usage: replay -inventory FILE PCAP...")
+	}
+
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	// closing writes whatever is still queued
+	defer func() {
+		if closeErr := store.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	f, err := os.Open(*inventory)
+	if err != nil {
+		return err
+	}
+	err = analyzer.LoadInventory(f, store)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err := analyzer.InitTrafficAnalizer(captureOptions(cfg)); err != nil {
+		return err
+	}
+	if err := analyzer.ReplayPcaps(fs.Args()); err != nil {
+		return err
+	}
+	if mem, ok := store.(*graphDB.MemoryStore); ok {
+		return dumpGraph(mem, cfg.Store.DumpFile)
+	}
+	return nil
+}
+
+// reportHealth prints the components the analyzer could not keep up to
+// date, if any.
+func reportHealth() {
+	report := analyzer.Health()
+	if !report.Degraded {
+		return
+	}
+	fmt.Fprintln(os.Stderr, "ran degraded:")
+	for _, p := range report.Problems {
+		fmt.Fprintf(os.Stderr, "  %s since %s: %s\n", p.Component, p.Since.Format(time.RFC3339), p.Error)
+	}
+}
+
+// runWipe deletes the nodes and relationships written by docker-topology
+// from the store.
+func runWipe(cfg config.Config, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: wipe")
+	}
+	if cfg.Store.Backend == config.StoreNeo4j {
+		return graphDB.WipeNeo4j(cfg.Neo4j.URL, cfg.Neo4j.User, cfg.Neo4j.Password, cfg.Neo4j.Database)
+	}
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	return store.Wipe()
+}
+
+// runMigrate tags the nodes written by versions older than the owner
+// property, once, so that wipe deletes them too.
+func runMigrate(cfg config.Config, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: migrate")
+	}
+	if cfg.Store.Backend != config.StoreNeo4j {
+		return fmt.Errorf("migrate only applies to the %s store", config.StoreNeo4j)
+	}
+	containers, noContainers, err := graphDB.ClaimLegacyNeo4j(cfg.Neo4j.URL, cfg.Neo4j.User, cfg.Neo4j.Password, cfg.Neo4j.Database)
+	log.Printf("migrate: tagged %d Container and %d NoContainer nodes written without an owner", containers, noContainers)
+	return err
+}
+
+// runCollector applies what agents push to the store until SIGINT or
+// SIGTERM.
+func runCollector(cfg config.Config, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: collector")
+	}
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := store.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+	shared, ok := store.(graphDB.SharedStore)
+	if !ok {
+		return fmt.Errorf("the %s store cannot take the writes of agents", cfg.Store.Backend)
+	}
+	feed := graphDB.NewFeed()
+	collector, err := cluster.NewCollector(graphDB.NewNotifier(shared, feed), clusterTLS(cfg))
+	if err != nil {
+		return err
+	}
+	l, err := collector.Listen(cfg.Cluster.Listen)
+	if err != nil {
+		return err
+	}
+	if queue, ok := store.(*graphDB.WriteBehind); ok {
+		go reportQueue(queue, queueReportInterval)
+	}
+	stopAPI, err := startAPI(cfg, store, feed)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	defer stopAPI()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	served := make(chan error, 1)
+	go func() { served <- collector.Serve(l) }()
+	log.Printf("collector listening on %s", l.Addr())
+	select {
+	case sig := <-sigs:
+		fmt.Println(sig)
+		collector.Stop()
+	case err := <-served:
+		return err
+	}
+	if mem, ok := store.(*graphDB.MemoryStore); ok {
+		return dumpGraph(mem, cfg.Store.DumpFile)
+	}
+	return nil
+}
+
+// How long the query API is given to answer the requests in progress on
+// exit.
+const apiShutdownTimeout = 5 * time.Second
+
+// startAPI serves the query API on the graph of store and the changes of
+// feed, unless it is turned off, and returns the function stopping it.
+func startAPI(cfg config.Config, store graphDB.TopologyStore, feed *graphDB.Feed) (func(), error) {
+	reader, ok := store.(graphDB.GraphReader)
+	if cfg.API.Listen == "" || !ok {
+		return func() {}, nil
+	}
+	l, err := net.Listen("tcp", cfg.API.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("api: %w", err)
+	}
+	handler := api.New(reader, feed, api.Options{Origins: cfg.API.Origins})
+	server := &http.Server{Handler: handler}
+	server.RegisterOnShutdown(handler.Close)
+	go func() {
+		if err := server.Serve(l); err != http.ErrServerClosed {
+			log.Printf("api: %v", err)
+		}
+	}()
+	log.Printf("query API listening on http://%s/v1/", l.Addr())
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), apiShutdownTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+	}, nil
+}
+
+func captureOptions(cfg config.Config) analyzer.CaptureOptions {
+	return analyzer.CaptureOptions{
+		Snaplen:      int32(cfg.Capture.Snaplen),
+		Promiscuous:  cfg.Capture.Promiscuous,
+		BPFFilter:    cfg.Capture.BPFFilter,
+		BPFOverrides: cfg.Capture.BPFOverrides,
+	}
+}
+
+// openRuntimes connects to every daemon of the configuration.
+func openRuntimes(cfg config.Config) ([]engine.Runtime, error) {
+	var runtimes []engine.Runtime
+	for _, d := range cfg.Docker.AllDaemons() {
+		rt, err := engine.New(engine.Endpoint{
+			Runtime: d.Runtime,
+			Host:    d.Host,
+			TLSCA:   d.TLSCA,
+			TLSCert: d.TLSCert,
+			TLSKey:  d.TLSKey,
+		})
+		if err != nil {
+			closeRuntimes(runtimes)
+			return nil, fmt.Errorf("%s %s: %w", d.Runtime, d.Host, err)
+		}
+		runtimes = append(runtimes, rt)
+	}
+	return runtimes, nil
+}
+
+func closeRuntimes(runtimes []engine.Runtime) {
+	for _, rt := range runtimes {
+		rt.Close()
+	}
+}
+
+// openLiveStore returns where the live command writes: the collector, when
+// running as an agent, or the store.
+func openLiveStore(cfg config.Config) (graphDB.TopologyStore, error) {
+	if cfg.Cluster.Collector == "" {
+		return openStore(cfg)
+	}
+	return cluster.NewAgent(cluster.AgentOptions{
+		Collector:    cfg.Cluster.Collector,
+		TLS:          clusterTLS(cfg),
+		PushInterval: cfg.Cluster.PushInterval,
+		BufferSize:   cfg.Cluster.BufferSize,
+	})
+}
+
+func clusterTLS(cfg config.Config) cluster.TLS {
+	return cluster.TLS{CA: cfg.Cluster.TLSCA, Cert: cfg.Cluster.TLSCert, Key: cfg.Cluster.TLSKey}
+}
+
+func openStore(cfg config.Config) (graphDB.TopologyStore, error) {
+	if cfg.Store.Backend == config.StoreMemory {
+		return graphDB.NewMemoryStore(), nil
+	}
+	store, err := graphDB.NewNeo4jStore(cfg.Neo4j.URL, cfg.Neo4j.User, cfg.Neo4j.Password, cfg.Neo4j.Database)
+	if err != nil || cfg.Store.QueueSize == 0 {
+		return store, err
+	}
+	return graphDB.NewWriteBehind(store, graphDB.QueueOptions{
+		Size:          cfg.Store.QueueSize,
+		BatchSize:     cfg.Store.BatchSize,
+		FlushInterval: cfg.Store.FlushInterval,
+		Policy:        cfg.Store.QueuePolicy,
+	}), nil
+}
+
+// reportQueue logs every interval how many graph writes are waiting, while
+// any are, and how many were dropped.
+func reportQueue(queue *graphDB.WriteBehind, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var dropped int64
+	for range ticker.C {
+		stats := queue.Stats()
+		if stats.Queued+stats.Pending == 0 && stats.Dropped == dropped {
+			continue
+		}
+		log.Printf("write queue: %d queued, %d pending, %d dropped", stats.Queued, stats.Pending, stats.Dropped-dropped)
+		dropped = stats.Dropped
+	}
+}
 
+func dumpGraph(mem *graphDB.MemoryStore, path string) error {
+	if path == "" {
+		return mem.WriteJSON(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := mem.WriteJSON(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
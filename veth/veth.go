@@ -0,0 +1,172 @@
+// Package veth finds the host side interfaces of container network
+// namespaces using netlink, without calling out to docker or iproute2.
+package veth
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// Interface is a network interface inside a container namespace together
+// with its peer on the host, if it has one.
+type Interface struct {
+	// Name and Index identify the interface inside the container, e.g. eth0.
+	Name  string
+	Index int
+	MAC   string
+	Addrs []net.IPNet
+	// HostName and HostIndex identify the veth peer in the host namespace.
+	// They are empty for interfaces without a peer, such as macvlan.
+	HostName  string
+	HostIndex int
+	// NetNS is the namespace file the interface lives in, set when its
+	// host peer is out of reach, as with rootless Podman whose veths end in
+	// a namespace of their own. Traffic is then read on Name inside NetNS.
+	NetNS string
+}
+
+// CaptureName identifies where the traffic of the interface is read: the
+// host peer, or the interface itself inside NetNS. It is empty when there
+// is nowhere to read from.
+func (i Interface) CaptureName() string {
+	switch {
+	case i.NetNS != "":
+		return i.NetNS + ":" + i.Name
+	case i.HostName != "":
+		return i.HostName
+	}
+	return ""
+}
+
+// HasIP reports whether ip is assigned to the interface.
+func (i Interface) HasIP(ip net.IP) bool {
+	for _, a := range i.Addrs {
+		if a.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Discover returns every non loopback interface in the network namespace
+// of the process pid.
+func Discover(pid int) ([]Interface, error) {
+	if pid <= 0 {
+		return nil, fmt.Errorf("invalid pid %d, is the container running?", pid)
+	}
+	return DiscoverPath(fmt.Sprintf("/proc/%d/ns/net", pid))
+}
+
+// DiscoverPath is like Discover but takes the path of a namespace file,
+// such as /proc/<pid>/ns/net or /run/netns/<name>.
+func DiscoverPath(nsPath string) ([]Interface, error) {
+	return discover(nsPath, true)
+}
+
+// DiscoverDetached is like Discover for namespaces whose veth peers are not
+// in the host namespace, where looking them up by index would find
+// unrelated interfaces. The interfaces returned have NetNS set instead of a
+// host peer.
+func DiscoverDetached(pid int) ([]Interface, error) {
+	if pid <= 0 {
+		return nil, fmt.Errorf("invalid pid %d, is the container running?", pid)
+	}
+	return discover(fmt.Sprintf("/proc/%d/ns/net", pid), false)
+}
+
+func discover(nsPath string, peers bool) ([]Interface, error) {
+	ns, err := netns.GetFromPath(nsPath)
+	if err != nil {
+		return nil, fmt.Errorf("opening netns %s: %w", nsPath, err)
+	}
+	defer ns.Close()
+
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return nil, fmt.Errorf("netlink in %s: %w", nsPath, err)
+	}
+	defer h.Delete()
+
+	links, err := h.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("listing links in %s: %w", nsPath, err)
+	}
+
+	var ifaces []Interface
+	for _, link := range links {
+		attrs := link.Attrs()
+		if attrs.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		iface := Interface{
+			Name:  attrs.Name,
+			Index: attrs.Index,
+			MAC:   attrs.HardwareAddr.String(),
+		}
+		addrs, err := h.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, fmt.Errorf("listing addresses of %s in %s: %w", attrs.Name, nsPath, err)
+		}
+		for _, a := range addrs {
+			iface.Addrs = append(iface.Addrs, *a.IPNet)
+		}
+		// For a veth, IFLA_LINK holds the ifindex of its peer, which lives in
+		// the host namespace.
+		if !peers {
+			iface.NetNS = nsPath
+		} else if link.Type() == "veth" && attrs.ParentIndex > 0 {
+			peer, err := netlink.LinkByIndex(attrs.ParentIndex)
+			if err != nil {
+				return nil, fmt.Errorf("host peer of %s (ifindex %d): %w", attrs.Name, attrs.ParentIndex, err)
+			}
+			iface.HostName = peer.Attrs().Name
+			iface.HostIndex = peer.Attrs().Index
+		}
+		ifaces = append(ifaces, iface)
+	}
+	return ifaces, nil
+}
+
+// Do runs fn on an OS thread switched to the network namespace at nsPath.
+// Sockets opened by fn stay in that namespace. The thread is discarded
+// afterwards rather than switched back.
+func Do(nsPath string, fn func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		// never unlocked: the thread exits with the goroutine
+		runtime.LockOSThread()
+		ns, err := netns.GetFromPath(nsPath)
+		if err != nil {
+			errc <- fmt.Errorf("opening netns %s: %w", nsPath, err)
+			return
+		}
+		defer ns.Close()
+		if err := netns.Set(ns); err != nil {
+			errc <- fmt.Errorf("entering netns %s: %w", nsPath, err)
+			return
+		}
+		errc <- fn()
+	}()
+	return <-errc
+}
+
+// ByNetwork matches interfaces to networks using the MAC address each
+// network assigned to the container. Interfaces whose MAC is not listed are
+// left out.
+func ByNetwork(ifaces []Interface, macByNetwork map[string]string) map[string]Interface {
+	out := make(map[string]Interface)
+	for network, mac := range macByNetwork {
+		for _, iface := range ifaces {
+			if mac != "" && strings.EqualFold(iface.MAC, mac) {
+				out[network] = iface
+				break
+			}
+		}
+	}
+	return out
+}